@@ -1,211 +1,423 @@
 package treeagent
 
-import "math"
+import (
+	"fmt"
+	"math"
+)
 
 // A TreeAlgorithm is an algorithm for building trees.
 //
 // Different tree algorithms solve different objectives.
 // Thus, different step sizes may be best for different
 // tree algorithms.
-type TreeAlgorithm int
+//
+// New algorithms can be implemented outside of this
+// package and made discoverable by name with
+// RegisterAlgorithm.
+type TreeAlgorithm interface {
+	// String returns a unique, human-readable name for
+	// the algorithm, like "mse" or "abs".
+	String() string
+
+	// NeedsCurvature returns true if the algorithm uses
+	// the Curvature field of GradientSamples.
+	// Computing curvatures is relatively expensive, so it
+	// is only done for algorithms which need it.
+	NeedsCurvature() bool
+
+	// SplitTracker creates a SplitTracker which decides
+	// how good splits are.
+	//
+	// The l2 argument is the builder's LeafL2, which may
+	// affect the splitting criterion.
+	SplitTracker(l2 float64) SplitTracker
 
-// TreeAlgorithms contains all supported TreeAlgorithms.
-var TreeAlgorithms = []TreeAlgorithm{
-	SumAlgorithm,
-	MSEAlgorithm,
-	BalancedSumAlgorithm,
-	StddevAlgorithm,
-	SignAlgorithm,
-	AbsAlgorithm,
+	// LeafParams computes the parameters for a leaf.
+	//
+	// The leafData argument contains the samples in the
+	// leaf, while allData contains all of the samples in
+	// the tree.
+	// The l2 argument is the builder's LeafL2.
+	//
+	// The result may not be modified by the caller, and
+	// it should not alias any gradients.
+	LeafParams(leafData, allData []*GradientSample, l2 float64) []float64
+
+	// PostProcess is applied to every tree once it has
+	// been built.
+	// It may modify the tree in place or return a new
+	// tree.
+	PostProcess(t *Tree) *Tree
 }
 
-const (
+// These are the built-in TreeAlgorithms.
+var (
 	// SumAlgorithm constructs a tree where the leaf nodes
 	// contain gradient sums for the repersented samples.
-	SumAlgorithm TreeAlgorithm = iota
+	SumAlgorithm TreeAlgorithm = &builtinAlgorithm{
+		name:       "sum",
+		newTracker: func(l2 float64) SplitTracker { return &sumTracker{} },
+		leafParams: sumLeafParams,
+		sumLeaves:  true,
+	}
 
 	// MSEAlgorithm constructs a tree by minimizing
 	// mean-squared error over gradients.
-	MSEAlgorithm
+	MSEAlgorithm TreeAlgorithm = &builtinAlgorithm{
+		name:       "mse",
+		newTracker: func(l2 float64) SplitTracker { return &meanTracker{} },
+		leafParams: meanLeafParams,
+	}
 
 	// BalancedSumAlgorithm is similar to SumAlgorithm,
 	// but splits are biased towards balanced trees.
-	BalancedSumAlgorithm
+	BalancedSumAlgorithm TreeAlgorithm = &builtinAlgorithm{
+		name:       "balancedsum",
+		newTracker: func(l2 float64) SplitTracker { return &balancedSumTracker{} },
+		leafParams: sumLeafParams,
+		sumLeaves:  true,
+	}
 
 	// StddevAlgorithm has the same objective as MSE and
 	// mean, but it uses a splitting criteria based on
 	// gradient standard deviations.
-	StddevAlgorithm
+	StddevAlgorithm TreeAlgorithm = &builtinAlgorithm{
+		name:       "stddev",
+		newTracker: func(l2 float64) SplitTracker { return &stddevTracker{} },
+		leafParams: meanLeafParams,
+	}
 
 	// SignAlgorithm maximizes the dot products between
 	// sums of gradients and the sums' sign.
 	// The resulting leaf parameters have values 0, 1, or
 	// -1.
-	SignAlgorithm
+	SignAlgorithm TreeAlgorithm = &builtinAlgorithm{
+		name:       "sign",
+		newTracker: func(l2 float64) SplitTracker { return &signTracker{} },
+		leafParams: func(leafData, allData []*GradientSample, l2 float64) Vector {
+			return sumGradients(leafData).Signs()
+		},
+		signs: true,
+	}
 
 	// AbsAlgorithm uses the same splitting criteria as
 	// SignAlgorithm, but it uses the gradient means in
 	// the leaves instead of the gradient signs.
-	AbsAlgorithm
+	AbsAlgorithm TreeAlgorithm = &builtinAlgorithm{
+		name:       "abs",
+		newTracker: func(l2 float64) SplitTracker { return &signTracker{} },
+		leafParams: meanLeafParams,
+	}
+
+	// NewtonAlgorithm uses second-order information to
+	// take approximate Newton steps.
+	// Leaves contain gradient sums divided by curvature
+	// sums, and splits maximize the improvement predicted
+	// by a second-order approximation of the objective.
+	//
+	// The curvature is the absolute value of the diagonal
+	// of the objective's Hessian with respect to the
+	// action parameters.
+	// Since leaves are approximate Newton steps, a step
+	// size of 1 is a natural choice.
+	// When curvatures are small, Builder.LeafL2 can be
+	// used to prevent huge steps.
+	NewtonAlgorithm TreeAlgorithm = &builtinAlgorithm{
+		name:       "newton",
+		newTracker: func(l2 float64) SplitTracker { return &newtonTracker{l2: l2} },
+		leafParams: newtonLeafParams,
+		curvature:  true,
+	}
 )
 
-// String returns a human-readable representation of the
-// algorithm, like "mse" or "abs".
-func (t TreeAlgorithm) String() string {
-	switch t {
-	case SumAlgorithm:
-		return "sum"
-	case MSEAlgorithm:
-		return "mse"
-	case BalancedSumAlgorithm:
-		return "balancedsum"
-	case StddevAlgorithm:
-		return "stddev"
-	case SignAlgorithm:
-		return "sign"
-	case AbsAlgorithm:
-		return "abs"
-	default:
-		return ""
-	}
-}
-
-func (t TreeAlgorithm) splitTracker() splitTracker {
-	switch t {
-	case SumAlgorithm:
-		return &sumTracker{}
-	case MSEAlgorithm:
-		return &meanTracker{}
-	case BalancedSumAlgorithm:
-		return &balancedSumTracker{}
-	case StddevAlgorithm:
-		return &stddevTracker{}
-	case SignAlgorithm, AbsAlgorithm:
-		return &signTracker{}
-	default:
-		panic("unknown tree algorithm")
-	}
-}
-
-func (t TreeAlgorithm) leafParams(leafData, allData []*gradientSample) smallVec {
-	switch t {
-	case SignAlgorithm:
-		return sumGradients(leafData).Signs()
-	case SumAlgorithm, BalancedSumAlgorithm:
-		return sumGradients(leafData).Scale(1 / float64(len(allData)))
-	case MSEAlgorithm, StddevAlgorithm, AbsAlgorithm:
-		return sumGradients(leafData).Scale(1 / float64(len(leafData)))
-	default:
-		panic("unknown tree algorithm")
-	}
-}
-
-// A splitTracker dynamically computes how good splits are
+// TreeAlgorithms contains all registered TreeAlgorithms,
+// starting with the built-in ones.
+var TreeAlgorithms = []TreeAlgorithm{
+	SumAlgorithm,
+	MSEAlgorithm,
+	BalancedSumAlgorithm,
+	StddevAlgorithm,
+	SignAlgorithm,
+	AbsAlgorithm,
+	NewtonAlgorithm,
+}
+
+// RegisterAlgorithm adds an algorithm to TreeAlgorithms
+// so that it can be found with LookupAlgorithm.
+//
+// It panics if an algorithm with the same name is already
+// registered.
+// RegisterAlgorithm is not safe to call concurrently, so
+// it is typically called from an init function.
+func RegisterAlgorithm(t TreeAlgorithm) {
+	if _, ok := LookupAlgorithm(t.String()); ok {
+		panic(fmt.Sprintf("algorithm already registered: %s", t))
+	}
+	TreeAlgorithms = append(TreeAlgorithms, t)
+}
+
+// LookupAlgorithm finds a registered algorithm by name.
+func LookupAlgorithm(name string) (TreeAlgorithm, bool) {
+	for _, t := range TreeAlgorithms {
+		if t.String() == name {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// builtinAlgorithm implements the built-in algorithms.
+type builtinAlgorithm struct {
+	name       string
+	newTracker func(l2 float64) SplitTracker
+	leafParams func(leafData, allData []*GradientSample, l2 float64) Vector
+	curvature  bool
+	signs      bool
+
+	// sumLeaves is true if leaf values are proportional
+	// to gradient sums rather than means.
+	sumLeaves bool
+}
+
+func (b *builtinAlgorithm) String() string {
+	return b.name
+}
+
+func (b *builtinAlgorithm) NeedsCurvature() bool {
+	return b.curvature
+}
+
+func (b *builtinAlgorithm) SplitTracker(l2 float64) SplitTracker {
+	return b.newTracker(l2)
+}
+
+func (b *builtinAlgorithm) LeafParams(leafData, allData []*GradientSample,
+	l2 float64) []float64 {
+	return b.leafParams(leafData, allData, l2)
+}
+
+func (b *builtinAlgorithm) PostProcess(t *Tree) *Tree {
+	if b.signs {
+		return SignTree(t)
+	}
+	return t
+}
+
+// The following functions compute leaf parameters for
+// the built-in algorithms.
+//
+// The l2 argument is an L2 penalty on the leaf values.
+// It shrinks leaves by a factor of n/(n+l2), where n is
+// the total weight of the samples in the leaf, so that
+// leaves with few samples are shrunk the most.
+// For mean-based algorithms, this is like adding l2 zero
+// gradients to the leaf.
+// Sign leaves are not shrunk.
+
+func sumLeafParams(leafData, allData []*GradientSample, l2 float64) Vector {
+	n := totalWeight(leafData)
+	return sumGradients(leafData).Scale(n / (totalWeight(allData) * (n + l2)))
+}
+
+func meanLeafParams(leafData, allData []*GradientSample, l2 float64) Vector {
+	n := totalWeight(leafData)
+	return sumGradients(leafData).Scale(1 / (n + l2))
+}
+
+func newtonLeafParams(leafData, allData []*GradientSample, l2 float64) Vector {
+	grad := sumGradients(leafData)
+	curvature := sumCurvatures(leafData)
+	for i, g := range grad {
+		grad[i] = newtonStep(g, curvature[i], l2)
+	}
+	return grad
+}
+
+// A SplitTracker dynamically computes how good splits are
 // on a spectrum of possible splits.
-type splitTracker interface {
-	Reset(rightSamples []*gradientSample)
-	MoveToLeft(sample *gradientSample)
+//
+// A split is evaluated by moving samples, one at a time,
+// from the right side of the split to the left side.
+type SplitTracker interface {
+	// Reset puts all of the samples on the right side.
+	Reset(rightSamples []*GradientSample)
+
+	// MoveToLeft moves a sample from the right side to
+	// the left side.
+	MoveToLeft(sample *GradientSample)
+
+	// Quality computes the quality of the current split.
+	// Higher is better.
 	Quality() float64
+
+	// Gain computes the improvement in quality over the
+	// parent, i.e. over putting every sample on one side.
+	Gain() float64
 }
 
-// A sumTracker is a splitTracker for SumAlgorithm.
+// A BinTracker is a SplitTracker which can move an entire
+// histogram bin at once.
+//
+// Trackers which do not implement BinTracker can still
+// be used with histograms, but they are slower.
+// SplitTrackers from custom TreeAlgorithms may implement
+// BinTracker to get the same speedup as the built-in
+// trackers.
+type BinTracker interface {
+	SplitTracker
+	MoveBinToLeft(bin *HistogramBin)
+}
+
+// A sumTracker is a SplitTracker for SumAlgorithm.
 type sumTracker struct {
-	leftSum  smallVec
-	rightSum smallVec
+	leftSum  Vector
+	rightSum Vector
+
+	// parent is the quality before any samples were
+	// moved to the left.
+	parent float64
 }
 
-func (s *sumTracker) Reset(rightSamples []*gradientSample) {
+func (s *sumTracker) Reset(rightSamples []*GradientSample) {
 	s.rightSum = sumGradients(rightSamples)
-	s.leftSum = make(smallVec, len(s.rightSum))
+	s.leftSum = make(Vector, len(s.rightSum))
+	s.parent = s.Quality()
 }
 
-func (s *sumTracker) MoveToLeft(sample *gradientSample) {
+func (s *sumTracker) MoveToLeft(sample *GradientSample) {
 	s.rightSum.Sub(sample.Gradient)
 	s.leftSum.Add(sample.Gradient)
 }
 
+func (s *sumTracker) MoveBinToLeft(bin *HistogramBin) {
+	s.rightSum.Sub(bin.Sum)
+	s.leftSum.Add(bin.Sum)
+}
+
 func (s *sumTracker) Quality() float64 {
 	var sum float64
-	for _, vec := range []smallVec{s.leftSum, s.rightSum} {
+	for _, vec := range []Vector{s.leftSum, s.rightSum} {
 		sum += vec.Dot(vec)
 	}
 	return sum
 }
 
-// A meanTracker is a splitTracker for MSEAlgorithm.
+func (s *sumTracker) Gain() float64 {
+	return s.Quality() - s.parent
+}
+
+// A meanTracker is a SplitTracker for MSEAlgorithm.
 //
 // There are many equivalent ways to write this splitting
 // criterion.
 // This particular mean-based implementation was selected
 // for its fast MoveToLeft and Reset routines.
+//
+// Sample counts are measured by total sample weight.
 type meanTracker struct {
 	sumTracker
-	leftCount  int
-	rightCount int
+	leftCount  float64
+	rightCount float64
 }
 
-func (m *meanTracker) Reset(rightSamples []*gradientSample) {
+func (m *meanTracker) Reset(rightSamples []*GradientSample) {
 	m.sumTracker.Reset(rightSamples)
 	m.leftCount = 0
-	m.rightCount = len(rightSamples)
+	m.rightCount = totalWeight(rightSamples)
+	m.parent = m.Quality()
 }
 
-func (m *meanTracker) MoveToLeft(sample *gradientSample) {
+func (m *meanTracker) MoveToLeft(sample *GradientSample) {
 	m.sumTracker.MoveToLeft(sample)
-	m.leftCount++
-	m.rightCount--
+	w := sample.Weight()
+	m.leftCount += w
+	m.rightCount -= w
+}
+
+func (m *meanTracker) MoveBinToLeft(bin *HistogramBin) {
+	m.sumTracker.MoveBinToLeft(bin)
+	m.leftCount += bin.Weight
+	m.rightCount -= bin.Weight
 }
 
 func (m *meanTracker) Quality() float64 {
-	sums := []smallVec{m.leftSum, m.rightSum}
-	counts := []int{m.leftCount, m.rightCount}
+	sums := []Vector{m.leftSum, m.rightSum}
+	counts := []float64{m.leftCount, m.rightCount}
 
 	var sum float64
 	for i, vec := range sums {
-		sum += vec.Dot(vec) / float64(counts[i])
+		if counts[i] > 0 {
+			sum += vec.Dot(vec) / counts[i]
+		}
 	}
 
 	return sum
 }
 
-// A balancedSumTracker is a splitTracker for
+func (m *meanTracker) Gain() float64 {
+	return m.Quality() - m.parent
+}
+
+// A balancedSumTracker is a SplitTracker for
 // BalancedSumAlgorithm.
 type balancedSumTracker struct {
 	meanTracker
 }
 
+func (b *balancedSumTracker) Reset(rightSamples []*GradientSample) {
+	b.meanTracker.Reset(rightSamples)
+	b.parent = b.Quality()
+}
+
 func (b *balancedSumTracker) Quality() float64 {
-	return b.sumTracker.Quality() * float64(b.leftCount*b.rightCount)
+	return b.sumTracker.Quality() * b.leftCount * b.rightCount
+}
+
+func (b *balancedSumTracker) Gain() float64 {
+	return b.Quality() - b.parent
 }
 
-// A stddevTracker is a splitTracker for StddevAlgorithm.
+// A stddevTracker is a SplitTracker for StddevAlgorithm.
+//
+// The squares are those of the unweighted gradients,
+// multiplied by the sample weights.
 type stddevTracker struct {
 	meanTracker
 	leftSquares  float64
 	rightSquares float64
 }
 
-func (s *stddevTracker) Reset(rightSamples []*gradientSample) {
+func (s *stddevTracker) Reset(rightSamples []*GradientSample) {
 	s.meanTracker.Reset(rightSamples)
 	s.leftSquares = 0
 	s.rightSquares = 0
 	for _, sample := range rightSamples {
-		s.rightSquares += sample.Gradient.Dot(sample.Gradient)
+		s.rightSquares += weightedSquare(sample)
 	}
+	s.parent = s.Quality()
 }
 
-func (s *stddevTracker) MoveToLeft(sample *gradientSample) {
+func (s *stddevTracker) MoveToLeft(sample *GradientSample) {
 	s.meanTracker.MoveToLeft(sample)
-	sq := sample.Gradient.Dot(sample.Gradient)
+	sq := weightedSquare(sample)
 	s.leftSquares += sq
 	s.rightSquares -= sq
 }
 
+func (s *stddevTracker) MoveBinToLeft(bin *HistogramBin) {
+	s.meanTracker.MoveBinToLeft(bin)
+	s.leftSquares += bin.Squares
+	s.rightSquares -= bin.Squares
+}
+
 func (s *stddevTracker) Quality() float64 {
 	// Equivalent to minimizing N1*stddev1 + N2*stddev2
 	left, right := s.leftRightErrors()
-	return -(math.Sqrt(float64(s.leftCount)*left) +
-		math.Sqrt(float64(s.rightCount)*right))
+	return -(math.Sqrt(s.leftCount*left) + math.Sqrt(s.rightCount*right))
+}
+
+func (s *stddevTracker) Gain() float64 {
+	return s.Quality() - s.parent
 }
 
 func (s *stddevTracker) leftRightErrors() (left, right float64) {
@@ -218,27 +430,105 @@ func (s *stddevTracker) leftRightErrors() (left, right float64) {
 	//     Error = (x1^2 + ... + xn^2) - (x1 + ... + xn)^2/n
 	//
 
-	sums := []smallVec{s.sumTracker.leftSum, s.sumTracker.rightSum}
+	sums := []Vector{s.sumTracker.leftSum, s.sumTracker.rightSum}
 	sqSums := []float64{s.leftSquares, s.rightSquares}
-	counts := []int{s.leftCount, s.rightCount}
+	counts := []float64{s.leftCount, s.rightCount}
 
 	reses := make([]float64, 2)
 	for i, sum := range sums {
-		n := float64(counts[i])
-		if n == 0 {
+		n := counts[i]
+		if n <= 0 {
 			continue
 		}
-		reses[i] = sqSums[i] - sum.Dot(sum)/n
+		// Rounding error can make the result negative.
+		reses[i] = math.Max(0, sqSums[i]-sum.Dot(sum)/n)
 	}
 
 	return reses[0], reses[1]
 }
 
-// signTracker is a splitTracker for SignAlgorithm.
+// weightedSquare computes the squared norm of a sample's
+// unweighted gradient, multiplied by the sample's weight.
+func weightedSquare(sample *GradientSample) float64 {
+	sq := sample.Gradient.Dot(sample.Gradient)
+	if w := sample.Weight(); w != 1 {
+		if w == 0 {
+			return 0
+		}
+		sq /= w
+	}
+	return sq
+}
+
+// signTracker is a SplitTracker for SignAlgorithm.
 type signTracker struct {
 	sumTracker
 }
 
+func (s *signTracker) Reset(rightSamples []*GradientSample) {
+	s.sumTracker.Reset(rightSamples)
+	s.parent = s.Quality()
+}
+
 func (s *signTracker) Quality() float64 {
 	return s.leftSum.AbsSum() + s.rightSum.AbsSum()
 }
+
+func (s *signTracker) Gain() float64 {
+	return s.Quality() - s.parent
+}
+
+// newtonTracker is a SplitTracker for NewtonAlgorithm.
+type newtonTracker struct {
+	sumTracker
+	leftCurvature  Vector
+	rightCurvature Vector
+	l2             float64
+}
+
+func (n *newtonTracker) Reset(rightSamples []*GradientSample) {
+	n.sumTracker.Reset(rightSamples)
+	n.rightCurvature = sumCurvatures(rightSamples)
+	n.leftCurvature = make(Vector, len(n.rightCurvature))
+	n.parent = n.Quality()
+}
+
+func (n *newtonTracker) MoveToLeft(sample *GradientSample) {
+	n.sumTracker.MoveToLeft(sample)
+	n.rightCurvature.Sub(sample.Curvature)
+	n.leftCurvature.Add(sample.Curvature)
+}
+
+func (n *newtonTracker) MoveBinToLeft(bin *HistogramBin) {
+	n.sumTracker.MoveBinToLeft(bin)
+	n.rightCurvature.Sub(bin.Curvature)
+	n.leftCurvature.Add(bin.Curvature)
+}
+
+func (n *newtonTracker) Quality() float64 {
+	// The second-order improvement from a Newton step is
+	// proportional to g^2/h for each parameter.
+	var sum float64
+	for i, g := range n.leftSum {
+		sum += g * newtonStep(g, n.leftCurvature[i], n.l2)
+	}
+	for i, g := range n.rightSum {
+		sum += g * newtonStep(g, n.rightCurvature[i], n.l2)
+	}
+	return sum
+}
+
+func (n *newtonTracker) Gain() float64 {
+	return n.Quality() - n.parent
+}
+
+// newtonStep computes a Newton step for a gradient and
+// curvature with an L2 penalty.
+// If there is no curvature or penalty, the step is 0.
+func newtonStep(grad, curvature, l2 float64) float64 {
+	denom := curvature + l2
+	if denom <= 0 {
+		return 0
+	}
+	return grad / denom
+}
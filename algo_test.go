@@ -4,6 +4,7 @@ import (
 	"math"
 	"math/rand"
 	"reflect"
+	"sync/atomic"
 	"testing"
 
 	"github.com/unixpickle/essentials"
@@ -17,18 +18,165 @@ func TestStddevTracker(t *testing.T) {
 	testTrackersEquivalent(t, &stddevTracker{}, &naiveStddevTracker{})
 }
 
-func testTrackersEquivalent(t *testing.T, t1, t2 splitTracker) {
-	samples := make([]*gradientSample, 100)
-	for i := range samples {
-		samples[i] = &gradientSample{Gradient: make([]float64, 5)}
-		for j := range samples[i].Gradient {
-			samples[i].Gradient[j] = rand.NormFloat64()
+func TestTrackerBins(t *testing.T) {
+	for _, algo := range TreeAlgorithms {
+		samples := testingGradientSamples(20, 3)
+		t1 := algo.SplitTracker(0.5)
+		t2 := algo.SplitTracker(0.5).(BinTracker)
+		t1.Reset(samples)
+		t2.Reset(samples)
+		for start := 0; start < 15; start += 5 {
+			var bin HistogramBin
+			for _, sample := range samples[start : start+5] {
+				t1.MoveToLeft(sample)
+				bin.Add(sample)
+			}
+			t2.MoveBinToLeft(&bin)
+			q1, q2 := t1.Quality(), t2.Quality()
+			if math.Abs(q1-q2) > 1e-8*math.Max(1, math.Abs(q1)) {
+				t.Errorf("%s: expected quality %f but got %f", algo, q1, q2)
+			}
+		}
+	}
+}
+
+func TestTrackerGain(t *testing.T) {
+	samples := testingGradientSamples(20, 3)
+	for _, algo := range TreeAlgorithms {
+		tracker := algo.SplitTracker(0.5)
+		tracker.Reset(samples)
+		parent := tracker.Quality()
+		if gain := tracker.Gain(); gain != 0 {
+			t.Errorf("%s: expected zero gain but got %f", algo, gain)
+		}
+		for _, sample := range samples[:10] {
+			tracker.MoveToLeft(sample)
+		}
+		expected := tracker.Quality() - parent
+		if actual := tracker.Gain(); math.Abs(actual-expected) > 1e-8 {
+			t.Errorf("%s: expected gain %f but got %f", algo, expected, actual)
+		}
+	}
+}
+
+func TestLeafParamsL2(t *testing.T) {
+	samples := testingGradientSamples(20, 3)
+	for _, algo := range TreeAlgorithms {
+		if algo == NewtonAlgorithm {
+			// Tested in TestNewtonLeafParams.
+			continue
+		}
+		leaf := samples[:5]
+		plain := Vector(algo.LeafParams(leaf, samples, 0))
+		shrunk := algo.LeafParams(leaf, samples, 15)
+		scale := 0.25
+		if algo == SignAlgorithm {
+			scale = 1
+		}
+		for i, x := range plain {
+			if math.Abs(x*scale-shrunk[i]) > 1e-8 {
+				t.Errorf("%s: expected %v but got %v", algo, plain.Copy().Scale(scale),
+					shrunk)
+				break
+			}
 		}
 	}
+}
+
+func TestLeafParamsUnshrunk(t *testing.T) {
+	samples := testingGradientSamples(20, 3)
+	leaf := samples[:5]
+	for _, algo := range []TreeAlgorithm{SumAlgorithm, BalancedSumAlgorithm} {
+		actual := algo.LeafParams(leaf, samples, 0)
+		expected := sumGradients(leaf).Scale(1 / float64(len(samples)))
+		for i, x := range expected {
+			if math.Abs(x-actual[i]) > 1e-8 {
+				t.Errorf("%s: expected %v but got %v", algo, expected, actual)
+				break
+			}
+		}
+	}
+	for _, algo := range []TreeAlgorithm{MSEAlgorithm, StddevAlgorithm, AbsAlgorithm} {
+		actual := algo.LeafParams(leaf, samples, 0)
+		expected := sumGradients(leaf).Scale(1 / float64(len(leaf)))
+		for i, x := range expected {
+			if math.Abs(x-actual[i]) > 1e-8 {
+				t.Errorf("%s: expected %v but got %v", algo, expected, actual)
+				break
+			}
+		}
+	}
+}
+
+func TestNewtonLeafParams(t *testing.T) {
+	samples := testingGradientSamples(20, 3)
+	actual := NewtonAlgorithm.LeafParams(samples, samples, 2)
+	grad := sumGradients(samples)
+	curvature := sumCurvatures(samples)
+	for i, x := range actual {
+		expected := grad[i] / (curvature[i] + 2)
+		if math.Abs(x-expected) > 1e-8 {
+			t.Errorf("param %d: expected %f but got %f", i, expected, x)
+		}
+	}
+}
+
+func TestRegisterAlgorithm(t *testing.T) {
+	oldAlgorithms := TreeAlgorithms
+	defer func() {
+		TreeAlgorithms = oldAlgorithms
+	}()
+
+	RegisterAlgorithm(&constantAlgorithm{})
+	algo, ok := LookupAlgorithm("constant")
+	if !ok {
+		t.Fatal("algorithm not found")
+	}
+
+	samples := testingGradientSamples(100, 2)
+	for i, sample := range samples {
+		sample.Sample = &memorySample{features: []float64{float64(i % 10)}}
+	}
+	for _, bins := range []int{0, 16} {
+		b := &Builder{Algorithm: algo, MaxDepth: 3, HistogramBins: bins}
+		tree := b.build(samples)
+		if tree.Leaf {
+			t.Errorf("bins %d: expected branching root", bins)
+			continue
+		}
+		if !tree.LessThan.Leaf || !tree.GreaterEqual.Leaf {
+			t.Errorf("bins %d: expected depth 1 after post-processing", bins)
+			continue
+		}
+		if tree.LessThan.Params[0] != 1 || tree.GreaterEqual.Params[0] != 1 {
+			t.Errorf("bins %d: unexpected leaves", bins)
+		}
+	}
+}
+
+func TestExternalBinTracker(t *testing.T) {
+	var binMoves int64
+	algo := &externalSumAlgorithm{binMoves: &binMoves}
+
+	samples := testingGradientSamples(100, 2)
+	for i, sample := range samples {
+		sample.Sample = &memorySample{features: []float64{float64(i % 10)}}
+	}
+	b := &Builder{Algorithm: algo, MaxDepth: 3, HistogramBins: 16}
+	if tree := b.build(samples); tree.Leaf {
+		t.Error("expected branching root")
+	}
+	if atomic.LoadInt64(&binMoves) == 0 {
+		t.Error("MoveBinToLeft was never called")
+	}
+}
+
+func testTrackersEquivalent(t *testing.T, t1, t2 SplitTracker) {
+	samples := testingGradientSamples(100, 5)
 
 	var qualities [2][]float64
 	var orders [2][]int
-	for i, tracker := range []splitTracker{t1, t2} {
+	for i, tracker := range []SplitTracker{t1, t2} {
 		tracker.Reset(samples)
 		tracker.MoveToLeft(samples[0])
 		for j, sample := range samples[1:] {
@@ -46,17 +194,34 @@ func testTrackersEquivalent(t *testing.T, t1, t2 splitTracker) {
 	}
 }
 
+func testingGradientSamples(numSamples, paramDim int) []*GradientSample {
+	samples := make([]*GradientSample, numSamples)
+	for i := range samples {
+		samples[i] = &GradientSample{
+			Gradient:  make([]float64, paramDim),
+			Curvature: make([]float64, paramDim),
+		}
+		for j := range samples[i].Gradient {
+			samples[i].Gradient[j] = rand.NormFloat64()
+			samples[i].Curvature[j] = rand.Float64()
+		}
+	}
+	return samples
+}
+
 type naiveMSETracker struct {
-	Left  []*gradientSample
-	Right []*gradientSample
+	Left   []*GradientSample
+	Right  []*GradientSample
+	Parent float64
 }
 
-func (n *naiveMSETracker) Reset(right []*gradientSample) {
+func (n *naiveMSETracker) Reset(right []*GradientSample) {
 	n.Left = right[:0]
 	n.Right = right
+	n.Parent = n.Quality()
 }
 
-func (n *naiveMSETracker) MoveToLeft(sample *gradientSample) {
+func (n *naiveMSETracker) MoveToLeft(sample *GradientSample) {
 	n.Left = n.Left[:len(n.Left)+1]
 	n.Right = n.Right[1:]
 }
@@ -65,20 +230,39 @@ func (n *naiveMSETracker) Quality() float64 {
 	return -(naiveMSE(n.Left) + naiveMSE(n.Right))
 }
 
+func (n *naiveMSETracker) Gain() float64 {
+	return n.Quality() - n.Parent
+}
+
 type naiveStddevTracker struct {
 	naiveMSETracker
 }
 
+func (n *naiveStddevTracker) Reset(right []*GradientSample) {
+	n.naiveMSETracker.Reset(right)
+	n.Parent = n.Quality()
+}
+
 func (n *naiveStddevTracker) Quality() float64 {
 	return -(naiveWeightedStddev(n.Left) + naiveWeightedStddev(n.Right))
 }
 
-func naiveWeightedStddev(samples []*gradientSample) float64 {
+func (n *naiveStddevTracker) Gain() float64 {
+	return n.Quality() - n.Parent
+}
+
+func naiveWeightedStddev(samples []*GradientSample) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
 	variance := naiveMSE(samples) / float64(len(samples))
 	return float64(len(samples)) * math.Sqrt(variance)
 }
 
-func naiveMSE(samples []*gradientSample) float64 {
+func naiveMSE(samples []*GradientSample) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
 	mean := sumGradients(samples).Scale(1 / float64(len(samples)))
 	var mse float64
 	for _, sample := range samples {
@@ -87,3 +271,106 @@ func naiveMSE(samples []*gradientSample) float64 {
 	}
 	return mse
 }
+
+// constantAlgorithm is a user-defined TreeAlgorithm which
+// uses MSE splits, puts 1 in every leaf, and prunes the
+// tree to depth 1.
+type constantAlgorithm struct{}
+
+func (c *constantAlgorithm) String() string {
+	return "constant"
+}
+
+func (c *constantAlgorithm) NeedsCurvature() bool {
+	return false
+}
+
+func (c *constantAlgorithm) SplitTracker(l2 float64) SplitTracker {
+	// Hide MoveBinToLeft to test trackers which are not
+	// BinTrackers.
+	return struct{ SplitTracker }{MSEAlgorithm.SplitTracker(l2)}
+}
+
+func (c *constantAlgorithm) LeafParams(leafData, allData []*GradientSample,
+	l2 float64) []float64 {
+	return []float64{1, 1}
+}
+
+func (c *constantAlgorithm) PostProcess(t *Tree) *Tree {
+	if !t.Leaf {
+		for _, child := range []*Tree{t.LessThan, t.GreaterEqual} {
+			if !child.Leaf {
+				*child = Tree{Leaf: true, Params: []float64{1, 1}}
+			}
+		}
+	}
+	return t
+}
+
+// externalSumAlgorithm is a user-defined TreeAlgorithm
+// whose tracker implements BinTracker.
+type externalSumAlgorithm struct {
+	binMoves *int64
+}
+
+func (e *externalSumAlgorithm) String() string {
+	return "external_sum"
+}
+
+func (e *externalSumAlgorithm) NeedsCurvature() bool {
+	return false
+}
+
+func (e *externalSumAlgorithm) SplitTracker(l2 float64) SplitTracker {
+	return &externalSumTracker{binMoves: e.binMoves}
+}
+
+func (e *externalSumAlgorithm) LeafParams(leafData, allData []*GradientSample,
+	l2 float64) []float64 {
+	return SumAlgorithm.LeafParams(leafData, allData, l2)
+}
+
+func (e *externalSumAlgorithm) PostProcess(t *Tree) *Tree {
+	return t
+}
+
+// externalSumTracker implements SumAlgorithm's tracker
+// using only the exported API.
+type externalSumTracker struct {
+	binMoves *int64
+
+	left   Vector
+	right  Vector
+	parent float64
+}
+
+func (e *externalSumTracker) Reset(rightSamples []*GradientSample) {
+	e.left, e.right = nil, nil
+	if len(rightSamples) > 0 {
+		e.right = make(Vector, len(rightSamples[0].Gradient))
+		e.left = make(Vector, len(e.right))
+	}
+	for _, sample := range rightSamples {
+		e.right.Add(sample.Gradient)
+	}
+	e.parent = e.Quality()
+}
+
+func (e *externalSumTracker) MoveToLeft(sample *GradientSample) {
+	e.right.Sub(sample.Gradient)
+	e.left.Add(sample.Gradient)
+}
+
+func (e *externalSumTracker) MoveBinToLeft(bin *HistogramBin) {
+	atomic.AddInt64(e.binMoves, 1)
+	e.right.Sub(bin.Sum)
+	e.left.Add(bin.Sum)
+}
+
+func (e *externalSumTracker) Quality() float64 {
+	return e.left.Dot(e.left) + e.right.Dot(e.right)
+}
+
+func (e *externalSumTracker) Gain() float64 {
+	return e.Quality() - e.parent
+}
@@ -1,10 +1,12 @@
 package treeagent
 
 import (
+	"context"
 	"math"
 	"math/rand"
-	"runtime"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/unixpickle/anyvec"
 	"github.com/unixpickle/essentials"
@@ -13,10 +15,35 @@ import (
 // A Builder stores parameters for building trees.
 type Builder struct {
 	// MaxDepth is the maximum tree depth.
+	//
+	// When MaxLeaves is set, a MaxDepth of 0 means that
+	// the depth is unlimited.
 	MaxDepth int
 
+	// MaxLeaves, if non-zero, enables best-first growth.
+	// Rather than splitting every node up to MaxDepth,
+	// the builder repeatedly splits the leaf whose split
+	// improves quality the most, until the tree has
+	// MaxLeaves leaves or no leaf can be split.
+	MaxLeaves int
+
+	// Oblivious, if true, makes the builder grow
+	// oblivious trees, in which every node at a given
+	// depth uses the same feature and threshold.
+	// Each level's split is chosen to maximize the total
+	// gain of all the nodes at that level.
+	//
+	// Oblivious trees are always MaxDepth levels deep
+	// (unless no split helps), so MaxLeaves must be 0.
+	// They only use simple threshold splits, with missing
+	// values going to GreaterEqual.
+	// Post-pruning may make the trees non-oblivious.
+	Oblivious bool
+
 	// Algorithm determines how to splits and leaf values
 	// are chosen.
+	//
+	// If nil, SumAlgorithm is used.
 	Algorithm TreeAlgorithm
 
 	// FeatureFrac is the fraction of features to try for
@@ -38,6 +65,26 @@ type Builder struct {
 	// Values closer to 0 allow for more freedom.
 	MinLeafFrac float64
 
+	// MinGain is the minimum improvement in split quality
+	// needed to split a node.
+	// Gains are measured relative to the parent node, in
+	// the units of the algorithm's splitting criterion.
+	//
+	// If 0, any split which satisfies MinLeaf and
+	// MinLeafFrac may be taken, even if it makes the
+	// split quality worse.
+	MinGain float64
+
+	// LeafL2 is an L2 penalty on leaf values.
+	// Larger values shrink leaves with few samples
+	// towards zero, preventing noisy gradients from
+	// producing extreme leaves.
+	// It is passed to the TreeAlgorithm, which may
+	// interpret it differently.
+	//
+	// LeafL2 does not affect SignAlgorithm.
+	LeafL2 float64
+
 	// ParamWhitelist specifies the parameter indices to
 	// target with the trees.
 	// Only parameters in the whitelist will be non-zero
@@ -45,79 +92,455 @@ type Builder struct {
 	//
 	// If nil, all parameters are used.
 	ParamWhitelist []int
+
+	// HistogramBins, if non-zero, enables histogram-based
+	// split finding.
+	// Before a tree is built, each feature is quantized
+	// into at most HistogramBins bins, and only splits
+	// between bins are considered.
+	// This avoids sorting the samples at every node.
+	//
+	// When a feature has no more distinct values than
+	// there are bins, no splits are lost.
+	//
+	// HistogramBins may not exceed 256.
+	HistogramBins int
+
+	// RandomThresholds, if non-zero, enables extremely
+	// randomized splits.
+	// Rather than searching every threshold of a feature,
+	// the builder draws this many thresholds uniformly
+	// between the feature's minimum and maximum values at
+	// the node, and only tries those.
+	// This avoids sorting the samples at every node.
+	//
+	// RandomThresholds takes precedence over
+	// HistogramBins.
+	// It does not affect categorical features, oblique
+	// splits, or oblivious trees.
+	RandomThresholds int
+
+	// ObliqueFeatures, if greater than 1, enables oblique
+	// splits on a weighted sum of up to this many
+	// features.
+	// At each node, the weights are chosen by regressing
+	// the gradients, projected onto the direction which
+	// the best single-feature split separates, against
+	// the features most correlated with them.
+	// The resulting oblique split is used if it beats the
+	// best single-feature split.
+	ObliqueFeatures int
+
+	// CategoricalFeatures lists the features whose values
+	// are unordered categories, such as colors or IDs.
+	// Rather than splitting these features at a
+	// threshold, the builder sends a subset of their
+	// values to the LessThan branch.
+	CategoricalFeatures []int
+
+	// LinearFeatures, if non-zero, enables linear leaves.
+	// Each leaf's parameters become an affine function of
+	// up to this many features, fitted to the gradients
+	// of the leaf's samples by least squares.
+	//
+	// Each parameter's linear terms are scaled like its
+	// constant term, so any TreeAlgorithm may be used.
+	// For algorithms which use curvature, the linear terms
+	// are fitted to Newton steps instead of gradients.
+	// However, SignAlgorithm removes the linear terms.
+	LinearFeatures int
+
+	// LinearL2 is an L2 penalty on the slopes of linear
+	// leaves, in units of squared feature deviations
+	// (times curvature, for algorithms which use it).
+	// Larger values make leaves closer to constant.
+	LinearL2 float64
+
+	// InteractionConstraints lists sets of features which
+	// may be used together.
+	// The splits on each root-to-leaf path may only use
+	// features from one of the sets, although different
+	// paths may use different sets.
+	// A feature which is not in any set may only be used
+	// on paths which use no other features.
+	//
+	// If nil, any features may be used together.
+	// Linear leaves are not constrained.
+	InteractionConstraints [][]int
+
+	// MonotoneConstraints require leaf parameters to be
+	// monotonic functions of certain features.
+	// Splits on a constrained feature must order their
+	// children's leaf values correctly, and the leaves in
+	// each child's subtree are bounded so that the order
+	// holds for every pair of leaves on opposite sides.
+	//
+	// Oblique splits never use constrained features.
+	// Constraints cannot be used with categorical
+	// features, oblivious trees, or linear leaves.
+	MonotoneConstraints []MonotoneConstraint
+
+	// PruneFrac, if non-zero, enables post-pruning.
+	// This fraction of the samples is held out while the
+	// tree is built.
+	// Afterwards, subtrees which do not improve the
+	// objective on the held-out samples are collapsed
+	// into leaves.
+	// Subtrees which no held-out samples reach are kept.
+	PruneFrac float64
+
+	// PruneCost is the improvement in the held-out
+	// objective that each extra leaf must pay for in
+	// order to avoid pruning.
+	// It is only used if PruneFrac is non-zero.
+	//
+	// The held-out objective is a mean over samples, so
+	// PruneCost does not depend on the number of samples.
+	PruneCost float64
+
+	// TimeLimit, if non-zero, limits the time spent
+	// building each tree.
+	// Once time runs out, nodes are no longer split, so
+	// the result is the tree that was grown so far.
+	TimeLimit time.Duration
+
+	// Progress, if non-nil, is called every time a node
+	// is split or finished as a leaf while a tree grows.
+	// It is never called concurrently, but it may be
+	// called from different goroutines.
+	Progress func(p BuildProgress)
+
+	// Rand is the source of randomness for the builder,
+	// e.g. for selecting features with FeatureFrac.
+	//
+	// If nil, the global source from math/rand is used.
+	// A Builder with a Rand should not be used from more
+	// than one goroutine at once.
+	//
+	// To keep trees reproducible, subtrees are not built
+	// concurrently when Rand is set and random numbers are
+	// needed at every node (i.e. for FeatureFrac or
+	// RandomThresholds).
+	Rand *rand.Rand
 }
 
 // build builds a tree to match the gradients.
 // It may modify the gradients of the data.
-func (b *Builder) build(data []*gradientSample) *Tree {
+func (b *Builder) build(data []*GradientSample) *Tree {
+	tree, _ := b.buildContext(context.Background(), data, nil)
+	return tree
+}
+
+// buildContext is like build, but it uses a SampleCache
+// containing the samples to avoid sorting them, and it
+// stops splitting nodes once ctx is done.
+// The cache may be nil.
+//
+// A tree is always returned, along with ctx.Err() if the
+// tree was cut short by ctx.
+func (b *Builder) buildContext(ctx context.Context, data []*GradientSample,
+	c *SampleCache) (*Tree, error) {
+	growCtx := ctx
+	if b.TimeLimit != 0 {
+		var cancel context.CancelFunc
+		growCtx, cancel = context.WithTimeout(ctx, b.TimeLimit)
+		defer cancel()
+	}
+
 	data = b.maskGradients(data)
-	return b.buildRecursive(data, data, b.MaxDepth)
+	state := &buildState{Done: growCtx.Done(), Progress: b.Progress}
+	if b.PruneFrac != 0 {
+		data, state.HeldOut = b.holdOut(data)
+		state.HeldOutWeight = totalWeight(state.HeldOut)
+	}
+	state.AllData = data
+	state.progress.TotalSamples = len(data)
+	if len(data) > 0 {
+		b.checkMonotone(data[0].NumFeatures(), len(data[0].Gradient))
+	}
+	if len(b.CategoricalFeatures) > 0 && len(data) > 0 {
+		state.Categorical = make([]bool, data[0].NumFeatures())
+		for _, feature := range b.CategoricalFeatures {
+			if feature < len(state.Categorical) {
+				state.Categorical[feature] = true
+			}
+		}
+	}
+	if b.HistogramBins != 0 && (b.RandomThresholds == 0 || b.Oblivious) {
+		state.Bins = c.featureBins(data, b.HistogramBins)
+		if state.Bins == nil {
+			state.Bins = newFeatureBins(data, b.HistogramBins)
+		}
+	}
+
+	// The samples are partitioned in place as the tree is
+	// built, so AllData is left intact.
+	samples := append([]*GradientSample{}, data...)
+
+	var tree *Tree
+	if b.Oblivious {
+		if b.MaxLeaves != 0 {
+			panic("oblivious trees cannot be grown best-first")
+		}
+		tree = b.buildOblivious(samples, state)
+	} else {
+		var sorted *presortedNode
+		if len(samples) > 1 && state.Bins == nil && b.RandomThresholds == 0 &&
+			len(samples)*samples[0].NumFeatures() <= maxPresortEntries {
+			sorted = presort(samples, c.featureOrder())
+		}
+		state.Scheduler = b.scheduler()
+		defer state.Scheduler.Close()
+		if b.MaxLeaves != 0 {
+			tree = b.buildBestFirst(samples, state, sorted)
+		} else {
+			tree = b.buildRecursive(samples, state, b.MaxDepth, nil, nil, sorted)
+		}
+	}
+	if state.HeldOut != nil {
+		tree, _, _ = b.prune(tree, samples, state.HeldOut, state)
+	}
+	return b.algorithm().PostProcess(tree), ctx.Err()
+}
+
+// algorithm returns the tree algorithm, taking defaults
+// into account.
+func (b *Builder) algorithm() TreeAlgorithm {
+	if b.Algorithm == nil {
+		return SumAlgorithm
+	}
+	return b.Algorithm
+}
+
+// computeObjective is like the package-level
+// computeObjective, but it also computes curvatures if
+// the algorithm needs them.
+func (b *Builder) computeObjective(s []Sample, f *Forest, c *SampleCache,
+	o ObjectiveFunc) (anyvec.Vector, []*GradientSample) {
+	if b.algorithm().NeedsCurvature() {
+		return computeNewtonObjective(s, f, c, o)
+	}
+	return computeObjective(s, f, c, o)
 }
 
-// buildWithTerms is like build, but it also returns the
-// surrogate objective and regularization terms.
+// buildWithTerms is like buildContext, but it also
+// returns the surrogate objective and regularization
+// terms.
 // It is assumed that objAndReg contains two components,
 // the first of which is the objective and the second of
 // which is the regularization term.
-func (b *Builder) buildWithTerms(objAndReg anyvec.Vector,
-	data []*gradientSample) (tree *Tree, obj, reg anyvec.Numeric) {
+//
+// The tree is built from the samples selected by goss,
+// which may be nil.
+// If goss selects no samples (e.g. because none of them
+// have weight), the tree is a single leaf of zeros.
+func (b *Builder) buildWithTerms(ctx context.Context, objAndReg anyvec.Vector,
+	data []*GradientSample, goss *GOSS, c *SampleCache) (tree *Tree, obj,
+	reg anyvec.Numeric, err error) {
 	obj, reg = splitUpTerms(objAndReg, len(data))
-	tree = b.build(data)
+
+	// GOSS must see the masked gradients, since it selects
+	// samples by their gradient norms.
+	// Masking again in buildContext has no effect.
+	data = b.maskGradients(data)
+	selected := goss.Select(data)
+	if len(selected) == 0 && len(data) > 0 {
+		params := make(ActionParams, len(data[0].Gradient))
+		return &Tree{Leaf: true, Params: params}, obj, reg, ctx.Err()
+	}
+	tree, err = b.buildContext(ctx, selected, c)
 	return
 }
 
-func (b *Builder) buildRecursive(data, allData []*gradientSample, depth int) *Tree {
+// buildRecursive builds a tree depth-first.
+//
+// The sorted argument is nil unless the samples are
+// presorted.
+func (b *Builder) buildRecursive(data []*GradientSample, state *buildState,
+	depth int, bounds *leafBounds, path []int, sorted *presortedNode) *Tree {
 	if len(data) == 0 {
 		panic("cannot build tree with no data")
-	} else if depth == 0 || len(data) == 1 {
-		res := &Tree{
-			Leaf:   true,
-			Params: ActionParams(b.Algorithm.leafParams(data, allData)),
+	}
+
+	var bestSplit *splitInfo
+	if depth != 0 && len(data) > 1 && !state.stopped() {
+		bestSplit = b.bestSplit(data, state, path, sorted)
+	}
+	if bestSplit == nil {
+		// If no split can help, create a leaf.
+		state.report(0, 1, len(data))
+		return b.leaf(data, state, bounds)
+	}
+
+	leftSorted, rightSorted := partitionSplit(data, bestSplit, sorted)
+	state.report(1, 0, 0)
+	res := &Tree{}
+	bestSplit.setBranch(res)
+	leftBounds, rightBounds := b.childBounds(bestSplit, bounds, state)
+	path = childPath(path, bestSplit)
+	state.forkJoin(len(bestSplit.LeftSamples), len(bestSplit.RightSamples), func() {
+		res.LessThan = b.buildRecursive(bestSplit.LeftSamples, state, depth-1,
+			leftBounds, path, leftSorted)
+	}, func() {
+		res.GreaterEqual = b.buildRecursive(bestSplit.RightSamples, state, depth-1,
+			rightBounds, path, rightSorted)
+	})
+	return res
+}
+
+// buildBestFirst builds a tree by repeatedly splitting
+// the leaf with the greatest improvement in quality.
+func (b *Builder) buildBestFirst(data []*GradientSample, state *buildState,
+	sorted *presortedNode) *Tree {
+	if b.MaxLeaves < 1 {
+		panic("max leaves out of range")
+	}
+	root := &Tree{}
+	frontier := []*pendingLeaf{b.pendingLeaf(root, data, state, 0, nil, nil, sorted)}
+	for numLeaves := 1; numLeaves < b.MaxLeaves && !state.stopped(); numLeaves++ {
+		bestIdx := -1
+		for i, leaf := range frontier {
+			if leaf.Split == nil {
+				continue
+			}
+			if bestIdx == -1 || leaf.Split.Gain > frontier[bestIdx].Split.Gain {
+				bestIdx = i
+			}
 		}
-		if b.Algorithm == SumAlgorithm || b.Algorithm == BalancedSumAlgorithm {
-			res.scaleParams(1 / float64(len(data)))
-		} else if b.Algorithm == SignAlgorithm {
-			res = SignTree(res)
+		if bestIdx == -1 {
+			break
 		}
-		return res
+		leaf := frontier[bestIdx]
+		leftSorted, rightSorted := partitionSplit(leaf.Samples, leaf.Split, leaf.Sorted)
+		state.report(1, 0, 0)
+		leaf.Split.setBranch(leaf.Node)
+		leaf.Node.LessThan = &Tree{}
+		leaf.Node.GreaterEqual = &Tree{}
+		leftBounds, rightBounds := b.childBounds(leaf.Split, leaf.Bounds, state)
+		path := childPath(leaf.Path, leaf.Split)
+		var left, right *pendingLeaf
+		state.forkJoin(len(leaf.Split.LeftSamples), len(leaf.Split.RightSamples), func() {
+			left = b.pendingLeaf(leaf.Node.LessThan, leaf.Split.LeftSamples, state,
+				leaf.Depth+1, leftBounds, path, leftSorted)
+		}, func() {
+			right = b.pendingLeaf(leaf.Node.GreaterEqual, leaf.Split.RightSamples, state,
+				leaf.Depth+1, rightBounds, path, rightSorted)
+		})
+		frontier[bestIdx] = left
+		frontier = append(frontier, right)
+	}
+	for _, leaf := range frontier {
+		*leaf.Node = *b.leaf(leaf.Samples, state, leaf.Bounds)
+		state.report(0, 1, len(leaf.Samples))
+	}
+	return root
+}
+
+// pendingLeaf finds the best split for a leaf which may
+// be expanded during best-first growth.
+func (b *Builder) pendingLeaf(node *Tree, data []*GradientSample, state *buildState,
+	depth int, bounds *leafBounds, path []int, sorted *presortedNode) *pendingLeaf {
+	res := &pendingLeaf{Node: node, Samples: data, Depth: depth, Bounds: bounds,
+		Path: path, Sorted: sorted}
+	if len(data) > 1 && (b.MaxDepth == 0 || depth < b.MaxDepth) {
+		res.Split = b.bestSplit(data, state, path, sorted)
 	}
+	return res
+}
+
+// leaf creates a leaf node for the samples.
+func (b *Builder) leaf(data []*GradientSample, state *buildState,
+	bounds *leafBounds) *Tree {
+	params := b.leafValues(data, state, bounds)
+	res := &Tree{Leaf: true, Params: ActionParams(params)}
+	if b.LinearFeatures > 0 {
+		b.linearLeaf(res, data, state)
+	}
+	return res
+}
+
+// leafValues computes the parameters of a leaf, clamped
+// to the bounds.
+func (b *Builder) leafValues(data []*GradientSample, state *buildState,
+	bounds *leafBounds) Vector {
+	return bounds.Clamp(b.algorithm().LeafParams(data, state.AllData, b.LeafL2))
+}
 
+// bestSplit finds the best split over all of the features
+// that should be tried.
+// It returns nil if no split is possible or if the best
+// split's gain is less than MinGain.
+//
+// If sorted is non-nil, it is used in place of sorting
+// the samples for exact splits.
+func (b *Builder) bestSplit(data []*GradientSample, state *buildState,
+	path []int, sorted *presortedNode) *splitInfo {
 	numFeatures := data[0].NumFeatures()
-	featureChan := b.featuresToTry(numFeatures)
-	splitChan := make(chan *splitInfo, numFeatures)
+	features := b.featuresToTry(numFeatures, path)
+	featureChan := make(chan int, len(features))
+	for i := range features {
+		featureChan <- i
+	}
+	close(featureChan)
 
+	// Random numbers are drawn up front, since b.Rand
+	// cannot be used concurrently.
+	var uniforms [][]float64
+	if b.RandomThresholds != 0 {
+		uniforms = b.randomUniforms(len(features))
+	}
+	splits := make([]*splitInfo, len(features))
+
+	// Small nodes are searched on the current goroutine,
+	// which is cheaper than spawning more.
+	worker := func() {
+		for i := range featureChan {
+			feature := features[i]
+			if state.isCategorical(feature) {
+				splits[i] = b.categoricalSplit(data, feature)
+			} else if uniforms != nil {
+				splits[i] = b.randomizedSplit(data, feature, uniforms[i])
+			} else if state.Bins != nil {
+				splits[i] = b.histogramSplit(data, state.Bins, feature)
+			} else if sorted != nil {
+				splits[i] = b.presortedSplit(data, sorted, feature)
+			} else {
+				splits[i] = b.optimalSplit(data, feature)
+			}
+		}
+	}
 	var wg sync.WaitGroup
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+	for i := 1; i < splitWorkers(len(data), len(features)); i++ {
 		wg.Add(1)
 		go func() {
-			for feature := range featureChan {
-				splitChan <- b.optimalSplit(data, feature)
-			}
-			wg.Done()
+			defer wg.Done()
+			worker()
 		}()
 	}
-
-	go func() {
-		wg.Wait()
-		close(splitChan)
-	}()
+	worker()
+	wg.Wait()
 
 	var bestSplit *splitInfo
-	for split := range splitChan {
+	for _, split := range splits {
 		bestSplit = betterSplit(bestSplit, split)
 	}
-
-	if bestSplit == nil {
-		// If no split can help, create a leaf.
-		return b.buildRecursive(data, allData, 0)
+	if bestSplit != nil && b.ObliqueFeatures > 1 {
+		groups := b.interactingGroups(features,
+			append(path[:len(path):len(path)], bestSplit.Feature),
+			numFeatures)
+		axisSplit := bestSplit
+		for _, group := range groups {
+			oblique := b.obliqueSplit(data, axisSplit,
+				b.unconstrained(state.ordered(group)))
+			if oblique != nil && oblique.Quality > bestSplit.Quality {
+				bestSplit = oblique
+			}
+		}
 	}
-
-	return &Tree{
-		Feature:      bestSplit.Feature,
-		Threshold:    bestSplit.Threshold,
-		LessThan:     b.buildRecursive(bestSplit.LeftSamples, allData, depth-1),
-		GreaterEqual: b.buildRecursive(bestSplit.RightSamples, allData, depth-1),
+	if bestSplit != nil && b.MinGain != 0 && bestSplit.Gain < b.MinGain {
+		return nil
 	}
+	return bestSplit
 }
 
 // optimalSplit finds the optimal split for the given
@@ -125,63 +548,150 @@ func (b *Builder) buildRecursive(data, allData []*gradientSample, depth int) *Tr
 // It returns nil if no split is effective.
 //
 // There must be at least one sample.
-func (b *Builder) optimalSplit(samples []*gradientSample, feature int) *splitInfo {
-	sorted, featureVals := sortByFeature(samples, feature)
+func (b *Builder) optimalSplit(samples []*GradientSample, feature int) *splitInfo {
+	buf := sortBuffers.Get().(*sortBuffer)
+	defer sortBuffers.Put(buf)
+	sorted, featureVals, missing := buf.sortByFeature(samples, feature)
+	return b.sortedSplit(samples, sorted, featureVals, missing, feature)
+}
+
+// sortedSplit finds the optimal split for samples, given
+// the samples with known values sorted by the values they
+// will be split on, and the samples with missing values.
+// The samples with missing values are tried in both
+// branches.
+// It returns nil if no split is effective.
+//
+// The feature argument is used for the Feature field of
+// the result, and is -1 if the values are not those of a
+// single feature.
+func (b *Builder) sortedSplit(samples, sorted []*GradientSample,
+	featureVals []float64, missing []*GradientSample, feature int) *splitInfo {
+	if len(sorted) == 0 {
+		return nil
+	}
+	res := b.sweepSplit(samples, sorted, featureVals, nil, feature)
+	if len(missing) > 0 {
+		missingLeft := b.sweepSplit(samples, sorted, featureVals, missing, feature)
+		if missingLeft != nil && (res == nil || missingLeft.Quality > res.Quality) {
+			res = missingLeft
+		}
+	}
+	return res
+}
 
-	tracker := b.Algorithm.splitTracker()
-	tracker.Reset(sorted)
+// sweepSplit finds the optimal split for samples, given
+// the samples with known values sorted by featureVals.
+// The samples in missingLeft go to the LessThan branch,
+// and any other samples with missing values go to the
+// GreaterEqual branch.
+func (b *Builder) sweepSplit(samples, sorted []*GradientSample, featureVals []float64,
+	missingLeft []*GradientSample, feature int) *splitInfo {
+	tracker := b.splitTracker(feature)
+	tracker.Reset(samples)
+	for _, sample := range missingLeft {
+		tracker.MoveToLeft(sample)
+	}
+	numMissing := len(missingLeft)
 	lastValue := featureVals[0]
 
-	minLeaf := essentials.MaxInt(b.MinLeaf, int(b.MinLeafFrac*float64(len(samples))))
+	minLeaf := b.minLeaf(len(samples))
 
+	// A single splitInfo is reused to avoid allocating
+	// one per threshold.
 	var bestSplit *splitInfo
-	for i, sample := range sorted {
-		if featureVals[i] > lastValue {
-			if i >= minLeaf && len(samples)-i >= minLeaf {
-				newSplit := &splitInfo{
-					Feature:      feature,
-					Threshold:    (featureVals[i] + lastValue) / 2,
-					Quality:      tracker.Quality(),
-					LeftSamples:  sorted[:i],
-					RightSamples: sorted[i:],
+	for i, value := range featureVals {
+		numLeft := numMissing + i
+		if value > lastValue || (i == 0 && numMissing > 0) {
+			if numLeft >= minLeaf && len(samples)-numLeft >= minLeaf &&
+				splitAllowed(tracker) {
+				quality := tracker.Quality()
+				if bestSplit == nil || !(bestSplit.Quality > quality) {
+					if bestSplit == nil {
+						bestSplit = &splitInfo{}
+					}
+					*bestSplit = splitInfo{
+						Feature:     feature,
+						Threshold:   splitThreshold(lastValue, value),
+						Quality:     quality,
+						Gain:        tracker.Gain(),
+						MissingLeft: numMissing > 0,
+					}
 				}
-				bestSplit = betterSplit(bestSplit, newSplit)
 			}
-			lastValue = featureVals[i]
+			lastValue = value
 		}
-		tracker.MoveToLeft(sample)
+		tracker.MoveToLeft(sorted[i])
 	}
 
 	return bestSplit
 }
 
-func (b *Builder) featuresToTry(numFeatures int) <-chan int {
-	useFeatures := numFeatures
+// splitThreshold computes a threshold between two sorted
+// values, such that lower is less than the threshold and
+// upper is not.
+//
+// This is usually the midpoint, unless the midpoint
+// rounds to lower or overflows.
+func splitThreshold(lower, upper float64) float64 {
+	if mid := (lower + upper) / 2; mid > lower && mid <= upper {
+		return mid
+	}
+	return upper
+}
+
+// minLeaf computes the minimum number of samples in each
+// branch of a split.
+func (b *Builder) minLeaf(numSamples int) int {
+	return essentials.MaxInt(b.MinLeaf, int(b.MinLeafFrac*float64(numSamples)))
+}
+
+// featuresToTry selects the features to try splitting on
+// at a node, given the features which its ancestors split
+// on.
+func (b *Builder) featuresToTry(numFeatures int, path []int) []int {
+	var candidates []int
+	if allowed := b.allowedFeatures(numFeatures, path); allowed != nil {
+		for feature, ok := range allowed {
+			if ok {
+				candidates = append(candidates, feature)
+			}
+		}
+	} else {
+		candidates = make([]int, numFeatures)
+		for i := range candidates {
+			candidates[i] = i
+		}
+	}
+
+	useFeatures := len(candidates)
 	if b.FeatureFrac != 0 {
 		if b.FeatureFrac < 0 || b.FeatureFrac > 1 {
 			panic("feature fraction out of range")
 		}
-		useFeatures = int(math.Ceil(b.FeatureFrac * float64(numFeatures)))
+		useFeatures = int(math.Ceil(b.FeatureFrac * float64(len(candidates))))
 	}
-	featureChan := make(chan int, useFeatures)
-	if useFeatures != numFeatures {
-		for _, i := range rand.Perm(numFeatures)[:useFeatures] {
-			featureChan <- i
-		}
-	} else {
-		for i := 0; i < numFeatures; i++ {
-			featureChan <- i
+	if useFeatures != len(candidates) {
+		features := randPerm(b.Rand, len(candidates))[:useFeatures]
+		for i, idx := range features {
+			features[i] = candidates[idx]
 		}
+		return features
 	}
-	close(featureChan)
-	return featureChan
+	return candidates
 }
 
-func (b *Builder) maskGradients(samples []*gradientSample) []*gradientSample {
+// samplesFeatures returns true if featuresToTry may draw
+// random numbers to choose a subset of the features.
+func (b *Builder) samplesFeatures() bool {
+	return b.FeatureFrac != 0 && b.FeatureFrac != 1
+}
+
+func (b *Builder) maskGradients(samples []*GradientSample) []*GradientSample {
 	if len(samples) == 0 || b.ParamWhitelist == nil {
 		return samples
 	}
-	mask := make(smallVec, len(samples[0].Gradient))
+	mask := make(Vector, len(samples[0].Gradient))
 	for _, idx := range b.ParamWhitelist {
 		mask[idx] = 1
 	}
@@ -191,20 +701,167 @@ func (b *Builder) maskGradients(samples []*gradientSample) []*gradientSample {
 	return samples
 }
 
-func sortByFeature(samples []*gradientSample, feature int) ([]*gradientSample,
-	[]float64) {
-	vals := make([]float64, len(samples))
-	sorted := make([]*gradientSample, len(samples))
-	for i, sample := range samples {
-		vals[i] = sample.Feature(feature)
-		sorted[i] = sample
+func sortByFeature(samples []*GradientSample, feature int) (sorted []*GradientSample,
+	vals []float64, missing []*GradientSample) {
+	return (&sortBuffer{}).sortByFeature(samples, feature)
+}
+
+// sortByValue sorts the samples by a value, leaving out
+// the samples whose values are missing (NaN).
+func sortByValue(samples []*GradientSample,
+	value func(s *GradientSample) float64) (sorted []*GradientSample,
+	vals []float64, missing []*GradientSample) {
+	return (&sortBuffer{}).sortByValue(samples, value)
+}
+
+// sortBuffers stores sortBuffers for reuse, so that split
+// finding does not allocate memory at every node.
+var sortBuffers = sync.Pool{
+	New: func() interface{} {
+		return &sortBuffer{}
+	},
+}
+
+// A sortBuffer stores the results of sorting samples.
+//
+// The results of a sort are only valid until the next
+// sort with the same buffer.
+type sortBuffer struct {
+	Samples []*GradientSample
+	Values  []float64
+	Missing []*GradientSample
+}
+
+func (s *sortBuffer) sortByFeature(samples []*GradientSample,
+	feature int) (sorted []*GradientSample, vals []float64, missing []*GradientSample) {
+	return s.sortByValue(samples, func(s *GradientSample) float64 {
+		return s.Feature(feature)
+	})
+}
+
+func (s *sortBuffer) sortByValue(samples []*GradientSample,
+	value func(s *GradientSample) float64) (sorted []*GradientSample,
+	vals []float64, missing []*GradientSample) {
+	s.Samples = s.Samples[:0]
+	s.Values = s.Values[:0]
+	s.Missing = s.Missing[:0]
+	for _, sample := range samples {
+		if val := value(sample); math.IsNaN(val) {
+			s.Missing = append(s.Missing, sample)
+		} else {
+			s.Values = append(s.Values, val)
+			s.Samples = append(s.Samples, sample)
+		}
 	}
+	sort.Sort((*valueSorter)(s))
+	return s.Samples, s.Values, s.Missing
+}
+
+// valueSorter sorts a sortBuffer's samples by their
+// values.
+type valueSorter sortBuffer
 
-	essentials.VoodooSort(vals, func(i, j int) bool {
-		return vals[i] < vals[j]
-	}, sorted)
+func (v *valueSorter) Len() int {
+	return len(v.Samples)
+}
 
-	return sorted, vals
+func (v *valueSorter) Less(i, j int) bool {
+	return v.Values[i] < v.Values[j]
+}
+
+func (v *valueSorter) Swap(i, j int) {
+	v.Samples[i], v.Samples[j] = v.Samples[j], v.Samples[i]
+	v.Values[i], v.Values[j] = v.Values[j], v.Values[i]
+}
+
+// buildState stores information which is shared by every
+// node while a tree is built.
+type buildState struct {
+	// AllData contains all of the samples for the tree,
+	// excluding held-out samples.
+	AllData []*GradientSample
+
+	// HeldOut contains the samples for pruning, if any.
+	HeldOut []*GradientSample
+
+	// HeldOutWeight is the total weight of HeldOut.
+	HeldOutWeight float64
+
+	// Bins is non-nil when histograms are used.
+	Bins *featureBins
+
+	// Categorical indicates which features are
+	// categorical, or is nil if none are.
+	Categorical []bool
+
+	// Scheduler is used to build subtrees concurrently,
+	// or is nil if they are built one at a time.
+	Scheduler *buildScheduler
+
+	// Done is closed when the tree should stop growing.
+	// It is nil if the tree may grow indefinitely.
+	Done <-chan struct{}
+
+	// Progress is the builder's progress callback.
+	Progress func(p BuildProgress)
+
+	progressLock sync.Mutex
+	progress     BuildProgress
+}
+
+// forkJoin runs the functions which build two sibling
+// subtrees, running the first one concurrently if the
+// scheduler allows it and it has enough samples.
+func (b *buildState) forkJoin(leftSize, rightSize int, left, right func()) {
+	if b.Scheduler == nil || leftSize < minForkSamples || rightSize < minForkSamples {
+		left()
+		right()
+		return
+	}
+	task := b.Scheduler.Fork(left)
+	right()
+	b.Scheduler.Join(task)
+}
+
+func (b *buildState) isCategorical(feature int) bool {
+	return b.Categorical != nil && b.Categorical[feature]
+}
+
+// ordered filters out categorical features.
+func (b *buildState) ordered(features []int) []int {
+	if b.Categorical == nil {
+		return features
+	}
+	var res []int
+	for _, feature := range features {
+		if !b.Categorical[feature] {
+			res = append(res, feature)
+		}
+	}
+	return res
+}
+
+// pendingLeaf is a leaf which may be split during
+// best-first growth.
+type pendingLeaf struct {
+	// Node is filled in once the leaf is split or once
+	// the tree is complete.
+	Node *Tree
+
+	Samples []*GradientSample
+	Depth   int
+	Bounds  *leafBounds
+
+	// Path contains the features used by the leaf's
+	// ancestors.
+	Path []int
+
+	// Sorted is set if the samples are presorted.
+	Sorted *presortedNode
+
+	// Split is the best split for the leaf, or nil if the
+	// leaf cannot be split.
+	Split *splitInfo
 }
 
 // splitInfo stores information about a feature split.
@@ -216,12 +873,90 @@ type splitInfo struct {
 	Threshold float64
 	Quality   float64
 
-	LeftSamples  []*gradientSample
-	RightSamples []*gradientSample
+	// Gain is the improvement in quality relative to the
+	// parent node.
+	Gain float64
+
+	// ObliqueFeatures and ObliqueWeights are set for
+	// oblique splits, in which case Feature is unused.
+	ObliqueFeatures []int
+	ObliqueWeights  []float64
+
+	// Categories is set for categorical splits, in which
+	// case Threshold is unused.
+	Categories []float64
+
+	// MissingLeft indicates that samples with missing
+	// values go to the LessThan branch.
+	MissingLeft bool
+
+	// LeftSamples and RightSamples are only set once a
+	// split is chosen, by partitionSplit.
+	LeftSamples  []*GradientSample
+	RightSamples []*GradientSample
+}
+
+// partitionSplit reorders the samples in place so that
+// the samples for each branch of a split are contiguous,
+// and sets the split's LeftSamples and RightSamples.
+//
+// If sorted is non-nil, it is the presortedNode for the
+// samples, and the presortedNodes for the branches are
+// returned.
+func partitionSplit(samples []*GradientSample, split *splitInfo,
+	sorted *presortedNode) (leftSorted, rightSorted *presortedNode) {
+	var node Tree
+	split.setBranch(&node)
+	if sorted == nil {
+		split.LeftSamples, split.RightSamples = partitionSamples(&node, samples)
+		return nil, nil
+	}
+	for _, sample := range samples {
+		sample.left = node.goesLeft(sample)
+	}
+	leftSorted, rightSorted = sorted.partition()
+	numLeft := stablePartition(samples, sorted.Scratch)
+	split.LeftSamples, split.RightSamples = samples[:numLeft], samples[numLeft:]
+	return
+}
+
+// partitionSamples reorders the samples in place so that
+// the samples which go to the LessThan branch of a node
+// come first, and returns the samples for each branch.
+//
+// The order of the samples in each branch is arbitrary
+// but deterministic.
+func partitionSamples(node *Tree, samples []*GradientSample) (left,
+	right []*GradientSample) {
+	i, j := 0, len(samples)
+	for i < j {
+		if node.goesLeft(samples[i]) {
+			i++
+		} else {
+			j--
+			samples[i], samples[j] = samples[j], samples[i]
+		}
+	}
+	return samples[:i], samples[i:]
+}
+
+// setBranch fills in the branching information of a node
+// (but not its children) to reflect the split.
+func (s *splitInfo) setBranch(node *Tree) {
+	node.Feature = s.Feature
+	node.Threshold = s.Threshold
+	node.ObliqueFeatures = s.ObliqueFeatures
+	node.ObliqueWeights = s.ObliqueWeights
+	node.Categories = s.Categories
+	node.MissingLeft = s.MissingLeft
 }
 
 // betterSplit selects the better of two splits.
 // If a split is nil, the other split is chosen.
+//
+// Ties between features are broken in favor of the lower
+// feature index, so that the result does not depend on
+// the order in which features are searched.
 func betterSplit(s1, s2 *splitInfo) *splitInfo {
 	if s1 == nil {
 		return s2
@@ -229,6 +964,8 @@ func betterSplit(s1, s2 *splitInfo) *splitInfo {
 		return s1
 	} else if s1.Quality > s2.Quality {
 		return s1
+	} else if s1.Quality == s2.Quality && s1.Feature < s2.Feature {
+		return s1
 	} else {
 		return s2
 	}
@@ -0,0 +1,283 @@
+package treeagent
+
+// A SampleCache caches the outputs of a Forest on a fixed
+// set of samples.
+//
+// The cache is updated incrementally as trees are added,
+// removed, or re-weighted.
+// Thus, re-applying a forest which only gained one tree
+// since the last sync costs O(new tree) rather than
+// O(forest).
+// Cached outputs may differ from freshly computed ones by
+// floating-point rounding error.
+//
+// Trees are identified by pointer, so trees should not be
+// modified in place after they are added to a forest.
+//
+// The cache also remembers which leaf of each tree every
+// sample falls into, once that information is needed
+// (e.g. for weight gradients).
+// This takes O(trees*samples) memory.
+// Likewise, the samples are sorted along every feature
+// once this is needed for building trees, so that trees
+// built from the samples (or minibatches of them) need
+// not sort the samples again.
+// This takes O(features*samples) memory, so it is skipped
+// for very large batches.
+// Similarly, the samples' features are quantized once for
+// histogram-based builds.
+//
+// A SampleCache is not safe for concurrent use.
+type SampleCache struct {
+	samples []Sample
+	indices map[Sample]int
+
+	base    ActionParams
+	trees   []*Tree
+	weights []float64
+	params  []Vector
+
+	treeLeaves map[*Tree]*cachedTree
+
+	order *featureOrder
+
+	bins       *featureBins
+	binsMax    int
+	binIndices []uint8
+}
+
+// NewSampleCache creates a cache for the samples.
+func NewSampleCache(samples []Sample) *SampleCache {
+	res := &SampleCache{
+		samples:    samples,
+		indices:    map[Sample]int{},
+		treeLeaves: map[*Tree]*cachedTree{},
+	}
+	for i, s := range samples {
+		res.indices[s] = i
+	}
+	return res
+}
+
+// Samples returns the samples for which outputs are
+// cached.
+func (c *SampleCache) Samples() []Sample {
+	return c.samples
+}
+
+// Sync updates the cache to reflect the current state of
+// the forest.
+func (c *SampleCache) Sync(f *Forest) {
+	if c.params == nil || !floatsEqual(c.base, f.Base) {
+		c.recompute(f)
+		return
+	}
+	removed, kept := removedTrees(c.trees, f)
+	if removed == nil {
+		c.recompute(f)
+		return
+	}
+
+	for _, idx := range removed {
+		t := c.trees[idx]
+		c.addTree(t, -c.weights[idx])
+		delete(c.treeLeaves, t)
+	}
+
+	oldWeights := make([]float64, len(kept))
+	for i, idx := range kept {
+		oldWeights[i] = c.weights[idx]
+	}
+	newWeights := f.Weights[:len(kept)]
+	if !floatsEqual(oldWeights, newWeights) {
+		if scale, ok := exactScale(oldWeights, newWeights); ok {
+			for _, param := range c.params {
+				param.Sub(Vector(c.base)).Scale(scale).Add(Vector(c.base))
+			}
+		} else {
+			for i, t := range f.Trees[:len(kept)] {
+				if newWeights[i] != oldWeights[i] {
+					c.addTree(t, newWeights[i]-oldWeights[i])
+				}
+			}
+		}
+	}
+
+	for i := len(kept); i < len(f.Trees); i++ {
+		c.addTree(f.Trees[i], f.Weights[i])
+	}
+	c.snapshot(f)
+}
+
+// outputs returns the cached forest outputs for the
+// samples.
+//
+// If any sample is not in the cache, ok is false.
+func (c *SampleCache) outputs(s []Sample) (res []ActionParams, ok bool) {
+	indices, ok := c.lookup(s)
+	if !ok {
+		return nil, false
+	}
+	res = make([]ActionParams, len(s))
+	for i, idx := range indices {
+		res[i] = ActionParams(c.params[idx].Copy())
+	}
+	return res, true
+}
+
+// treeWeightGradient is like the package-level
+// treeWeightGradient, but it uses cached leaf indices.
+//
+// Every sample must be in the cache.
+func (c *SampleCache) treeWeightGradient(g []*GradientSample, t *Tree) float64 {
+	ct := c.cachedTree(t)
+	leafGrads := make([]Vector, len(ct.leaves))
+	for _, sample := range g {
+		leaf := ct.indices[c.indices[sample.Sample]]
+		if leafGrads[leaf] == nil {
+			leafGrads[leaf] = sample.Gradient.Copy()
+		} else {
+			leafGrads[leaf].Add(sample.Gradient)
+		}
+	}
+	var sum float64
+	for i, grad := range leafGrads {
+		if grad != nil {
+			sum += grad.Dot(Vector(ct.leaves[i]))
+		}
+	}
+	return sum / totalWeight(g)
+}
+
+// featureOrder returns the order of the samples along
+// every feature, computing it if necessary.
+//
+// If c is nil or the samples are too numerous to be
+// presorted, nil is returned.
+func (c *SampleCache) featureOrder() *featureOrder {
+	if c == nil || len(c.samples) == 0 ||
+		len(c.samples)*c.samples[0].NumFeatures() > maxPresortEntries {
+		return nil
+	}
+	if c.order == nil {
+		c.order = newFeatureOrder(c.samples, c.indices)
+	}
+	return c.order
+}
+
+// featureBins quantizes the cached samples for a
+// histogram-based build and sets the bins field of each
+// GradientSample in data.
+// The quantization is reused by later calls with the same
+// maxBins.
+//
+// If c is nil or any sample is not in the cache, nil is
+// returned and data is left unchanged.
+func (c *SampleCache) featureBins(data []*GradientSample, maxBins int) *featureBins {
+	if c == nil || len(c.samples) == 0 {
+		return nil
+	}
+	indices := make([]int, len(data))
+	for i, sample := range data {
+		idx, ok := c.indices[sample.Sample]
+		if !ok {
+			return nil
+		}
+		indices[i] = idx
+	}
+	if c.bins == nil || c.binsMax != maxBins {
+		c.bins, c.binIndices = quantizeFeatures(c.samples, maxBins)
+		c.binsMax = maxBins
+	}
+	numFeatures := len(c.bins.Thresholds)
+	for i, sample := range data {
+		start := indices[i] * numFeatures
+		sample.bins = c.binIndices[start : start+numFeatures : start+numFeatures]
+	}
+	return c.bins
+}
+
+func (c *SampleCache) lookup(s []Sample) ([]int, bool) {
+	res := make([]int, len(s))
+	for i, sample := range s {
+		idx, ok := c.indices[sample]
+		if !ok {
+			return nil, false
+		}
+		res[i] = idx
+	}
+	return res, true
+}
+
+func (c *SampleCache) recompute(f *Forest) {
+	c.params = make([]Vector, len(c.samples))
+	for i, out := range f.applySamples(c.samples) {
+		c.params[i] = Vector(out)
+	}
+	for t := range c.treeLeaves {
+		delete(c.treeLeaves, t)
+	}
+	c.snapshot(f)
+}
+
+func (c *SampleCache) addTree(t *Tree, weight float64) {
+	ct := c.cachedTree(t)
+	for i, param := range c.params {
+		for j, x := range ct.leaves[ct.indices[i]] {
+			param[j] += x * weight
+		}
+	}
+}
+
+func (c *SampleCache) cachedTree(t *Tree) *cachedTree {
+	if ct, ok := c.treeLeaves[t]; ok {
+		return ct
+	}
+	ct := newCachedTree(t, c.samples)
+	c.treeLeaves[t] = ct
+	return ct
+}
+
+func (c *SampleCache) snapshot(f *Forest) {
+	c.base = append(ActionParams{}, f.Base...)
+	c.trees = append([]*Tree{}, f.Trees...)
+	c.weights = append([]float64{}, f.Weights...)
+}
+
+// cachedTree stores the leaf that each sample in a
+// SampleCache falls into.
+//
+// Samples in linear leaves get their own entries in
+// leaves, since their parameters depend on the sample.
+type cachedTree struct {
+	leaves  []ActionParams
+	indices []int32
+}
+
+func newCachedTree(t *Tree, samples []Sample) *cachedTree {
+	res := &cachedTree{indices: make([]int32, len(samples))}
+	leafIndices := map[*Tree]int32{}
+	var addLeaves func(t *Tree)
+	addLeaves = func(t *Tree) {
+		if t.Leaf {
+			if len(t.LinearFeatures) == 0 {
+				leafIndices[t] = int32(len(res.leaves))
+				res.leaves = append(res.leaves, t.Params)
+			}
+		} else {
+			addLeaves(t.LessThan)
+			addLeaves(t.GreaterEqual)
+		}
+	}
+	addLeaves(t)
+	for i, sample := range samples {
+		leaf := t.findLeaf(sample)
+		if len(leaf.LinearFeatures) > 0 {
+			res.indices[i] = int32(len(res.leaves))
+			res.leaves = append(res.leaves, leaf.leafParams(sample))
+		} else {
+			res.indices[i] = leafIndices[leaf]
+		}
+	}
+	return res
+}
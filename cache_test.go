@@ -0,0 +1,106 @@
+package treeagent
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/anyvec/anyvec64"
+)
+
+func TestSampleCache(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	samples := benchmarkingSamples(c, 3, 200, false)
+	forest := benchmarkingForest(10, 3, 3, 2)
+	cache := NewSampleCache(samples)
+
+	mutations := []func(){
+		func() {},
+		func() { forest.Add(benchmarkingTree(3, 3, 2), 0.3) },
+		func() { forest.Scale(0.9) },
+		func() {
+			forest.Scale(0.5)
+			forest.Add(benchmarkingTree(2, 3, 2), 0.1)
+		},
+		func() { forest.RemoveFirst() },
+		func() {
+			weights := make([]float64, len(forest.Weights))
+			for i := range weights {
+				weights[i] = rand.NormFloat64()
+			}
+			forest.AddWeights(weights, 0.5)
+			forest.PruneNegative()
+		},
+		func() { forest.Base[0] = 3 },
+	}
+	for i, mutation := range mutations {
+		mutation()
+		cache.Sync(forest)
+		actual, ok := cache.outputs(samples[10:50])
+		if !ok {
+			t.Fatal("samples should be cached")
+		}
+		expected := forest.applySamples(samples[10:50])
+		for j, x := range expected {
+			for k, val := range x {
+				if math.Abs(val-actual[j][k]) > 1e-8 {
+					t.Fatalf("mutation %d: expected %v but got %v", i, x, actual[j])
+				}
+			}
+		}
+	}
+}
+
+func TestSampleCacheWeightGradient(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	samples := benchmarkingSamples(c, 3, 200, false)
+	forest := benchmarkingForest(10, 3, 3, 2)
+	ppo := &PPO{PG: PG{ActionSpace: anyrl.Softmax{}}}
+
+	expected, expectedObj, _ := ppo.WeightGradient(samples[:100], forest)
+	ppo.Cache = NewSampleCache(samples)
+	actual, actualObj, _ := ppo.WeightGradient(samples[:100], forest)
+
+	if math.Abs(expectedObj.(float64)-actualObj.(float64)) > 1e-8 {
+		t.Errorf("expected objective %v but got %v", expectedObj, actualObj)
+	}
+	for i, x := range expected {
+		if math.Abs(x-actual[i]) > 1e-8 {
+			t.Errorf("weight %d: expected %f but got %f", i, x, actual[i])
+		}
+	}
+}
+
+func BenchmarkSampleCache(b *testing.B) {
+	c := anyvec64.DefaultCreator{}
+	samples := benchmarkingSamples(c, 10, 5000, false)
+	forest := benchmarkingForest(200, benchmarkDepth, 10, 2)
+	ppo := &PPO{
+		PG: PG{
+			Builder:     Builder{MaxDepth: benchmarkDepth},
+			ActionSpace: anyrl.Softmax{},
+		},
+	}
+	for _, cached := range []bool{false, true} {
+		name := "Uncached"
+		if cached {
+			name = "Cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			f := &Forest{
+				Base:    forest.Base,
+				Trees:   append([]*Tree{}, forest.Trees...),
+				Weights: append([]float64{}, forest.Weights...),
+			}
+			ppo.Cache = nil
+			if cached {
+				ppo.Cache = NewSampleCache(samples)
+			}
+			for i := 0; i < b.N; i++ {
+				tree, _, _ := ppo.Build(samples, f)
+				f.Add(tree, 0.1)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package treeagent
+
+import (
+	"math"
+	"sort"
+)
+
+// categoricalPowerIters is the number of power iterations
+// used to find the direction along which categories are
+// ordered.
+const categoricalPowerIters = 20
+
+// categoryGroup stores the samples for one category of a
+// categorical feature.
+type categoryGroup struct {
+	Value   float64
+	Missing bool
+	Samples []*GradientSample
+	Mean    Vector
+}
+
+// categoricalSplit finds the best split which sends a
+// subset of a categorical feature's values to the
+// LessThan branch.
+// It returns nil if no split is effective.
+//
+// The categories are ordered by their mean gradients,
+// projected onto the direction in which those means vary
+// the most.
+// Only splits between consecutive categories in this
+// order are considered.
+// Missing values are treated as an extra category.
+func (b *Builder) categoricalSplit(samples []*GradientSample, feature int) *splitInfo {
+	groups := categoryGroups(samples, feature)
+	if len(groups) < 2 {
+		return nil
+	}
+
+	direction := categoryDirection(groups)
+	scores := make([]float64, len(groups))
+	for i, group := range groups {
+		scores[i] = group.Mean.Dot(direction)
+	}
+	sort.Stable(&categorySorter{groups: groups, scores: scores})
+
+	tracker := b.algorithm().SplitTracker(b.LeafL2)
+	tracker.Reset(samples)
+	minLeaf := b.minLeaf(len(samples))
+
+	var bestSplit *splitInfo
+	var bestIdx int
+	var numLeft int
+	for i, group := range groups[:len(groups)-1] {
+		for _, sample := range group.Samples {
+			tracker.MoveToLeft(sample)
+		}
+		numLeft += len(group.Samples)
+		if numLeft < minLeaf || len(samples)-numLeft < minLeaf {
+			continue
+		}
+		newSplit := &splitInfo{
+			Feature: feature,
+			Quality: tracker.Quality(),
+			Gain:    tracker.Gain(),
+		}
+		if bestSplit == nil || newSplit.Quality > bestSplit.Quality {
+			bestSplit = newSplit
+			bestIdx = i
+		}
+	}
+	if bestSplit == nil {
+		return nil
+	}
+
+	left, right := groups[:bestIdx+1], groups[bestIdx+1:]
+	if len(left) == 1 && left[0].Missing {
+		// Only known categories can be sent left, so
+		// the branches are swapped.
+		left, right = right, left
+	}
+	for _, group := range left {
+		if group.Missing {
+			bestSplit.MissingLeft = true
+		} else {
+			bestSplit.Categories = append(bestSplit.Categories, group.Value)
+		}
+	}
+	sort.Float64s(bestSplit.Categories)
+	return bestSplit
+}
+
+// categoryGroups groups the samples by category, sorted
+// by value with missing values at the end.
+func categoryGroups(samples []*GradientSample, feature int) []*categoryGroup {
+	byValue := map[float64]*categoryGroup{}
+	var missing *categoryGroup
+	var groups []*categoryGroup
+	for _, sample := range samples {
+		value := sample.Feature(feature)
+		var group *categoryGroup
+		if math.IsNaN(value) {
+			if missing == nil {
+				missing = &categoryGroup{Missing: true}
+			}
+			group = missing
+		} else if group = byValue[value]; group == nil {
+			group = &categoryGroup{Value: value}
+			byValue[value] = group
+			groups = append(groups, group)
+		}
+		group.Samples = append(group.Samples, sample)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Value < groups[j].Value
+	})
+	if missing != nil {
+		groups = append(groups, missing)
+	}
+	for _, group := range groups {
+		group.Mean = meanGradient(group.Samples)
+	}
+	return groups
+}
+
+// categoryDirection finds the principal direction of the
+// groups' mean gradients, weighted by the total sample
+// weight in each group.
+func categoryDirection(groups []*categoryGroup) Vector {
+	var total float64
+	center := make(Vector, len(groups[0].Mean))
+	for _, group := range groups {
+		n := totalWeight(group.Samples)
+		center.Add(group.Mean.Copy().Scale(n))
+		total += n
+	}
+	center.Scale(1 / total)
+
+	deviations := make([]Vector, len(groups))
+	var direction Vector
+	var maxNorm float64
+	for i, group := range groups {
+		deviations[i] = group.Mean.Copy().Sub(center)
+		if norm := deviations[i].Dot(deviations[i]); direction == nil || norm > maxNorm {
+			direction = deviations[i].Copy()
+			maxNorm = norm
+		}
+	}
+
+	for iter := 0; iter < categoricalPowerIters && maxNorm > 0; iter++ {
+		next := make(Vector, len(direction))
+		for i, group := range groups {
+			dot := deviations[i].Dot(direction) * totalWeight(group.Samples)
+			next.Add(deviations[i].Copy().Scale(dot))
+		}
+		norm := math.Sqrt(next.Dot(next))
+		if norm == 0 {
+			break
+		}
+		direction = next.Scale(1 / norm)
+	}
+	return direction
+}
+
+// categorySorter sorts category groups by their scores.
+type categorySorter struct {
+	groups []*categoryGroup
+	scores []float64
+}
+
+func (c *categorySorter) Len() int {
+	return len(c.groups)
+}
+
+func (c *categorySorter) Less(i, j int) bool {
+	return c.scores[i] < c.scores[j]
+}
+
+func (c *categorySorter) Swap(i, j int) {
+	c.groups[i], c.groups[j] = c.groups[j], c.groups[i]
+	c.scores[i], c.scores[j] = c.scores[j], c.scores[i]
+}
@@ -0,0 +1,90 @@
+package treeagent
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestCategoricalSplit(t *testing.T) {
+	leftCategories := map[float64]bool{1: true, 4: true, 7: true, 8: true}
+	samples := make([]*GradientSample, 1000)
+	for i := range samples {
+		category := float64(rand.Intn(10))
+		grad := Vector{-1, 0.5}
+		if leftCategories[category] {
+			grad = Vector{1, -0.5}
+		}
+		samples[i] = &GradientSample{
+			Sample:    &memorySample{features: []float64{rand.NormFloat64(), category}},
+			Gradient:  grad.Add(Vector{rand.NormFloat64() * 0.1, rand.NormFloat64() * 0.1}),
+			Curvature: Vector{1, 1},
+		}
+	}
+	for _, algo := range TreeAlgorithms {
+		b := &Builder{Algorithm: algo, MaxDepth: 1, CategoricalFeatures: []int{1}}
+		tree := b.build(samples)
+		if tree.Leaf || tree.Feature != 1 {
+			t.Errorf("%s: expected split on categorical feature", algo)
+			continue
+		}
+		var actual []float64
+		for category := 0.0; category < 10; category++ {
+			if tree.Branch(sliceFeatureSource{0, category}) == tree.LessThan {
+				actual = append(actual, category)
+			}
+		}
+		if !reflect.DeepEqual(actual, tree.Categories) {
+			t.Errorf("%s: categories %v do not match branches %v", algo,
+				tree.Categories, actual)
+		}
+		if !reflect.DeepEqual(actual, []float64{1, 4, 7, 8}) &&
+			!reflect.DeepEqual(actual, []float64{0, 2, 3, 5, 6, 9}) {
+			t.Errorf("%s: unexpected categories %v", algo, actual)
+		}
+	}
+}
+
+func TestCategoricalForest(t *testing.T) {
+	forest := benchmarkingForest(20, 4, 5, 2)
+	var convert func(t *Tree, depth int)
+	convert = func(t *Tree, depth int) {
+		if t.Leaf {
+			return
+		}
+		if depth%2 == 1 {
+			t.Categories = []float64{-1, 1}
+			t.Threshold = 0
+		}
+		convert(t.LessThan, depth+1)
+		convert(t.GreaterEqual, depth+1)
+	}
+	for _, tree := range forest.Trees {
+		convert(tree, 0)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteForest(&buf, forest); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ReadForest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testForestsEqual(t, forest, decoded)
+
+	compiled := forest.Compile()
+	features := make([]float64, 5*30)
+	for j := range features {
+		features[j] = float64(rand.Intn(3) - 1)
+	}
+	actual := compiled.ApplyBatch(features, 30)
+	for i := 0; i < 30; i++ {
+		expected := forest.Apply(features[i*5 : (i+1)*5])
+		if !reflect.DeepEqual(ActionParams(actual[i*2:(i+1)*2]), expected) {
+			t.Fatalf("sample %d: expected %v but got %v", i, expected,
+				actual[i*2:(i+1)*2])
+		}
+	}
+}
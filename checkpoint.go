@@ -0,0 +1,335 @@
+package treeagent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/unixpickle/essentials"
+)
+
+// checkpointMagic is the header of every checkpoint log.
+var checkpointMagic = []byte("TRFL")
+
+// checkpointVersion is the current version of the
+// checkpoint log encoding.
+const checkpointVersion = 1
+
+// Record kinds in a checkpoint log.
+const (
+	checkpointMarker byte = iota
+	checkpointSetBase
+	checkpointRemove
+	checkpointScale
+	checkpointSetWeights
+	checkpointAdd
+)
+
+// A CheckpointLog writes Forest checkpoints to an
+// append-only log.
+//
+// Each checkpoint only records how the forest changed
+// since the previous checkpoint.
+// Since boosting mostly appends trees, a checkpoint
+// usually costs O(new trees) to write.
+// The exception is an arbitrary change to the weights
+// (e.g. from Forest.AddWeights), which is stored as a
+// full weight vector.
+//
+// Trees are identified by pointer, so trees should not be
+// modified in place after they are added to a forest.
+type CheckpointLog struct {
+	w     io.Writer
+	count int
+
+	base    ActionParams
+	trees   []*Tree
+	weights []float64
+}
+
+// NewCheckpointLog creates an empty log and writes its
+// header to w.
+func NewCheckpointLog(w io.Writer) (*CheckpointLog, error) {
+	bw := &binaryWriter{w: bufio.NewWriter(w)}
+	bw.Bytes(checkpointMagic)
+	bw.Uvarint(checkpointVersion)
+	if err := bw.Flush(); err != nil {
+		return nil, essentials.AddCtx("create checkpoint log", err)
+	}
+	return &CheckpointLog{w: w}, nil
+}
+
+// ResumeCheckpointLog creates a CheckpointLog which
+// appends to an existing log.
+//
+// The latest argument is the forest from the last
+// checkpoint in the log, and count is the number of
+// checkpoints in the log.
+// Both can be obtained with ReplayCheckpoints.
+func ResumeCheckpointLog(w io.Writer, latest *Forest, count int) *CheckpointLog {
+	res := &CheckpointLog{w: w, count: count}
+	res.snapshot(latest)
+	return res
+}
+
+// NumCheckpoints returns the number of checkpoints in the
+// log, including ones that were written before the log
+// was resumed.
+func (c *CheckpointLog) NumCheckpoints() int {
+	return c.count
+}
+
+// Checkpoint appends the state of f to the log.
+//
+// The checkpoint is written with a single call to Write.
+func (c *CheckpointLog) Checkpoint(f *Forest) (err error) {
+	defer essentials.AddCtxTo("checkpoint forest", &err)
+	if len(f.Trees) != len(f.Weights) {
+		return errors.New("mismatching tree and weight counts")
+	}
+
+	var buf bytes.Buffer
+	bw := &binaryWriter{w: bufio.NewWriter(&buf)}
+
+	if !floatsEqual(c.base, f.Base) {
+		bw.Bytes([]byte{checkpointSetBase})
+		bw.Floats(f.Base)
+	}
+
+	removed, kept := removedTrees(c.trees, f)
+	if removed == nil {
+		return errors.New("trees were reordered or replaced")
+	}
+	if len(removed) > 0 {
+		bw.Bytes([]byte{checkpointRemove})
+		bw.Uvarint(uint64(len(removed)))
+		for _, idx := range removed {
+			bw.Uvarint(uint64(idx))
+		}
+	}
+
+	oldWeights := make([]float64, 0, len(kept))
+	for _, idx := range kept {
+		oldWeights = append(oldWeights, c.weights[idx])
+	}
+	newWeights := f.Weights[:len(kept)]
+	if !floatsEqual(oldWeights, newWeights) {
+		if scale, ok := exactScale(oldWeights, newWeights); ok {
+			bw.Bytes([]byte{checkpointScale})
+			bw.Float(scale)
+		} else {
+			bw.Bytes([]byte{checkpointSetWeights})
+			bw.Floats(newWeights)
+		}
+	}
+
+	for i := len(kept); i < len(f.Trees); i++ {
+		bw.Bytes([]byte{checkpointAdd})
+		bw.Float(f.Weights[i])
+		bw.Tree(f.Trees[i])
+	}
+
+	bw.Bytes([]byte{checkpointMarker})
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	c.count++
+	c.snapshot(f)
+	return nil
+}
+
+func (c *CheckpointLog) snapshot(f *Forest) {
+	c.base = append(ActionParams{}, f.Base...)
+	c.trees = append([]*Tree{}, f.Trees...)
+	c.weights = append([]float64{}, f.Weights...)
+}
+
+// ErrIncompleteCheckpoint is returned by a
+// CheckpointReader when a log ends partway through a
+// checkpoint, e.g. because a write was interrupted.
+//
+// The checkpoints before the incomplete one are intact,
+// and the log can be truncated to the reader's Offset to
+// remove the incomplete checkpoint.
+var ErrIncompleteCheckpoint = errors.New("incomplete checkpoint")
+
+// A CheckpointReader replays the checkpoints in a log.
+type CheckpointReader struct {
+	r      *binaryReader
+	forest *Forest
+
+	counter *countingReader
+	offset  int64
+}
+
+// NewCheckpointReader creates a CheckpointReader and
+// reads the log's header.
+func NewCheckpointReader(r io.Reader) (res *CheckpointReader, err error) {
+	defer essentials.AddCtxTo("read checkpoint log", &err)
+	counter := &countingReader{r: r}
+	br := bufio.NewReader(counter)
+	header := make([]byte, len(checkpointMagic))
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header, checkpointMagic) {
+		return nil, errors.New("not a checkpoint log")
+	}
+	res = &CheckpointReader{r: &binaryReader{r: br}, forest: &Forest{},
+		counter: counter}
+	if version := res.r.Uvarint(); res.r.err != nil {
+		return nil, res.r.err
+	} else if version != checkpointVersion {
+		return nil, fmt.Errorf("unsupported version: %d", version)
+	}
+	res.updateOffset()
+	return res, nil
+}
+
+// Next replays the next checkpoint and returns the
+// resulting forest.
+//
+// Each returned forest is independent of the others,
+// although they may share *Tree pointers.
+//
+// At the end of the log, io.EOF is returned.
+// If the log ends partway through a checkpoint,
+// ErrIncompleteCheckpoint is returned.
+func (c *CheckpointReader) Next() (*Forest, error) {
+	if _, err := c.r.r.Peek(1); err == io.EOF {
+		return nil, io.EOF
+	}
+	f, err := c.next()
+	if err == io.ErrUnexpectedEOF {
+		return nil, ErrIncompleteCheckpoint
+	} else if err != nil {
+		return nil, essentials.AddCtx("read checkpoint", err)
+	}
+	c.updateOffset()
+	return f, nil
+}
+
+// Offset returns the number of bytes of the log which
+// have been replayed, which is the end of the last
+// checkpoint returned by Next (or of the header, if Next
+// has not returned a checkpoint).
+func (c *CheckpointReader) Offset() int64 {
+	return c.offset
+}
+
+func (c *CheckpointReader) next() (*Forest, error) {
+	for {
+		kind := c.r.Byte()
+		if c.r.err != nil {
+			return nil, c.r.err
+		}
+		switch kind {
+		case checkpointMarker:
+			return &Forest{
+				Base:    append(ActionParams{}, c.forest.Base...),
+				Trees:   append([]*Tree{}, c.forest.Trees...),
+				Weights: append([]float64{}, c.forest.Weights...),
+			}, nil
+		case checkpointSetBase:
+			c.forest.Base = c.r.Floats()
+		case checkpointRemove:
+			c.replayRemove()
+		case checkpointScale:
+			c.forest.Scale(c.r.Float())
+		case checkpointSetWeights:
+			weights := c.r.Floats()
+			if c.r.err == nil && len(weights) != len(c.forest.Weights) {
+				c.r.fail(errors.New("weight count mismatch"))
+			}
+			c.forest.Weights = weights
+		case checkpointAdd:
+			weight := c.r.Float()
+			c.forest.Add(c.r.Tree(), weight)
+		default:
+			return nil, fmt.Errorf("unknown record kind: %d", kind)
+		}
+	}
+}
+
+func (c *CheckpointReader) updateOffset() {
+	c.offset = c.counter.N - int64(c.r.r.Buffered())
+}
+
+func (c *CheckpointReader) replayRemove() {
+	count := c.r.Int()
+	remove := map[int]bool{}
+	for i := 0; i < count && c.r.err == nil; i++ {
+		idx := c.r.Int()
+		if idx >= len(c.forest.Trees) {
+			c.r.fail(errors.New("tree index out of range"))
+			return
+		}
+		remove[idx] = true
+	}
+	if c.r.err != nil {
+		return
+	}
+	if count == 1 && remove[0] {
+		c.forest.RemoveFirst()
+		return
+	}
+	var newTrees []*Tree
+	var newWeights []float64
+	for i, t := range c.forest.Trees {
+		if !remove[i] {
+			newTrees = append(newTrees, t)
+			newWeights = append(newWeights, c.forest.Weights[i])
+		}
+	}
+	c.forest.Trees = newTrees
+	c.forest.Weights = newWeights
+}
+
+// ReplayCheckpoints reads a checkpoint log and returns
+// the forest at the given checkpoint index.
+//
+// If index is negative, the latest checkpoint is used.
+//
+// The count return value indicates how many checkpoints
+// were read.
+// If the log contains no checkpoints, forest is nil.
+//
+// An incomplete checkpoint at the end of the log is
+// treated like the end of the log.
+func ReplayCheckpoints(r io.Reader, index int) (forest *Forest, count int, err error) {
+	reader, err := NewCheckpointReader(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	for index < 0 || count <= index {
+		f, err := reader.Next()
+		if err == io.EOF || err == ErrIncompleteCheckpoint {
+			break
+		} else if err != nil {
+			return nil, count, err
+		}
+		forest = f
+		count++
+	}
+	if index >= 0 && count <= index {
+		return nil, count, fmt.Errorf("replay checkpoints: index %d out of range", index)
+	}
+	return forest, count, nil
+}
+
+// countingReader counts the bytes read from a reader.
+type countingReader struct {
+	r io.Reader
+	N int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.N += int64(n)
+	return n, err
+}
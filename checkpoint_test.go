@@ -0,0 +1,190 @@
+package treeagent
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestCheckpointLog(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := NewCheckpointLog(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forest, snapshots := checkpointTestForests(t, log)
+
+	for i, expected := range snapshots {
+		actual, count, err := ReplayCheckpoints(bytes.NewReader(buf.Bytes()), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != i+1 {
+			t.Errorf("checkpoint %d: expected count %d but got %d", i, i+1, count)
+		}
+		testForestsEqual(t, expected, actual)
+	}
+
+	latest, count, err := ReplayCheckpoints(bytes.NewReader(buf.Bytes()), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(snapshots) {
+		t.Errorf("expected %d checkpoints but got %d", len(snapshots), count)
+	}
+	testForestsEqual(t, forest, latest)
+
+	viaRead, err := ReadForest(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testForestsEqual(t, forest, viaRead)
+}
+
+func TestCheckpointLogResume(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := NewCheckpointLog(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpointTestForests(t, log)
+
+	forest, count, err := ReplayCheckpoints(bytes.NewReader(buf.Bytes()), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log = ResumeCheckpointLog(&buf, forest, count)
+	forest.Add(benchmarkingTree(2, 3, 2), 0.5)
+	forest.RemoveFirst()
+	if err := log.Checkpoint(forest); err != nil {
+		t.Fatal(err)
+	}
+	if log.NumCheckpoints() != count+1 {
+		t.Errorf("expected %d checkpoints but got %d", count+1, log.NumCheckpoints())
+	}
+
+	reader, err := NewCheckpointReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last *Forest
+	for i := 0; true; i++ {
+		f, err := reader.Next()
+		if err == io.EOF {
+			if i != count+1 {
+				t.Errorf("expected %d checkpoints but got %d", count+1, i)
+			}
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		last = f
+	}
+	testForestsEqual(t, forest, last)
+}
+
+func TestCheckpointLogTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := NewCheckpointLog(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, snapshots := checkpointTestForests(t, log)
+	complete := buf.Len()
+
+	// Simulate a crash partway through a checkpoint.
+	last := snapshots[len(snapshots)-1]
+	forest := &Forest{
+		Base:    append(ActionParams{}, last.Base...),
+		Trees:   append([]*Tree{}, last.Trees...),
+		Weights: append([]float64{}, last.Weights...),
+	}
+	forest.Add(benchmarkingTree(2, 3, 2), 0.5)
+	if err := log.Checkpoint(forest); err != nil {
+		t.Fatal(err)
+	}
+	buf.Truncate(buf.Len() - 3)
+
+	latest, count, err := ReplayCheckpoints(bytes.NewReader(buf.Bytes()), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(snapshots) {
+		t.Errorf("expected %d checkpoints but got %d", len(snapshots), count)
+	}
+	testForestsEqual(t, last, latest)
+
+	reader, err := NewCheckpointReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; true; i++ {
+		_, err := reader.Next()
+		if err == ErrIncompleteCheckpoint {
+			if i != len(snapshots) {
+				t.Errorf("expected %d checkpoints but got %d", len(snapshots), i)
+			}
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reader.Offset() != int64(complete) {
+		t.Fatalf("expected offset %d but got %d", complete, reader.Offset())
+	}
+
+	// Resume the log after removing the incomplete
+	// checkpoint.
+	buf.Truncate(int(reader.Offset()))
+	log = ResumeCheckpointLog(&buf, latest, count)
+	latest.Add(benchmarkingTree(2, 3, 2), 0.5)
+	if err := log.Checkpoint(latest); err != nil {
+		t.Fatal(err)
+	}
+	resumed, count, err := ReplayCheckpoints(bytes.NewReader(buf.Bytes()), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(snapshots)+1 {
+		t.Errorf("expected %d checkpoints but got %d", len(snapshots)+1, count)
+	}
+	testForestsEqual(t, latest, resumed)
+}
+
+// checkpointTestForests applies a sequence of forest
+// mutations and checkpoints the forest after each batch.
+//
+// It returns the final forest and a copy of the forest at
+// each checkpoint.
+func checkpointTestForests(t *testing.T, log *CheckpointLog) (*Forest, []*Forest) {
+	forest := NewForest(2)
+	var snapshots []*Forest
+	for batch := 0; batch < 10; batch++ {
+		for i := 0; i < 3; i++ {
+			forest.Add(benchmarkingTree(2, 3, 2), rand.NormFloat64())
+		}
+		switch batch % 4 {
+		case 1:
+			forest.Scale(0.99)
+		case 2:
+			forest.RemoveFirst()
+		case 3:
+			weights := make([]float64, len(forest.Weights))
+			for i := range weights {
+				weights[i] = rand.NormFloat64()
+			}
+			forest.AddWeights(weights, 0.1)
+			forest.PruneNegative()
+		}
+		if err := log.Checkpoint(forest); err != nil {
+			t.Fatal(err)
+		}
+		snapshots = append(snapshots, &Forest{
+			Base:    append(ActionParams{}, forest.Base...),
+			Trees:   append([]*Tree{}, forest.Trees...),
+			Weights: append([]float64{}, forest.Weights...),
+		})
+	}
+	return forest, snapshots
+}
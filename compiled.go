@@ -0,0 +1,329 @@
+package treeagent
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/essentials"
+)
+
+// compiledChunkSize is the number of samples processed
+// together by CompiledForest.ApplyBatch.
+const compiledChunkSize = 64
+
+// A CompiledForest is an immutable, flattened version of
+// a Forest which is optimized for fast inference.
+//
+// The nodes of every tree are stored in one contiguous
+// array, and the leaf parameters are stored in a single
+// pool with the tree weights already multiplied in.
+//
+// Oblivious trees are evaluated with bit-indexing rather
+// than by following branches.
+type CompiledForest struct {
+	base      []float64
+	paramDim  int
+	roots     []int32
+	oblivious []*compiledOblivious
+	nodes     []compiledNode
+	leaves    []float64
+	special   []Tree
+}
+
+// compiledNode is a node in a CompiledForest.
+//
+// Nodes are stored in pre-order, so the LessThan child of
+// a branching node always comes right after it.
+//
+// For leaf nodes, GreaterEqual is the offset of the
+// leaf's parameters in the leaf pool.
+// For constant leaves, Feature is -1.
+//
+// For linear leaves and for branching nodes which are not
+// simple threshold splits (e.g. oblique or categorical
+// splits, or splits which send missing values to
+// LessThan), Feature is -2-i, where i is the index of a
+// copy of the original node (without its children) in
+// the CompiledForest's special table.
+// Linear leaves are copied without their Params, and
+// their LinearWeights are multiplied by the tree weight.
+type compiledNode struct {
+	Feature      int32
+	GreaterEqual int32
+	Threshold    float64
+}
+
+// compiledOblivious is an oblivious tree in a
+// CompiledForest.
+//
+// The tree's leaves are stored consecutively in the
+// node array, starting at FirstLeaf, and are indexed by
+// the bits of the splits as described in obliviousTree.
+type compiledOblivious struct {
+	Features   []int32
+	Thresholds []float64
+	FirstLeaf  int32
+}
+
+func (c *compiledOblivious) leaf(list FeatureSource) int32 {
+	var idx int32
+	for i, feature := range c.Features {
+		idx <<= 1
+		if !(list.Feature(int(feature)) < c.Thresholds[i]) {
+			idx |= 1
+		}
+	}
+	return c.FirstLeaf + idx
+}
+
+func (c *compiledOblivious) sliceLeaf(sample []float64) int32 {
+	var idx int32
+	for i, feature := range c.Features {
+		idx <<= 1
+		if !(sample[feature] < c.Thresholds[i]) {
+			idx |= 1
+		}
+	}
+	return c.FirstLeaf + idx
+}
+
+// Compile produces a CompiledForest which computes the
+// same outputs as f.
+//
+// The result does not reflect future changes to f.
+func (f *Forest) Compile() *CompiledForest {
+	res := &CompiledForest{
+		base:     append([]float64{}, f.Base...),
+		paramDim: len(f.Base),
+	}
+	for i, tree := range f.Trees {
+		if features, thresholds, leaves, ok := obliviousSplits(tree); ok {
+			ob := &compiledOblivious{
+				Thresholds: thresholds,
+				FirstLeaf:  int32(len(res.nodes)),
+			}
+			for _, feature := range features {
+				ob.Features = append(ob.Features, int32(feature))
+			}
+			for _, leaf := range leaves {
+				res.addTree(leaf, f.Weights[i])
+			}
+			res.roots = append(res.roots, ob.FirstLeaf)
+			res.oblivious = append(res.oblivious, ob)
+		} else {
+			res.roots = append(res.roots, res.addTree(tree, f.Weights[i]))
+			res.oblivious = append(res.oblivious, nil)
+		}
+	}
+	return res
+}
+
+func (c *CompiledForest) addTree(t *Tree, weight float64) int32 {
+	idx := int32(len(c.nodes))
+	c.nodes = append(c.nodes, compiledNode{})
+	if t.Leaf {
+		c.nodes[idx] = compiledNode{Feature: -1, GreaterEqual: int32(len(c.leaves))}
+		for _, x := range t.Params {
+			c.leaves = append(c.leaves, x*weight)
+		}
+		if len(t.LinearFeatures) > 0 {
+			c.nodes[idx].Feature = -2 - int32(len(c.special))
+			leaf := Tree{
+				Leaf:           true,
+				LinearFeatures: append([]int{}, t.LinearFeatures...),
+				LinearCenters:  append([]float64{}, t.LinearCenters...),
+			}
+			for _, weights := range t.LinearWeights {
+				scaled := Vector(weights).Copy().Scale(weight)
+				leaf.LinearWeights = append(leaf.LinearWeights, ActionParams(scaled))
+			}
+			c.special = append(c.special, leaf)
+		}
+		return idx
+	}
+	feature := int32(t.Feature)
+	if len(t.ObliqueFeatures) > 0 || len(t.Categories) > 0 || t.MissingLeft {
+		feature = -2 - int32(len(c.special))
+		branch := *t.branchCopy(nil, nil)
+		branch.ObliqueFeatures = append([]int{}, t.ObliqueFeatures...)
+		branch.ObliqueWeights = append([]float64{}, t.ObliqueWeights...)
+		branch.Categories = append([]float64{}, t.Categories...)
+		c.special = append(c.special, branch)
+	}
+	c.addTree(t.LessThan, weight)
+	c.nodes[idx] = compiledNode{
+		Feature:      feature,
+		GreaterEqual: c.addTree(t.GreaterEqual, weight),
+		Threshold:    t.Threshold,
+	}
+	return idx
+}
+
+// NumTrees returns the number of trees in the forest.
+func (c *CompiledForest) NumTrees() int {
+	return len(c.roots)
+}
+
+// Apply runs the features through each tree and produces
+// a parameter vector.
+func (c *CompiledForest) Apply(features []float64) ActionParams {
+	params := make(ActionParams, c.paramDim)
+	c.applyChunk(features, params, 1)
+	return params
+}
+
+// ApplyFeatureSource is like Apply, but for a
+// FeatureSource.
+func (c *CompiledForest) ApplyFeatureSource(list FeatureSource) ActionParams {
+	params := make(ActionParams, c.paramDim)
+	c.applyInto(list, params)
+	return params
+}
+
+// ApplyBatch applies the forest to a packed batch of
+// feature vectors and produces a packed batch of
+// parameter vectors.
+//
+// Samples are processed in chunks, one tree at a time,
+// so that each tree's nodes stay in the cache while it
+// is applied to the chunk.
+func (c *CompiledForest) ApplyBatch(features []float64, batch int) []float64 {
+	numFeatures := len(features) / batch
+	res := make([]float64, batch*c.paramDim)
+	numChunks := (batch + compiledChunkSize - 1) / compiledChunkSize
+	c.parallelize(numChunks, func(i int) {
+		start := i * compiledChunkSize
+		end := essentials.MinInt(batch, start+compiledChunkSize)
+		c.applyChunk(features[start*numFeatures:end*numFeatures],
+			res[start*c.paramDim:end*c.paramDim], end-start)
+	})
+	return res
+}
+
+// ApplySamples applies the forest to every sample.
+func (c *CompiledForest) ApplySamples(samples []Sample) []ActionParams {
+	res := make([]ActionParams, len(samples))
+	c.parallelize(len(samples), func(i int) {
+		res[i] = c.ApplyFeatureSource(samples[i])
+	})
+	return res
+}
+
+func (c *CompiledForest) applyVec(in anyvec.Vector, batch int) anyvec.Vector {
+	outParams := c.ApplyBatch(vecToFloats(in), batch)
+	cr := in.Creator()
+	return cr.MakeVectorData(cr.MakeNumericList(outParams))
+}
+
+func (c *CompiledForest) applyInto(list FeatureSource, params []float64) {
+	copy(params, c.base)
+	for i, root := range c.roots {
+		idx := root
+		if ob := c.oblivious[i]; ob != nil {
+			idx = ob.leaf(list)
+		}
+		for !c.isLeaf(&c.nodes[idx]) {
+			node := &c.nodes[idx]
+			if c.goesLeft(node, list) {
+				idx++
+			} else {
+				idx = node.GreaterEqual
+			}
+		}
+		c.addLeaf(params, &c.nodes[idx])
+		if c.nodes[idx].Feature != -1 {
+			c.addLinearTerms(params, &c.nodes[idx], list)
+		}
+	}
+}
+
+// applyChunk applies the forest to a packed chunk of
+// feature vectors, writing the results to params.
+func (c *CompiledForest) applyChunk(features, params []float64, n int) {
+	numFeatures := len(features) / n
+	for i := 0; i < n; i++ {
+		copy(params[i*c.paramDim:(i+1)*c.paramDim], c.base)
+	}
+	for treeIdx, root := range c.roots {
+		ob := c.oblivious[treeIdx]
+		for i := 0; i < n; i++ {
+			sample := features[i*numFeatures : (i+1)*numFeatures]
+			idx := root
+			if ob != nil {
+				idx = ob.sliceLeaf(sample)
+			}
+			for {
+				node := &c.nodes[idx]
+				var left bool
+				if node.Feature >= 0 {
+					left = sample[node.Feature] < node.Threshold
+				} else if c.isLeaf(node) {
+					break
+				} else {
+					left = c.goesLeft(node, sliceFeatureSource(sample))
+				}
+				if left {
+					idx++
+				} else {
+					idx = node.GreaterEqual
+				}
+			}
+			out := params[i*c.paramDim : (i+1)*c.paramDim]
+			c.addLeaf(out, &c.nodes[idx])
+			if c.nodes[idx].Feature != -1 {
+				c.addLinearTerms(out, &c.nodes[idx], sliceFeatureSource(sample))
+			}
+		}
+	}
+}
+
+// goesLeft checks if the features belong in the LessThan
+// branch of a branching node.
+func (c *CompiledForest) goesLeft(node *compiledNode, list FeatureSource) bool {
+	if node.Feature >= 0 {
+		return list.Feature(int(node.Feature)) < node.Threshold
+	}
+	return c.special[-2-node.Feature].goesLeft(list)
+}
+
+func (c *CompiledForest) isLeaf(node *compiledNode) bool {
+	return node.Feature == -1 || (node.Feature < -1 && c.special[-2-node.Feature].Leaf)
+}
+
+// addLeaf adds the constant parameters of a leaf node to
+// params.
+func (c *CompiledForest) addLeaf(params []float64, node *compiledNode) {
+	offset := node.GreaterEqual
+	for j, x := range c.leaves[offset : int(offset)+c.paramDim] {
+		params[j] += x
+	}
+}
+
+// addLinearTerms adds the feature-dependent parameters
+// of a linear leaf node to params.
+func (c *CompiledForest) addLinearTerms(params []float64, node *compiledNode,
+	list FeatureSource) {
+	c.special[-2-node.Feature].addLinearTerms(list, params)
+}
+
+// parallelize calls f for every index in [0, n) using
+// multiple Goroutines.
+func (c *CompiledForest) parallelize(n int, f func(i int)) {
+	indices := make(chan int, n)
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	var wg sync.WaitGroup
+	for i := 0; i < essentials.MinInt(n, runtime.GOMAXPROCS(0)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				f(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
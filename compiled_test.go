@@ -0,0 +1,144 @@
+package treeagent
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestCompiledForest(t *testing.T) {
+	forest := benchmarkingForest(50, 5, 10, 3)
+	compiled := forest.Compile()
+	for i := 0; i < 100; i++ {
+		features := make([]float64, 10)
+		for j := range features {
+			features[j] = rand.NormFloat64()
+		}
+		expected := forest.Apply(features)
+		actual := compiled.Apply(features)
+		if !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("expected %v but got %v", expected, actual)
+		}
+	}
+}
+
+func TestCompiledForestBatch(t *testing.T) {
+	forest := benchmarkingForest(20, 4, 5, 2)
+	compiled := forest.Compile()
+	features := make([]float64, 5*30)
+	for j := range features {
+		features[j] = rand.NormFloat64()
+	}
+	actual := compiled.ApplyBatch(features, 30)
+	for i := 0; i < 30; i++ {
+		expected := forest.Apply(features[i*5 : (i+1)*5])
+		if !reflect.DeepEqual(ActionParams(actual[i*2:(i+1)*2]), expected) {
+			t.Fatalf("sample %d: expected %v but got %v", i, expected,
+				actual[i*2:(i+1)*2])
+		}
+	}
+}
+
+func TestForestCompileCache(t *testing.T) {
+	forest := benchmarkingForest(5, 2, 3, 2)
+	features := []float64{1, 2, 3}
+	c1 := forest.compiled()
+	if forest.compiled() != c1 {
+		t.Error("cache should be reused")
+	}
+	forest.Scale(2)
+	c2 := forest.compiled()
+	if c2 == c1 {
+		t.Error("cache should be invalidated by Scale")
+	}
+	if !reflect.DeepEqual(c2.Apply(features), forest.Apply(features)) {
+		t.Error("stale compiled forest")
+	}
+	forest.Add(benchmarkingForest(1, 2, 3, 2).Trees[0], 1)
+	if forest.compiled() == c2 {
+		t.Error("cache should be invalidated by Add")
+	}
+}
+
+func BenchmarkForestApply(b *testing.B) {
+	forest := benchmarkingForest(1000, 8, 100, 4)
+	samples := benchmarkingFeatures(100, 128)
+	b.Run("Pointer", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, s := range samples {
+				forest.Apply(s)
+			}
+		}
+	})
+	b.Run("Compiled", func(b *testing.B) {
+		compiled := forest.Compile()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, s := range samples {
+				compiled.Apply(s)
+			}
+		}
+	})
+}
+
+func BenchmarkForestApplyBatch(b *testing.B) {
+	forest := benchmarkingForest(1000, 8, 100, 4)
+	var packed []float64
+	for _, s := range benchmarkingFeatures(100, 128) {
+		packed = append(packed, s...)
+	}
+	b.Run("Pointer", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < 128; j++ {
+				forest.Apply(packed[j*100 : (j+1)*100])
+			}
+		}
+	})
+	b.Run("Compiled", func(b *testing.B) {
+		compiled := forest.Compile()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			compiled.ApplyBatch(packed, 128)
+		}
+	})
+}
+
+// benchmarkingForest creates a forest of random, full
+// trees with the given depth.
+func benchmarkingForest(numTrees, depth, numFeatures, paramDim int) *Forest {
+	res := NewForest(paramDim)
+	for i := range res.Base {
+		res.Base[i] = rand.NormFloat64()
+	}
+	for i := 0; i < numTrees; i++ {
+		res.Add(benchmarkingTree(depth, numFeatures, paramDim), rand.Float64())
+	}
+	return res
+}
+
+func benchmarkingTree(depth, numFeatures, paramDim int) *Tree {
+	if depth == 0 {
+		params := make(ActionParams, paramDim)
+		for i := range params {
+			params[i] = rand.NormFloat64()
+		}
+		return &Tree{Leaf: true, Params: params}
+	}
+	return &Tree{
+		Feature:      rand.Intn(numFeatures),
+		Threshold:    rand.NormFloat64(),
+		LessThan:     benchmarkingTree(depth-1, numFeatures, paramDim),
+		GreaterEqual: benchmarkingTree(depth-1, numFeatures, paramDim),
+	}
+}
+
+func benchmarkingFeatures(numFeatures, numSamples int) [][]float64 {
+	res := make([][]float64, numSamples)
+	for i := range res {
+		res[i] = make([]float64, numFeatures)
+		for j := range res[i] {
+			res[i][j] = rand.NormFloat64()
+		}
+	}
+	return res
+}
@@ -28,6 +28,9 @@ type Flags struct {
 	Depth       int
 	MinLeaf     int
 	MinLeafFrac float64
+	PruneFrac   float64
+	Random      int
+	Categorical bool
 	MaskParam   int
 	ValueFunc   bool
 
@@ -47,6 +50,11 @@ func main() {
 	flag.IntVar(&flags.MinLeaf, "minleaf", 1, "minimum samples per leaf")
 	flag.Float64Var(&flags.MinLeafFrac, "minleaffrac", 0,
 		"minimum fraction of samples per leaf")
+	flag.Float64Var(&flags.PruneFrac, "prunefrac", 0, "fraction of samples held out for pruning")
+	flag.IntVar(&flags.Random, "random", 0,
+		"random thresholds per feature (0 for exact splits)")
+	flag.BoolVar(&flags.Categorical, "categorical", false,
+		"split categorical features (e.g. RAM bytes) by category")
 	flag.IntVar(&flags.MaskParam, "mask", -1, "specific parameter to fit")
 	flag.BoolVar(&flags.ValueFunc, "valfunc", false, "train a value function, not a policy")
 	flag.BoolVar(&flags.DumpLeaves, "dump", false, "print all leaves")
@@ -56,6 +64,11 @@ func main() {
 	info, err := experiments.LookupEnvInfo(flags.EnvFlags.Name)
 	essentials.Must(err)
 
+	var categorical []int
+	if flags.Categorical {
+		categorical = experiments.EnvCategorical(info, &flags.EnvFlags)
+	}
+
 	log.Println("Creating training samples...")
 	samples := GatherSamples(c, &flags, flags.Batch)
 
@@ -87,20 +100,26 @@ func main() {
 		var tree *treeagent.Tree
 		if flags.ValueFunc {
 			judger := &treeagent.Judger{
-				MaxDepth:    flags.Depth,
-				ValueFunc:   treeagent.NewForest(1),
-				Discount:    flags.Discount,
-				MinLeaf:     flags.MinLeaf,
-				MinLeafFrac: flags.MinLeafFrac,
+				MaxDepth:            flags.Depth,
+				ValueFunc:           treeagent.NewForest(1),
+				Discount:            flags.Discount,
+				MinLeaf:             flags.MinLeaf,
+				MinLeafFrac:         flags.MinLeafFrac,
+				PruneFrac:           flags.PruneFrac,
+				RandomThresholds:    flags.Random,
+				CategoricalFeatures: categorical,
 			}
 			tree, _ = judger.Train(samples)
 		} else {
 			pg := &treeagent.PG{
 				Builder: treeagent.Builder{
-					MaxDepth:    flags.Depth,
-					Algorithm:   algo,
-					MinLeaf:     flags.MinLeaf,
-					MinLeafFrac: flags.MinLeafFrac,
+					MaxDepth:            flags.Depth,
+					Algorithm:           algo,
+					MinLeaf:             flags.MinLeaf,
+					MinLeafFrac:         flags.MinLeafFrac,
+					PruneFrac:           flags.PruneFrac,
+					RandomThresholds:    flags.Random,
+					CategoricalFeatures: categorical,
 				},
 				ActionSpace: info.ActionSpace,
 			}
@@ -171,11 +190,7 @@ func Visitation(t *treeagent.Tree, s []treeagent.Sample) map[*treeagent.Tree]int
 	visit = func(sample treeagent.Sample, t *treeagent.Tree) {
 		res[t]++
 		if !t.Leaf {
-			if sample.Feature(t.Feature) < t.Threshold {
-				visit(sample, t.LessThan)
-			} else {
-				visit(sample, t.GreaterEqual)
-			}
+			visit(sample, t.Branch(sample))
 		}
 	}
 	for _, sample := range s {
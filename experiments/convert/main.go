@@ -0,0 +1,69 @@
+// Converts forests between JSON and the binary format.
+//
+// This can also extract a forest from any checkpoint in a
+// checkpoint log, making it possible to roll back to an
+// earlier policy.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/treeagent"
+	"github.com/unixpickle/treeagent/experiments"
+)
+
+func main() {
+	var inFile string
+	var outFile string
+	var toJSON bool
+	var checkpoint int
+	flag.StringVar(&inFile, "in", "", "input forest file (JSON or binary)")
+	flag.StringVar(&outFile, "out", "", "output forest file")
+	flag.BoolVar(&toJSON, "json", false, "output JSON instead of binary")
+	flag.IntVar(&checkpoint, "checkpoint", -1,
+		"checkpoint index for checkpoint logs (-1 for latest)")
+	flag.Parse()
+
+	if inFile == "" || outFile == "" {
+		essentials.Die("Missing -in or -out flag. See -help.")
+	}
+
+	var forest *treeagent.Forest
+	var err error
+	if checkpoint >= 0 {
+		forest, err = loadCheckpoint(inFile, checkpoint)
+	} else {
+		forest, err = experiments.LoadForest(inFile)
+	}
+	if err != nil {
+		essentials.Die(err)
+	}
+
+	if toJSON {
+		data, err := json.Marshal(forest)
+		if err != nil {
+			essentials.Die(err)
+		}
+		err = ioutil.WriteFile(outFile, data, 0644)
+	} else {
+		err = experiments.SaveForest(outFile, forest)
+	}
+	if err != nil {
+		essentials.Die(err)
+	}
+}
+
+func loadCheckpoint(path string, index int) (*treeagent.Forest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	forest, _, err := treeagent.ReplayCheckpoints(f, index)
+	return forest, err
+}
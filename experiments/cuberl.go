@@ -6,8 +6,9 @@ import (
 )
 
 const (
-	cubeRLNumActs = 18
-	cubeRLNumObs  = 8*6 + 1
+	cubeRLNumActs     = 18
+	cubeRLNumStickers = 8 * 6
+	cubeRLNumObs      = cubeRLNumStickers + 1
 )
 
 func cubeRLInfo() *EnvInfo {
@@ -16,6 +17,7 @@ func cubeRLInfo() *EnvInfo {
 		ActionSpace: anyrl.Softmax{},
 		ParamSize:   cuberl.NumActions,
 		NumFeatures: cubeRLNumObs,
+		Categorical: allFeatures(cubeRLNumStickers),
 		CubeRL:      true,
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"compress/flate"
 	"errors"
 	"io"
+	"strings"
 
 	"github.com/unixpickle/anydiff/anyseq"
 	"github.com/unixpickle/anyrl"
@@ -43,6 +44,10 @@ type EnvInfo struct {
 	// values to use less RAM.
 	Uint8Features bool
 
+	// Indices of features which are unordered categories
+	// (e.g. colors) rather than numbers.
+	Categorical []int
+
 	// The collection to which the environment belongs.
 	Muniverse bool
 	Atari     bool
@@ -77,7 +82,7 @@ func LookupEnvInfo(name string) (*EnvInfo, error) {
 	}
 
 	if numActions, ok := atariActionSizes[name]; ok {
-		return &EnvInfo{
+		res := &EnvInfo{
 			Name:          name,
 			ActionSpace:   anyrl.Softmax{},
 			ParamSize:     numActions,
@@ -86,7 +91,12 @@ func LookupEnvInfo(name string) (*EnvInfo, error) {
 			NumFeatures:   atariObsSize(name),
 			Uint8Features: true,
 			Atari:         true,
-		}, nil
+		}
+		if strings.Contains(name, "-ram") {
+			// RAM bytes are often flags or IDs.
+			res.Categorical = allFeatures(res.NumFeatures)
+		}
+		return res, nil
 	}
 
 	if numActions, numObs, ok := mujocoEnvInfo(name); ok {
@@ -102,6 +112,18 @@ func LookupEnvInfo(name string) (*EnvInfo, error) {
 	return nil, errors.New("lookup game environment: \"" + name + "\" not found")
 }
 
+// EnvCategorical lists the categorical features in the
+// observations of environments created by MakeEnvs.
+func EnvCategorical(e *EnvInfo, flags *EnvFlags) []int {
+	res := append([]int{}, e.Categorical...)
+	if flags.History {
+		for _, feature := range e.Categorical {
+			res = append(res, feature+e.NumFeatures)
+		}
+	}
+	return res
+}
+
 // EnvRoller creates a roller with the appropriate fields
 // set for the environment.
 func EnvRoller(c anyvec.Creator, e *EnvInfo, p *treeagent.Forest) *treeagent.Roller {
@@ -161,6 +183,14 @@ func CloseEnvs(envs []Env) {
 	}
 }
 
+func allFeatures(n int) []int {
+	res := make([]int, n)
+	for i := range res {
+		res[i] = i
+	}
+	return res
+}
+
 // historyEnv keeps track of the previous observation and
 // concatenates it with the current observation.
 type historyEnv struct {
@@ -1,26 +1,25 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"image"
 	"image/color"
 	"image/png"
-	"io/ioutil"
 	"math"
 	"os"
 
 	"github.com/unixpickle/essentials"
 	"github.com/unixpickle/muniverse"
 	"github.com/unixpickle/treeagent"
+	"github.com/unixpickle/treeagent/experiments"
 )
 
 func main() {
 	var forestFile string
 	var envName string
 	var heatmapOut string
-	flag.StringVar(&forestFile, "in", "", "forest json file")
+	flag.StringVar(&forestFile, "in", "", "forest file (JSON or binary)")
 	flag.StringVar(&envName, "env", "", "muniverse environment name")
 	flag.StringVar(&heatmapOut, "heatmap", "heatmap.png", "heatmap output file")
 	flag.Parse()
@@ -29,14 +28,10 @@ func main() {
 		essentials.Die("Missing -in flag. See -help.")
 	}
 
-	data, err := ioutil.ReadFile(forestFile)
+	forest, err := experiments.LoadForest(forestFile)
 	if err != nil {
 		essentials.Die(err)
 	}
-	var forest *treeagent.Forest
-	if err := json.Unmarshal(data, &forest); err != nil {
-		essentials.Die(err)
-	}
 
 	fmt.Println("   # trees:", len(forest.Trees))
 
@@ -67,8 +62,18 @@ func countFeatures(f *treeagent.Forest) map[int]int {
 	counts := map[int]int{}
 	var addTree func(t *treeagent.Tree)
 	addTree = func(t *treeagent.Tree) {
-		if !t.Leaf {
-			counts[t.Feature]++
+		if t.Leaf {
+			for _, feature := range t.LinearFeatures {
+				counts[feature]++
+			}
+		} else {
+			if len(t.ObliqueFeatures) > 0 {
+				for _, feature := range t.ObliqueFeatures {
+					counts[feature]++
+				}
+			} else {
+				counts[t.Feature]++
+			}
 			addTree(t.LessThan)
 			addTree(t.GreaterEqual)
 		}
@@ -3,6 +3,7 @@ package experiments
 import (
 	"errors"
 	"flag"
+	"math/rand"
 	"strings"
 	"time"
 
@@ -18,23 +19,33 @@ type AlgorithmFlag struct {
 // String returns the string representation of the
 // algorithm.
 func (a *AlgorithmFlag) String() string {
+	if a.Algorithm == nil {
+		return ""
+	}
 	return a.Algorithm.String()
 }
 
 // Set sets the algorithm from a string representation.
+//
+// Any algorithm registered with
+// treeagent.RegisterAlgorithm may be used.
 func (a *AlgorithmFlag) Set(s string) error {
-	for _, alg := range treeagent.TreeAlgorithms {
-		if alg.String() == s {
-			a.Algorithm = alg
-			return nil
-		}
+	if alg, ok := treeagent.LookupAlgorithm(s); ok {
+		a.Algorithm = alg
+		return nil
 	}
 	return errors.New("unknown algorithm: " + s)
 }
 
 // AddFlag adds the flag to the flag package's global set
 // of flags.
+//
+// If no algorithm is set, the default is
+// treeagent.SumAlgorithm.
 func (a *AlgorithmFlag) AddFlag() {
+	if a.Algorithm == nil {
+		a.Algorithm = treeagent.SumAlgorithm
+	}
 	var names []string
 	for _, alg := range treeagent.TreeAlgorithms {
 		names = append(names, alg.String())
@@ -42,6 +53,29 @@ func (a *AlgorithmFlag) AddFlag() {
 	flag.Var(a, "algo", "splitting heuristic ("+strings.Join(names, ", ")+")")
 }
 
+// SeedFlag is a flag for seeding the random number
+// generators used during training.
+type SeedFlag struct {
+	Seed int64
+}
+
+// AddFlag adds the flag to the flag package's global set
+// of flags.
+func (s *SeedFlag) AddFlag() {
+	flag.Int64Var(&s.Seed, "seed", 0, "random seed (0 for a non-deterministic run)")
+}
+
+// Rand creates a random number generator from the seed.
+//
+// If no seed was provided, nil is returned, indicating
+// that the global source from math/rand should be used.
+func (s *SeedFlag) Rand() *rand.Rand {
+	if s.Seed == 0 {
+		return nil
+	}
+	return rand.New(rand.NewSource(s.Seed))
+}
+
 // EnvFlags holds various parameters for creating
 // environments.
 type EnvFlags struct {
@@ -0,0 +1,172 @@
+package experiments
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/treeagent"
+)
+
+// LoadForest reads a forest from a file.
+//
+// The file may use treeagent's binary format, JSON, or
+// be a checkpoint log (in which case the latest
+// checkpoint is loaded).
+func LoadForest(path string) (forest *treeagent.Forest, err error) {
+	defer essentials.AddCtxTo("load forest", &err)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return treeagent.ReadForest(f)
+}
+
+// SaveForest writes a forest to a file.
+//
+// If the path ends in ".json", the forest is encoded as
+// JSON.
+// Otherwise, treeagent's binary format is used.
+//
+// The forest is written to a temporary file which then
+// replaces the destination, so an interrupted save leaves
+// the previous file intact.
+func SaveForest(path string, forest *treeagent.Forest) (err error) {
+	defer essentials.AddCtxTo("save forest", &err)
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(path, ".json") {
+		err = json.NewEncoder(f).Encode(forest)
+	} else {
+		err = treeagent.WriteForest(f, forest)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// ForestLoadPath finds the file to load a forest from.
+//
+// If path does not exist but a JSON file with the same
+// name exists (e.g. "actor.json" for "actor.trf"), the
+// JSON file is returned, so that runs saved before the
+// binary format existed can be resumed.
+// Otherwise, path is returned.
+func ForestLoadPath(path string) string {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return path
+	}
+	legacy := strings.TrimSuffix(path, filepath.Ext(path)) + ".json"
+	if _, err := os.Stat(legacy); err == nil {
+		return legacy
+	}
+	return path
+}
+
+// A CheckpointFile is an append-only log of forest
+// checkpoints stored in a file.
+type CheckpointFile struct {
+	file *os.File
+	log  *treeagent.CheckpointLog
+}
+
+// OpenCheckpointFile opens a checkpoint log, creating it
+// if it does not exist.
+//
+// If the log already contains checkpoints, the forest
+// from the latest checkpoint is returned.
+// Otherwise, latest is nil.
+//
+// If the log ends with an incomplete checkpoint (e.g.
+// because a previous run crashed while writing it), the
+// file is truncated to the last complete checkpoint.
+func OpenCheckpointFile(path string) (c *CheckpointFile, latest *treeagent.Forest,
+	err error) {
+	defer essentials.AddCtxTo("open checkpoint file", &err)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if info.Size() == 0 {
+		log, err := treeagent.NewCheckpointLog(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return &CheckpointFile{file: f, log: log}, nil, nil
+	}
+	latest, count, size, err := replayCheckpointFile(f)
+	if err == nil && size < info.Size() {
+		err = f.Truncate(size)
+	}
+	if err == nil {
+		_, err = f.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if latest == nil {
+		latest = &treeagent.Forest{}
+	}
+	log := treeagent.ResumeCheckpointLog(f, latest, count)
+	if count == 0 {
+		latest = nil
+	}
+	return &CheckpointFile{file: f, log: log}, latest, nil
+}
+
+// Checkpoint appends the state of the forest to the log.
+func (c *CheckpointFile) Checkpoint(f *treeagent.Forest) error {
+	return c.log.Checkpoint(f)
+}
+
+// Close closes the underlying file.
+func (c *CheckpointFile) Close() error {
+	return c.file.Close()
+}
+
+// replayCheckpointFile replays the complete checkpoints
+// in a log file.
+//
+// The size return value is the size of the log up to the
+// end of the last complete checkpoint.
+func replayCheckpointFile(f *os.File) (latest *treeagent.Forest, count int,
+	size int64, err error) {
+	reader, err := treeagent.NewCheckpointReader(f)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	for {
+		forest, err := reader.Next()
+		if err == io.EOF || err == treeagent.ErrIncompleteCheckpoint {
+			return latest, count, reader.Offset(), nil
+		} else if err != nil {
+			return nil, 0, 0, err
+		}
+		latest = forest
+		count++
+	}
+}
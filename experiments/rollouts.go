@@ -1,6 +1,7 @@
 package experiments
 
 import (
+	"math/rand"
 	"sync"
 
 	"github.com/unixpickle/anyrl"
@@ -18,8 +19,33 @@ import (
 // Along with the rollouts, GatherRollouts produces an
 // entropy measure, indicating how much exploration took
 // place.
+//
+// If roller.Rand is set, the result does not depend on
+// goroutine scheduling.
+// In this case, the environments are run in lock-step,
+// each with its own random number generator.
 func GatherRollouts(roller *treeagent.Roller, envs []Env,
 	steps int) (*anyrl.RolloutSet, anyvec.Numeric, error) {
+	var res []*anyrl.RolloutSet
+	var err error
+	if roller.Rand != nil {
+		res, err = gatherSeeded(roller, envs, steps)
+	} else {
+		res, err = gatherUnseeded(roller, envs, steps)
+	}
+	packed := anyrl.PackRolloutSets(roller.Creator(), res)
+
+	reg := &anypg.EntropyReg{
+		Entropyer: roller.ActionSpace.(anyrl.Entropyer),
+		Coeff:     1,
+	}
+	entropy := anypg.AverageReg(packed.AgentOuts, reg)
+
+	return packed, entropy, err
+}
+
+func gatherUnseeded(roller *treeagent.Roller, envs []Env,
+	steps int) ([]*anyrl.RolloutSet, error) {
 	resChan := make(chan *anyrl.RolloutSet, 1)
 	errChan := make(chan error, 1)
 	requests := make(chan struct{}, len(envs))
@@ -65,13 +91,39 @@ func GatherRollouts(roller *treeagent.Roller, envs []Env,
 			}
 		}
 	}
-	packed := anyrl.PackRolloutSets(roller.Creator(), res)
+	return res, <-errChan
+}
 
-	reg := &anypg.EntropyReg{
-		Entropyer: roller.ActionSpace.(anyrl.Entropyer),
-		Coeff:     1,
-	}
-	entropy := anypg.AverageReg(packed.AgentOuts, reg)
+func gatherSeeded(roller *treeagent.Roller, envs []Env,
+	steps int) ([]*anyrl.RolloutSet, error) {
+	var res []*anyrl.RolloutSet
+	var totalSteps int
+	for totalSteps < steps {
+		rollers := make([]treeagent.Roller, len(envs))
+		for i := range rollers {
+			rollers[i] = *roller
+			rollers[i].Rand = rand.New(rand.NewSource(roller.Rand.Int63()))
+		}
+
+		rollouts := make([]*anyrl.RolloutSet, len(envs))
+		errs := make([]error, len(envs))
+		var wg sync.WaitGroup
+		for i, env := range envs {
+			wg.Add(1)
+			go func(i int, env anyrl.Env) {
+				defer wg.Done()
+				rollouts[i], errs[i] = rollers[i].Rollout(env)
+			}(i, env)
+		}
+		wg.Wait()
 
-	return packed, entropy, <-errChan
+		for i, rollout := range rollouts {
+			if errs[i] != nil {
+				return res, errs[i]
+			}
+			res = append(res, rollout)
+			totalSteps += rollout.NumSteps()
+		}
+	}
+	return res, nil
 }
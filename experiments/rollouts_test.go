@@ -0,0 +1,70 @@
+package experiments
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/treeagent"
+)
+
+func TestGatherRolloutsSeeded(t *testing.T) {
+	gather := func(seed int64) (actions, features [][]float64) {
+		roller := &treeagent.Roller{
+			Policy:      treeagent.NewForest(3),
+			ActionSpace: anyrl.Softmax{},
+			Rand:        rand.New(rand.NewSource(seed)),
+		}
+		envs := []Env{&choiceEnv{}, &choiceEnv{}, &choiceEnv{}}
+		rollouts, _, err := GatherRollouts(roller, envs, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples := treeagent.RolloutSamples(rollouts, rollouts.Rewards)
+		for _, sample := range treeagent.AllSamples(samples) {
+			actions = append(actions, sample.Action().Data().([]float64))
+			var feats []float64
+			for i := 0; i < sample.NumFeatures(); i++ {
+				feats = append(feats, sample.Feature(i))
+			}
+			features = append(features, feats)
+		}
+		return
+	}
+	actions1, features1 := gather(1337)
+	actions2, features2 := gather(1337)
+	if !reflect.DeepEqual(actions1, actions2) {
+		t.Error("same seed gave different actions")
+	}
+	if !reflect.DeepEqual(features1, features2) {
+		t.Error("same seed gave different observations")
+	}
+}
+
+// choiceEnv is a deterministic environment whose
+// observations include the previous action.
+type choiceEnv struct {
+	timestep int
+}
+
+func (c *choiceEnv) Reset() ([]float64, error) {
+	c.timestep = 0
+	return []float64{0, -1}, nil
+}
+
+func (c *choiceEnv) Step(action []float64) ([]float64, float64, bool, error) {
+	var choice int
+	for i, x := range action {
+		if x != 0 {
+			choice = i
+		}
+	}
+	c.timestep++
+	obs := []float64{float64(c.timestep), float64(choice)}
+	return obs, float64(choice), c.timestep == 10, nil
+}
+
+func (c *choiceEnv) Close() error {
+	return nil
+}
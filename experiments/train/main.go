@@ -1,14 +1,14 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
-	"io/ioutil"
 	"log"
 	"math"
 	"os"
 	"runtime"
 	"sync"
+	"time"
 
 	"github.com/unixpickle/anyrl/anypg"
 	"github.com/unixpickle/anyvec/anyvec32"
@@ -20,42 +20,86 @@ import (
 type Flags struct {
 	EnvFlags  experiments.EnvFlags
 	Algorithm experiments.AlgorithmFlag
+	Seed      experiments.SeedFlag
 
 	BatchSize    int
 	ParallelEnvs int
 	Depth        int
 	MinLeaf      int
+	Bins         int
+	Random       int
+	Oblique      int
+	Categorical  bool
+	Linear       int
+	LinearL2     float64
+	Leaves       int
+	Oblivious    bool
+	MinGain      float64
+	LeafL2       float64
+	PruneFrac    float64
+	BuildTime    time.Duration
+	GOSSTop      float64
+	GOSSOther    float64
 	StepSize     float64
 	Discount     float64
 	EntropyReg   float64
 	SignOnly     bool
 	SaveFile     string
+	Checkpoint   bool
 }
 
 func main() {
 	flags := &Flags{}
 	flags.EnvFlags.AddFlags()
 	flags.Algorithm.AddFlag()
+	flags.Seed.AddFlag()
 	flag.IntVar(&flags.BatchSize, "batch", 2048, "steps per batch")
 	flag.IntVar(&flags.ParallelEnvs, "numparallel", runtime.GOMAXPROCS(0),
 		"parallel environments")
 	flag.IntVar(&flags.Depth, "depth", 3, "tree depth")
 	flag.IntVar(&flags.MinLeaf, "minleaf", 1, "minimum samples per leaf")
+	flag.Float64Var(&flags.MinGain, "mingain", 0, "minimum split gain")
+	flag.Float64Var(&flags.LeafL2, "leafl2", 0, "L2 shrinkage for leaf values")
+	flag.Float64Var(&flags.PruneFrac, "prunefrac", 0, "fraction of samples held out for pruning")
+	flag.DurationVar(&flags.BuildTime, "buildtime", 0, "time limit per tree (0 for no limit)")
+	flag.Float64Var(&flags.GOSSTop, "gosstop", 0,
+		"fraction of large-gradient samples kept by GOSS")
+	flag.Float64Var(&flags.GOSSOther, "gossother", 0,
+		"fraction of samples randomly kept by GOSS (GOSS is off if both are 0)")
+	flag.IntVar(&flags.Leaves, "leaves", 0, "max leaves for best-first growth (0 for depth-first)")
+	flag.BoolVar(&flags.Oblivious, "oblivious", false,
+		"use oblivious trees, which share one split per depth")
+	flag.IntVar(&flags.Bins, "bins", 0, "histogram bins per feature (0 for exact splits)")
+	flag.IntVar(&flags.Random, "random", 0,
+		"random thresholds per feature (0 for exact splits)")
+	flag.IntVar(&flags.Oblique, "oblique", 0, "max features per oblique split (0 for axis splits)")
+	flag.BoolVar(&flags.Categorical, "categorical", false,
+		"split categorical features (e.g. RAM bytes) by category")
+	flag.IntVar(&flags.Linear, "linear", 0, "max features per linear leaf (0 for constant leaves)")
+	flag.Float64Var(&flags.LinearL2, "linearl2", 1, "L2 penalty on linear leaf slopes")
 	flag.Float64Var(&flags.StepSize, "step", 0.8, "step size")
 	flag.Float64Var(&flags.Discount, "discount", 0, "discount factor (0 is no discount)")
 	flag.Float64Var(&flags.EntropyReg, "reg", 0.01, "entropy regularization coefficient")
 	flag.BoolVar(&flags.SignOnly, "sign", false, "only use sign from trees")
-	flag.StringVar(&flags.SaveFile, "out", "policy.json", "file for saved policy")
+	flag.StringVar(&flags.SaveFile, "out", "policy.trf", "file for saved policy")
+	flag.BoolVar(&flags.Checkpoint, "checkpoint", false,
+		"save the policy as an append-only checkpoint log")
 	flag.Parse()
 	log.Println("Run with arguments:", os.Args[1:])
 
 	creator := anyvec32.CurrentCreator()
+	gen := flags.Seed.Rand()
 
 	log.Println("Creating environments...")
 	envs, err := experiments.MakeEnvs(&flags.EnvFlags, flags.ParallelEnvs)
 	must(err)
 	info, _ := experiments.LookupEnvInfo(flags.EnvFlags.Name)
 
+	var categorical []int
+	if flags.Categorical {
+		categorical = experiments.EnvCategorical(info, &flags.EnvFlags)
+	}
+
 	var judger anypg.ActionJudger
 	if flags.Discount != 0 {
 		judger = &anypg.QJudger{Discount: flags.Discount, Normalize: true}
@@ -63,13 +107,33 @@ func main() {
 		judger = &anypg.TotalJudger{Normalize: true}
 	}
 
-	roller := experiments.EnvRoller(creator, info, loadOrCreatePolicy(flags))
+	policy, savePolicy := loadOrCreatePolicy(flags)
+	roller := experiments.EnvRoller(creator, info, policy)
+	if treeagent.CanSampleRand(info.ActionSpace) {
+		roller.Rand = gen
+	} else if gen != nil {
+		log.Println("Action space does not support seeded sampling, so rollouts " +
+			"will not be reproducible.")
+	}
 
 	pg := &treeagent.PG{
 		Builder: treeagent.Builder{
-			MaxDepth:  flags.Depth,
-			Algorithm: flags.Algorithm.Algorithm,
-			MinLeaf:   flags.MinLeaf,
+			MaxDepth:            flags.Depth,
+			Algorithm:           flags.Algorithm.Algorithm,
+			MinLeaf:             flags.MinLeaf,
+			HistogramBins:       flags.Bins,
+			RandomThresholds:    flags.Random,
+			ObliqueFeatures:     flags.Oblique,
+			CategoricalFeatures: categorical,
+			LinearFeatures:      flags.Linear,
+			LinearL2:            flags.LinearL2,
+			MaxLeaves:           flags.Leaves,
+			Oblivious:           flags.Oblivious,
+			MinGain:             flags.MinGain,
+			LeafL2:              flags.LeafL2,
+			PruneFrac:           flags.PruneFrac,
+			TimeLimit:           flags.BuildTime,
+			Rand:                gen,
 		},
 		ActionSpace: info.ActionSpace,
 		Regularizer: &anypg.EntropyReg{
@@ -77,9 +141,17 @@ func main() {
 			Coeff:     flags.EntropyReg,
 		},
 	}
+	if flags.GOSSTop != 0 || flags.GOSSOther != 0 {
+		pg.GOSS = &treeagent.GOSS{
+			TopFrac:   flags.GOSSTop,
+			OtherFrac: flags.GOSSOther,
+			Rand:      gen,
+		}
+	}
 
 	// Train on a background goroutine so that we can
 	// listen for Ctrl+C on the main goroutine.
+	ctx, cancel := context.WithCancel(context.Background())
 	var trainLock sync.Mutex
 	go func() {
 		for batchIdx := 0; true; batchIdx++ {
@@ -101,39 +173,57 @@ func main() {
 			advantages := judger.JudgeActions(rollouts)
 			sampleChan := treeagent.RolloutSamples(rollouts, advantages)
 			sampleChan = experiments.EnvSamples(info, sampleChan)
-			tree, _, _ := pg.Build(treeagent.AllSamples(sampleChan))
+			tree, _, _, err := pg.BuildContext(ctx, treeagent.AllSamples(sampleChan))
+			if err != nil {
+				// Interrupted, so the partial tree is discarded.
+				return
+			}
 			if flags.SignOnly {
 				tree = treeagent.SignTree(tree)
 			}
 			roller.Policy.Add(tree, flags.StepSize)
 
 			trainLock.Lock()
-			data, err := json.Marshal(roller.Policy)
-			must(err)
-			must(ioutil.WriteFile(flags.SaveFile, data, 0755))
+			must(savePolicy(roller.Policy))
 			trainLock.Unlock()
 		}
 	}()
 
 	log.Println("Running. Press Ctrl+C to stop.")
 	<-rip.NewRIP().Chan()
+	cancel()
 
 	// Avoid the race condition where we save during
 	// exit.
 	trainLock.Lock()
 }
 
-func loadOrCreatePolicy(flags *Flags) *treeagent.Forest {
-	data, err := ioutil.ReadFile(flags.SaveFile)
-	if err != nil {
+func loadOrCreatePolicy(flags *Flags) (*treeagent.Forest,
+	func(f *treeagent.Forest) error) {
+	info, _ := experiments.LookupEnvInfo(flags.EnvFlags.Name)
+	if flags.Checkpoint {
+		file, res, err := experiments.OpenCheckpointFile(flags.SaveFile)
+		must(err)
+		if res == nil {
+			log.Println("Created new policy.")
+			res = treeagent.NewForest(info.ParamSize)
+		} else {
+			log.Println("Loaded policy from file.")
+		}
+		return res, file.Checkpoint
+	}
+	saver := func(f *treeagent.Forest) error {
+		return experiments.SaveForest(flags.SaveFile, f)
+	}
+	loadPath := experiments.ForestLoadPath(flags.SaveFile)
+	if _, err := os.Stat(loadPath); os.IsNotExist(err) {
 		log.Println("Created new policy.")
-		info, _ := experiments.LookupEnvInfo(flags.EnvFlags.Name)
-		return treeagent.NewForest(info.ParamSize)
+		return treeagent.NewForest(info.ParamSize), saver
 	}
-	var res *treeagent.Forest
-	must(json.Unmarshal(data, &res))
-	log.Println("Loaded policy from file.")
-	return res
+	res, err := experiments.LoadForest(loadPath)
+	must(err)
+	log.Println("Loaded policy from:", loadPath)
+	return res, saver
 }
 
 func must(err error) {
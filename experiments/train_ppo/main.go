@@ -1,15 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
-	"io/ioutil"
 	"log"
 	"math"
 	"math/rand"
 	"os"
 	"runtime"
 	"sync"
+	"time"
 
 	"github.com/unixpickle/anyrl/anypg"
 	"github.com/unixpickle/anyvec"
@@ -23,6 +23,7 @@ import (
 type Flags struct {
 	EnvFlags  experiments.EnvFlags
 	Algorithm experiments.AlgorithmFlag
+	Seed      experiments.SeedFlag
 
 	BatchSize    int
 	ParallelEnvs int
@@ -40,7 +41,22 @@ type Flags struct {
 	Discount     float64
 	Lambda       float64
 	FeatureFrac  float64
+	Bins         int
+	Random       int
+	Oblique      int
+	Categorical  bool
+	Linear       int
+	LinearL2     float64
+	Leaves       int
+	Oblivious    bool
+	NewtonValue  bool
+	MinGain      float64
+	LeafL2       float64
+	PruneFrac    float64
+	BuildTime    time.Duration
 	Minibatch    float64
+	GOSSTop      float64
+	GOSSOther    float64
 	EntropyReg   float64
 	Epsilon      float64
 	SignOnly     bool
@@ -51,12 +67,14 @@ type Flags struct {
 
 	ActorFile  string
 	CriticFile string
+	Checkpoint bool
 }
 
 func main() {
 	flags := &Flags{}
 	flags.EnvFlags.AddFlags()
 	flags.Algorithm.AddFlag()
+	flags.Seed.AddFlag()
 	flag.IntVar(&flags.BatchSize, "batch", 2048, "steps per rollout")
 	flag.IntVar(&flags.ParallelEnvs, "numparallel", runtime.GOMAXPROCS(0),
 		"parallel environments")
@@ -74,7 +92,27 @@ func main() {
 	flag.Float64Var(&flags.Discount, "discount", 0.8, "discount factor")
 	flag.Float64Var(&flags.Lambda, "lambda", 0.95, "GAE coefficient")
 	flag.Float64Var(&flags.FeatureFrac, "featurefrac", 1, "fraction of features to use")
+	flag.Float64Var(&flags.MinGain, "mingain", 0, "minimum split gain")
+	flag.Float64Var(&flags.LeafL2, "leafl2", 0, "L2 shrinkage for leaf values")
+	flag.BoolVar(&flags.NewtonValue, "newtonvalue", false, "use Newton boosting for the value function")
+	flag.Float64Var(&flags.PruneFrac, "prunefrac", 0, "fraction of samples held out for pruning")
+	flag.DurationVar(&flags.BuildTime, "buildtime", 0, "time limit per policy tree (0 for no limit)")
+	flag.IntVar(&flags.Leaves, "leaves", 0, "max leaves for best-first growth (0 for depth-first)")
+	flag.BoolVar(&flags.Oblivious, "oblivious", false,
+		"use oblivious trees, which share one split per depth")
+	flag.IntVar(&flags.Bins, "bins", 0, "histogram bins per feature (0 for exact splits)")
+	flag.IntVar(&flags.Random, "random", 0,
+		"random thresholds per feature (0 for exact splits)")
+	flag.IntVar(&flags.Oblique, "oblique", 0, "max features per oblique split (0 for axis splits)")
+	flag.BoolVar(&flags.Categorical, "categorical", false,
+		"split categorical features (e.g. RAM bytes) by category")
+	flag.IntVar(&flags.Linear, "linear", 0, "max features per linear leaf (0 for constant leaves)")
+	flag.Float64Var(&flags.LinearL2, "linearl2", 1, "L2 penalty on linear leaf slopes")
 	flag.Float64Var(&flags.Minibatch, "minibatch", 1, "mini-batch fraction for each tree")
+	flag.Float64Var(&flags.GOSSTop, "gosstop", 0,
+		"fraction of large-gradient samples kept by GOSS")
+	flag.Float64Var(&flags.GOSSOther, "gossother", 0,
+		"fraction of samples randomly kept by GOSS (replaces -minibatch unless both are 0)")
 	flag.Float64Var(&flags.EntropyReg, "reg", 0.01, "entropy regularization coefficient")
 	flag.Float64Var(&flags.Epsilon, "epsilon", 0.1, "PPO epsilon")
 	flag.BoolVar(&flags.SignOnly, "sign", false, "only use sign from trees")
@@ -82,40 +120,81 @@ func main() {
 	flag.IntVar(&flags.ValIters, "valiters", 4, "value training iterations per batch")
 	flag.IntVar(&flags.TuneIters, "tuneiters", 0, "tuning iterations per batch")
 	flag.BoolVar(&flags.CoordDesc, "coorddesc", false, "tune one action parameter at a time")
-	flag.StringVar(&flags.ActorFile, "actor", "actor.json", "file for saved policy")
-	flag.StringVar(&flags.CriticFile, "critic", "critic.json", "file for saved value function")
+	flag.StringVar(&flags.ActorFile, "actor", "actor.trf", "file for saved policy")
+	flag.StringVar(&flags.CriticFile, "critic", "critic.trf",
+		"file for saved value function")
+	flag.BoolVar(&flags.Checkpoint, "checkpoint", false,
+		"save forests as append-only checkpoint logs")
 	flag.Parse()
 
 	log.Println("Run with arguments:", os.Args[1:])
 
 	creator := anyvec32.CurrentCreator()
+	gen := flags.Seed.Rand()
 
 	log.Println("Creating environments...")
 	envs, err := experiments.MakeEnvs(&flags.EnvFlags, flags.ParallelEnvs)
 	must(err)
 	info, _ := experiments.LookupEnvInfo(flags.EnvFlags.Name)
 
-	policy, valueFunc := loadOrCreateForests(flags)
+	var categorical []int
+	if flags.Categorical {
+		categorical = experiments.EnvCategorical(info, &flags.EnvFlags)
+	}
+
+	policy, valueFunc, saveActor, saveCritic := loadOrCreateForests(flags)
 	roller := experiments.EnvRoller(creator, info, policy)
+	if treeagent.CanSampleRand(info.ActionSpace) {
+		roller.Rand = gen
+	} else if gen != nil {
+		log.Println("Action space does not support seeded sampling, so rollouts " +
+			"will not be reproducible.")
+	}
 
 	judger := &treeagent.Judger{
-		ValueFunc:   valueFunc,
-		Discount:    flags.Discount,
-		Lambda:      flags.Lambda,
-		MaxDepth:    flags.Depth,
-		FeatureFrac: flags.FeatureFrac,
-		MinLeaf:     flags.MinLeaf,
-		MinLeafFrac: flags.MinLeafFrac,
+		ValueFunc:           valueFunc,
+		Discount:            flags.Discount,
+		Lambda:              flags.Lambda,
+		MaxDepth:            flags.Depth,
+		FeatureFrac:         flags.FeatureFrac,
+		MinLeaf:             flags.MinLeaf,
+		MinLeafFrac:         flags.MinLeafFrac,
+		HistogramBins:       flags.Bins,
+		RandomThresholds:    flags.Random,
+		ObliqueFeatures:     flags.Oblique,
+		CategoricalFeatures: categorical,
+		LinearFeatures:      flags.Linear,
+		LinearL2:            flags.LinearL2,
+		Newton:              flags.NewtonValue,
+		MaxLeaves:           flags.Leaves,
+		Oblivious:           flags.Oblivious,
+		MinGain:             flags.MinGain,
+		LeafL2:              flags.LeafL2,
+		PruneFrac:           flags.PruneFrac,
+		Rand:                gen,
 	}
 
 	ppo := &treeagent.PPO{
 		PG: treeagent.PG{
 			Builder: treeagent.Builder{
-				MaxDepth:    flags.Depth,
-				Algorithm:   flags.Algorithm.Algorithm,
-				FeatureFrac: flags.FeatureFrac,
-				MinLeaf:     flags.MinLeaf,
-				MinLeafFrac: flags.MinLeafFrac,
+				MaxDepth:            flags.Depth,
+				Algorithm:           flags.Algorithm.Algorithm,
+				FeatureFrac:         flags.FeatureFrac,
+				MinLeaf:             flags.MinLeaf,
+				MinLeafFrac:         flags.MinLeafFrac,
+				HistogramBins:       flags.Bins,
+				RandomThresholds:    flags.Random,
+				ObliqueFeatures:     flags.Oblique,
+				CategoricalFeatures: categorical,
+				LinearFeatures:      flags.Linear,
+				LinearL2:            flags.LinearL2,
+				MaxLeaves:           flags.Leaves,
+				Oblivious:           flags.Oblivious,
+				MinGain:             flags.MinGain,
+				LeafL2:              flags.LeafL2,
+				PruneFrac:           flags.PruneFrac,
+				TimeLimit:           flags.BuildTime,
+				Rand:                gen,
 			},
 			ActionSpace: info.ActionSpace,
 			Regularizer: &anypg.EntropyReg{
@@ -125,7 +204,15 @@ func main() {
 		},
 		Epsilon: flags.Epsilon,
 	}
+	if flags.GOSSTop != 0 || flags.GOSSOther != 0 {
+		ppo.PG.GOSS = &treeagent.GOSS{
+			TopFrac:   flags.GOSSTop,
+			OtherFrac: flags.GOSSOther,
+			Rand:      gen,
+		}
+	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	var trainLock sync.Mutex
 	go func() {
 		for batchIdx := 0; true; batchIdx++ {
@@ -149,10 +236,11 @@ func main() {
 			sampleChan := treeagent.RolloutSamples(rollouts, advantages)
 			sampleChan = experiments.EnvSamples(info, sampleChan)
 			samples := treeagent.AllSamples(sampleChan)
+			ppo.Cache = treeagent.NewSampleCache(samples)
 			for i := 0; i < flags.TuneIters; i++ {
-				minibatch := treeagent.Minibatch(samples, flags.Minibatch)
+				minibatch := treeagent.MinibatchRand(gen, samples, flags.Minibatch)
 				if flags.CoordDesc {
-					ppo.PG.Builder.ParamWhitelist = []int{rand.Intn(info.ParamSize)}
+					ppo.PG.Builder.ParamWhitelist = []int{randIntn(gen, info.ParamSize)}
 				}
 				grad, obj, reg := ppo.WeightGradient(minibatch, policy)
 
@@ -165,11 +253,18 @@ func main() {
 					obj, reg, numPruned)
 			}
 			for i := 0; i < flags.Iters; i++ {
-				minibatch := treeagent.Minibatch(samples, flags.Minibatch)
+				minibatch := samples
+				if ppo.PG.GOSS == nil {
+					minibatch = treeagent.MinibatchRand(gen, samples, flags.Minibatch)
+				}
 				if flags.CoordDesc {
-					ppo.PG.Builder.ParamWhitelist = []int{rand.Intn(info.ParamSize)}
+					ppo.PG.Builder.ParamWhitelist = []int{randIntn(gen, info.ParamSize)}
+				}
+				tree, obj, reg, err := ppo.BuildContext(ctx, minibatch, policy)
+				if err != nil {
+					// Interrupted, so the partial tree is discarded.
+					return
 				}
-				tree, obj, reg := ppo.Build(minibatch, policy)
 				log.Printf("step %d: objective=%f reg=%f", i, obj, reg)
 				if flags.SignOnly {
 					tree = treeagent.SignTree(tree)
@@ -178,7 +273,7 @@ func main() {
 			}
 
 			if flags.AdaptiveDown != 1 || flags.AdaptiveUp != 1 {
-				if treeagent.Improved(samples, policy, ppo.Objective) {
+				if ppo.Improved(samples, policy) {
 					if flags.AdaptiveUp != 1 {
 						flags.StepSize *= flags.AdaptiveUp
 						log.Println("increased step to", flags.StepSize)
@@ -191,14 +286,20 @@ func main() {
 				}
 			}
 
+			ppo.Cache = nil
+
 			log.Println("Training value function...")
 			sampleChan = judger.TrainingSamples(rollouts)
 			sampleChan = experiments.EnvSamples(info, sampleChan)
 			samples = treeagent.AllSamples(sampleChan)
 			for i := 0; i < flags.ValIters; i++ {
 				decayForest(flags, valueFunc)
-				minibatch := treeagent.Minibatch(samples, flags.Minibatch)
-				tree, loss := judger.Train(minibatch)
+				minibatch := treeagent.MinibatchRand(gen, samples, flags.Minibatch)
+				tree, loss, err := judger.TrainContext(ctx, minibatch)
+				if err != nil {
+					// Interrupted, so the partial tree is discarded.
+					return
+				}
 				step := judger.OptimalWeight(samples, tree) * flags.ValStep
 				valueFunc.Add(tree, step)
 				log.Printf("step %d: mse=%f step=%f", i, loss, step)
@@ -207,13 +308,8 @@ func main() {
 			log.Println("Saving...")
 			trainLock.Lock()
 
-			data, err := json.Marshal(policy)
-			must(err)
-			must(ioutil.WriteFile(flags.ActorFile, data, 0755))
-
-			data, err = json.Marshal(valueFunc)
-			must(err)
-			must(ioutil.WriteFile(flags.CriticFile, data, 0755))
+			must(saveActor(policy))
+			must(saveCritic(valueFunc))
 
 			trainLock.Unlock()
 		}
@@ -221,27 +317,47 @@ func main() {
 
 	log.Println("Running. Press Ctrl+C to stop.")
 	<-rip.NewRIP().Chan()
+	cancel()
 
 	trainLock.Lock()
 }
 
-func loadOrCreateForests(flags *Flags) (actor, critic *treeagent.Forest) {
+// A forestSaver saves the current state of a forest.
+type forestSaver func(f *treeagent.Forest) error
+
+func loadOrCreateForests(flags *Flags) (actor, critic *treeagent.Forest,
+	saveActor, saveCritic forestSaver) {
 	info, _ := experiments.LookupEnvInfo(flags.EnvFlags.Name)
-	actor = loadOrCreateForest(flags, flags.ActorFile, info.ParamSize)
-	critic = loadOrCreateForest(flags, flags.CriticFile, 1)
+	actor, saveActor = loadOrCreateForest(flags, flags.ActorFile, info.ParamSize)
+	critic, saveCritic = loadOrCreateForest(flags, flags.CriticFile, 1)
 	return
 }
 
-func loadOrCreateForest(flags *Flags, path string, dims int) *treeagent.Forest {
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
+func loadOrCreateForest(flags *Flags, path string, dims int) (*treeagent.Forest,
+	forestSaver) {
+	if flags.Checkpoint {
+		file, res, err := experiments.OpenCheckpointFile(path)
+		must(err)
+		if res == nil {
+			log.Println("Creating new forest for:", path)
+			res = treeagent.NewForest(dims)
+		} else {
+			log.Println("Loaded forest from:", path)
+		}
+		return res, file.Checkpoint
+	}
+	saver := func(f *treeagent.Forest) error {
+		return experiments.SaveForest(path, f)
+	}
+	loadPath := experiments.ForestLoadPath(path)
+	if _, err := os.Stat(loadPath); os.IsNotExist(err) {
 		log.Println("Creating new forest for:", path)
-		return treeagent.NewForest(dims)
+		return treeagent.NewForest(dims), saver
 	}
-	var res *treeagent.Forest
-	must(json.Unmarshal(data, &res))
-	log.Println("Loaded forest from:", path)
-	return res
+	res, err := experiments.LoadForest(loadPath)
+	must(err)
+	log.Println("Loaded forest from:", loadPath)
+	return res, saver
 }
 
 func decayForest(flags *Flags, forest *treeagent.Forest) {
@@ -258,3 +374,12 @@ func must(err error) {
 		panic(err)
 	}
 }
+
+// randIntn is like rand.Intn, but it uses gen if it is
+// non-nil.
+func randIntn(gen *rand.Rand, n int) int {
+	if gen == nil {
+		return rand.Intn(n)
+	}
+	return gen.Intn(n)
+}
@@ -1,7 +1,8 @@
 package treeagent
 
 import (
-	"runtime"
+	"math"
+	"sort"
 	"sync"
 
 	"github.com/unixpickle/anyvec"
@@ -22,6 +23,9 @@ type Forest struct {
 	Base    ActionParams
 	Trees   []*Tree
 	Weights []float64
+
+	cacheLock sync.Mutex
+	cache     *compileCache
 }
 
 // NewForest creates an empty forest with a set of zero
@@ -97,40 +101,60 @@ func (f *Forest) ApplyFeatureSource(list FeatureSource) ActionParams {
 }
 
 func (f *Forest) applyBatch(in anyvec.Vector, batch int) anyvec.Vector {
-	features := vecToFloats(in)
-	numFeatures := len(features) / batch
+	return f.compiled().applyVec(in, batch)
+}
+
+func (f *Forest) applySamples(samples []Sample) []ActionParams {
+	return f.compiled().ApplySamples(samples)
+}
 
-	var outParams []float64
-	for i := 0; i < batch; i++ {
-		subFeatures := features[i*numFeatures : (i+1)*numFeatures]
-		params := f.Apply(subFeatures)
-		outParams = append(outParams, params...)
+// compiled returns a CompiledForest for f, reusing the
+// previous result if f has not changed since then.
+//
+// This makes it cheap to apply the forest to many small
+// batches, as the Roller does.
+func (f *Forest) compiled() *CompiledForest {
+	f.cacheLock.Lock()
+	defer f.cacheLock.Unlock()
+	if f.cache == nil || !f.cache.UpToDate(f) {
+		f.cache = &compileCache{
+			Base:     append(ActionParams{}, f.Base...),
+			Trees:    append([]*Tree{}, f.Trees...),
+			Weights:  append([]float64{}, f.Weights...),
+			Compiled: f.Compile(),
+		}
 	}
+	return f.cache.Compiled
+}
 
-	c := in.Creator()
-	vecData := c.MakeNumericList(outParams)
-	return c.MakeVectorData(vecData)
+// compileCache stores a CompiledForest along with the
+// Forest state that it was compiled from.
+type compileCache struct {
+	Base     ActionParams
+	Trees    []*Tree
+	Weights  []float64
+	Compiled *CompiledForest
 }
 
-func (f *Forest) applySamples(samples []Sample) []ActionParams {
-	res := make([]ActionParams, len(samples))
-	indices := make(chan int, len(samples))
-	for i := range samples {
-		indices <- i
-	}
-	close(indices)
-	var wg sync.WaitGroup
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for i := range indices {
-				res[i] = f.ApplyFeatureSource(samples[i])
-			}
-		}()
+// UpToDate checks if the cache matches the forest.
+//
+// Trees are compared by pointer, so modifying a Tree in
+// place will not invalidate the cache.
+func (c *compileCache) UpToDate(f *Forest) bool {
+	if len(c.Trees) != len(f.Trees) || len(c.Base) != len(f.Base) {
+		return false
 	}
-	wg.Wait()
-	return res
+	for i, x := range c.Base {
+		if f.Base[i] != x {
+			return false
+		}
+	}
+	for i, t := range c.Trees {
+		if f.Trees[i] != t || f.Weights[i] != c.Weights[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // Tree is a node in a decision tree.
@@ -142,11 +166,44 @@ type Tree struct {
 	// Information for leaf nodes.
 	Params ActionParams `json:",omitempty"`
 
+	// Information for linear leaf nodes.
+	//
+	// If LinearFeatures is non-empty, the parameters of
+	// the leaf are an affine function of the features.
+	// Each feature LinearFeatures[i] adds LinearWeights[i]
+	// times the feature's difference from LinearCenters[i]
+	// to Params.
+	// Missing (NaN) features add nothing.
+	LinearFeatures []int          `json:",omitempty"`
+	LinearCenters  []float64      `json:",omitempty"`
+	LinearWeights  []ActionParams `json:",omitempty"`
+
 	// Information for branching nodes.
 	Feature      int     `json:",omitempty"`
 	Threshold    float64 `json:",omitempty"`
 	LessThan     *Tree   `json:",omitempty"`
 	GreaterEqual *Tree   `json:",omitempty"`
+
+	// MissingLeft indicates that features with missing
+	// (NaN) values belong in LessThan rather than in
+	// GreaterEqual.
+	MissingLeft bool `json:",omitempty"`
+
+	// Information for oblique branching nodes.
+	//
+	// If ObliqueFeatures is non-empty, the node compares
+	// the weighted sum of these features (weighted by
+	// ObliqueWeights) to Threshold, and Feature is unused.
+	ObliqueFeatures []int     `json:",omitempty"`
+	ObliqueWeights  []float64 `json:",omitempty"`
+
+	// Information for categorical branching nodes.
+	//
+	// If Categories is non-empty, the node sends features
+	// whose Feature is one of the Categories to LessThan
+	// and all other features to GreaterEqual.
+	// Categories is sorted and Threshold is unused.
+	Categories []float64 `json:",omitempty"`
 }
 
 // Find finds the leaf parameters for the features.
@@ -157,15 +214,88 @@ func (t *Tree) Find(features []float64) ActionParams {
 // FindFeatureSource is like Find, but for a
 // FeatureSource.
 func (t *Tree) FindFeatureSource(list FeatureSource) ActionParams {
-	if t.Leaf {
+	return t.findLeaf(list).leafParams(list)
+}
+
+// findLeaf finds the leaf node for the features.
+func (t *Tree) findLeaf(list FeatureSource) *Tree {
+	for !t.Leaf {
+		t = t.Branch(list)
+	}
+	return t
+}
+
+// leafParams computes the parameters of a leaf node for
+// the features.
+//
+// For constant leaves, the result is t.Params itself.
+func (t *Tree) leafParams(list FeatureSource) ActionParams {
+	if len(t.LinearFeatures) == 0 {
 		return t.Params
 	}
-	val := list.Feature(t.Feature)
-	if val < t.Threshold {
-		return t.LessThan.FindFeatureSource(list)
-	} else {
-		return t.GreaterEqual.FindFeatureSource(list)
+	res := append(ActionParams{}, t.Params...)
+	t.addLinearTerms(list, res)
+	return res
+}
+
+// addLinearTerms adds the feature-dependent part of a
+// linear leaf's parameters to params.
+func (t *Tree) addLinearTerms(list FeatureSource, params []float64) {
+	for i, feature := range t.LinearFeatures {
+		diff := list.Feature(feature) - t.LinearCenters[i]
+		if math.IsNaN(diff) {
+			continue
+		}
+		for j, w := range t.LinearWeights[i] {
+			params[j] += w * diff
+		}
+	}
+}
+
+// Branch returns the child of a branching node which the
+// features belong in.
+func (t *Tree) Branch(list FeatureSource) *Tree {
+	if t.goesLeft(list) {
+		return t.LessThan
 	}
+	return t.GreaterEqual
+}
+
+// goesLeft checks if the features belong in the LessThan
+// branch of a branching node.
+func (t *Tree) goesLeft(list FeatureSource) bool {
+	value := t.splitValue(list)
+	if math.IsNaN(value) {
+		return t.MissingLeft
+	}
+	if len(t.Categories) > 0 {
+		idx := sort.SearchFloat64s(t.Categories, value)
+		return idx < len(t.Categories) && t.Categories[idx] == value
+	}
+	return value < t.Threshold
+}
+
+// splitValue computes the value which a branching node
+// compares to its threshold or categories.
+// The result is NaN if the value is missing.
+func (t *Tree) splitValue(list FeatureSource) float64 {
+	if len(t.ObliqueFeatures) == 0 {
+		return list.Feature(t.Feature)
+	}
+	var sum float64
+	for i, feature := range t.ObliqueFeatures {
+		sum += t.ObliqueWeights[i] * list.Feature(feature)
+	}
+	return sum
+}
+
+// branchCopy copies a branching node, replacing its
+// children.
+func (t *Tree) branchCopy(lessThan, greaterEqual *Tree) *Tree {
+	res := *t
+	res.LessThan = lessThan
+	res.GreaterEqual = greaterEqual
+	return &res
 }
 
 func (t *Tree) scaleParams(scale float64) {
@@ -173,6 +303,11 @@ func (t *Tree) scaleParams(scale float64) {
 		for i, x := range t.Params {
 			t.Params[i] = x * scale
 		}
+		for _, weights := range t.LinearWeights {
+			for i, x := range weights {
+				weights[i] = x * scale
+			}
+		}
 	} else {
 		t.LessThan.scaleParams(scale)
 		t.GreaterEqual.scaleParams(scale)
@@ -188,3 +323,64 @@ func (s sliceFeatureSource) NumFeatures() int {
 func (s sliceFeatureSource) Feature(i int) float64 {
 	return s[i]
 }
+
+// removedTrees compares a forest to a previous list of
+// its trees to find which trees were removed.
+//
+// It returns the indices (in oldTrees) of the removed
+// trees and of the kept trees, in order.
+// The kept trees must form a prefix of f.Trees, and any
+// other trees in f must be new.
+// If this is not the case, removed is nil.
+func removedTrees(oldTrees []*Tree, f *Forest) (removed, kept []int) {
+	removed = []int{}
+	for i, t := range oldTrees {
+		if len(kept) < len(f.Trees) && f.Trees[len(kept)] == t {
+			kept = append(kept, i)
+		} else {
+			removed = append(removed, i)
+		}
+	}
+	if len(kept) < len(f.Trees) {
+		old := map[*Tree]bool{}
+		for _, t := range oldTrees {
+			old[t] = true
+		}
+		for _, t := range f.Trees[len(kept):] {
+			if old[t] {
+				return nil, nil
+			}
+		}
+	}
+	return
+}
+
+// exactScale finds a scale s such that newVals[i] is
+// exactly oldVals[i]*s for every i.
+func exactScale(oldVals, newVals []float64) (float64, bool) {
+	scale := 1.0
+	for i, x := range oldVals {
+		if x != 0 {
+			scale = newVals[i] / x
+			break
+		}
+	}
+	for i, x := range oldVals {
+		if x*scale != newVals[i] {
+			return 0, false
+		}
+	}
+	return scale, true
+}
+
+func floatsEqual(v1, v2 []float64) bool {
+	if len(v1) != len(v2) {
+		return false
+	}
+	for i, x := range v1 {
+		if v2[i] != x {
+			return false
+		}
+	}
+	return true
+}
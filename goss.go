@@ -0,0 +1,104 @@
+package treeagent
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// GOSS implements gradient-based one-side sampling, an
+// alternative to uniform minibatches.
+//
+// The samples with the largest gradients are always
+// kept, and the remaining samples are subsampled
+// uniformly.
+// The weights and gradients of the subsampled samples are
+// scaled up so that the total gradient is unbiased.
+//
+// GOSS comes from the LightGBM paper (Ke et al., 2017).
+type GOSS struct {
+	// TopFrac is the fraction of the samples which are
+	// kept because they have the largest gradients.
+	TopFrac float64
+
+	// OtherFrac is the fraction of the samples which are
+	// selected at random from the rest.
+	OtherFrac float64
+
+	// Rand is the source of randomness for subsampling.
+	//
+	// If nil, the global source from math/rand is used.
+	Rand *rand.Rand
+}
+
+// Select selects a subset of the samples, modifying the
+// weights and gradients of the subsampled samples.
+//
+// Samples with a weight of 0 are never selected.
+// Gradient magnitudes are measured by the Euclidean norm,
+// so they include the samples' weights.
+//
+// If g is nil, all of the samples are selected.
+func (g *GOSS) Select(samples []*GradientSample) []*GradientSample {
+	if g == nil {
+		return samples
+	}
+	if g.TopFrac < 0 || g.TopFrac > 1 || g.OtherFrac < 0 || g.OtherFrac > 1 ||
+		g.TopFrac+g.OtherFrac == 0 {
+		panic("GOSS fractions out of range")
+	}
+
+	var nonzero []*GradientSample
+	for _, sample := range samples {
+		if sample.Weight() != 0 {
+			nonzero = append(nonzero, sample)
+		}
+	}
+	squaredNorms := make([]float64, len(nonzero))
+	for i, sample := range nonzero {
+		squaredNorms[i] = sample.Gradient.Dot(sample.Gradient)
+	}
+	sort.Stable(&gossSorter{samples: nonzero, squaredNorms: squaredNorms})
+
+	numTop := int(math.Ceil(float64(len(nonzero)) * g.TopFrac))
+	rest := nonzero[numTop:]
+	numOther := int(math.Ceil(float64(len(nonzero)) * g.OtherFrac))
+	if numOther > len(rest) {
+		numOther = len(rest)
+	}
+
+	res := append([]*GradientSample{}, nonzero[:numTop]...)
+	if numOther == 0 {
+		return res
+	}
+	scale := float64(len(rest)) / float64(numOther)
+	for _, j := range randPerm(g.Rand, len(rest))[:numOther] {
+		sample := rest[j]
+		sample.weightScale = scale
+		sample.Gradient.Scale(scale)
+		if sample.Curvature != nil {
+			sample.Curvature.Scale(scale)
+		}
+		res = append(res, sample)
+	}
+	return res
+}
+
+// gossSorter sorts samples by decreasing gradient norm.
+type gossSorter struct {
+	samples      []*GradientSample
+	squaredNorms []float64
+}
+
+func (g *gossSorter) Len() int {
+	return len(g.samples)
+}
+
+func (g *gossSorter) Less(i, j int) bool {
+	return g.squaredNorms[i] > g.squaredNorms[j]
+}
+
+func (g *gossSorter) Swap(i, j int) {
+	g.samples[i], g.samples[j] = g.samples[j], g.samples[i]
+	g.squaredNorms[i], g.squaredNorms[j] = g.squaredNorms[j], g.squaredNorms[i]
+}
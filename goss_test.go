@@ -0,0 +1,131 @@
+package treeagent
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/anyvec/anyvec64"
+)
+
+func TestGOSSSelect(t *testing.T) {
+	gen := rand.New(rand.NewSource(1337))
+	var samples []*GradientSample
+	for i := 0; i < 1000; i++ {
+		var sample Sample = &memorySample{features: []float64{float64(i)}}
+		if i%10 == 0 {
+			sample = NewWeightedSample(sample, 0)
+		}
+		samples = append(samples, &GradientSample{
+			Sample:    sample,
+			Gradient:  Vector{float64(i), -float64(i)},
+			Curvature: Vector{1, 1},
+		})
+	}
+	originals := map[*GradientSample]Sample{}
+	for _, sample := range samples {
+		originals[sample] = sample.Sample
+	}
+	goss := &GOSS{TopFrac: 0.2, OtherFrac: 0.1, Rand: gen}
+	selected := goss.Select(append([]*GradientSample{}, samples...))
+	if len(selected) != 270 {
+		t.Fatalf("expected 270 samples but got %d", len(selected))
+	}
+
+	// The top 180 non-zero samples have i >= 800.
+	var numTop int
+	var totalWeight float64
+	for _, sample := range selected {
+		i := int(sample.Feature(0))
+		if i%10 == 0 {
+			t.Fatal("selected sample with zero weight")
+		}
+		if sample.Sample != originals[sample] {
+			t.Fatalf("sample %d: underlying sample was replaced", i)
+		}
+		expectedWeight := 1.0
+		if i >= 800 {
+			numTop++
+		} else {
+			expectedWeight = 720.0 / 90
+		}
+		if sample.Weight() != expectedWeight {
+			t.Fatalf("sample %d: expected weight %f but got %f", i, expectedWeight,
+				sample.Weight())
+		}
+		expected := Vector{float64(i), -float64(i)}.Scale(expectedWeight)
+		if !reflect.DeepEqual(sample.Gradient, expected) ||
+			sample.Curvature[0] != expectedWeight {
+			t.Fatalf("sample %d: gradient was not scaled", i)
+		}
+		totalWeight += sample.Weight()
+	}
+	if numTop != 180 {
+		t.Errorf("expected 180 top samples but got %d", numTop)
+	}
+	if math.Abs(totalWeight-900) > 1e-8 {
+		t.Errorf("expected total weight 900 but got %f", totalWeight)
+	}
+}
+
+func TestGOSSCache(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	samples := benchmarkingSamples(c, 5, 500, false)
+	forest := benchmarkingForest(5, 3, 5, 2)
+	ppo := &PPO{
+		PG: PG{
+			Builder:     Builder{Algorithm: MSEAlgorithm, MaxDepth: 4},
+			ActionSpace: anyrl.Softmax{},
+			GOSS:        &GOSS{TopFrac: 0.2, OtherFrac: 0.3, Rand: rand.New(rand.NewSource(1))},
+		},
+	}
+	expected, _, _ := ppo.Build(samples, forest)
+
+	ppo.PG.GOSS.Rand = rand.New(rand.NewSource(1))
+	ppo.Cache = NewSampleCache(samples)
+	actual, _, _ := ppo.Build(samples, forest)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Error("cached build differs from uncached build")
+	}
+}
+
+func TestGOSSParamWhitelist(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	objAndReg := c.MakeVectorData(c.MakeNumericList([]float64{1, 0}))
+
+	// The masked-out parameter would make the samples with
+	// small i look like the top samples.
+	var samples []*GradientSample
+	for i := 0; i < 100; i++ {
+		samples = append(samples, &GradientSample{
+			Sample:   &memorySample{features: []float64{float64(i)}},
+			Gradient: Vector{float64(i), 1000 * float64(100-i)},
+		})
+	}
+	b := &Builder{Algorithm: MSEAlgorithm, ParamWhitelist: []int{0}}
+	goss := &GOSS{TopFrac: 0.1}
+	tree, _, _, err := b.buildWithTerms(context.Background(), objAndReg, samples,
+		goss, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tree.Leaf || tree.Params[0] != 94.5 || tree.Params[1] != 0 {
+		t.Errorf("unexpected tree: %v", tree.Params)
+	}
+
+	// GOSS skips samples with no weight, leaving nothing.
+	for _, sample := range samples {
+		sample.Sample = NewWeightedSample(sample.Sample, 0)
+	}
+	tree, _, _, err = b.buildWithTerms(context.Background(), objAndReg, samples,
+		goss, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tree.Leaf || !reflect.DeepEqual(tree.Params, ActionParams{0, 0}) {
+		t.Errorf("expected zero leaf but got %v", tree.Params)
+	}
+}
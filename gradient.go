@@ -1,6 +1,7 @@
 package treeagent
 
 import (
+	"math"
 	"runtime"
 	"sync"
 
@@ -42,7 +43,14 @@ type ObjectiveFunc func(params, oldParams, acts, advs anydiff.Res, n int) anydif
 // Improved checks if a policy makes an improvement over
 // the policy that originally produced the samples.
 func Improved(s []Sample, f *Forest, o ObjectiveFunc) bool {
-	newParams, oldParams, acts, advs := objectiveArguments(s, f, o)
+	return improved(s, f, nil, o)
+}
+
+// improved is like Improved, but it can use a cache to
+// compute the outputs of the forest.
+// The cache may be nil.
+func improved(s []Sample, f *Forest, c *SampleCache, o ObjectiveFunc) bool {
+	newParams, oldParams, acts, advs := objectiveArguments(s, forestOutputs(s, f, c))
 	newObj := anyvec.Sum(o(newParams, oldParams, acts, advs, len(s)).Output())
 	oldObj := anyvec.Sum(o(oldParams, oldParams, acts, advs, len(s)).Output())
 	return acts.Output().Creator().NumOps().Greater(newObj, oldObj)
@@ -53,13 +61,27 @@ func Improved(s []Sample, f *Forest, o ObjectiveFunc) bool {
 // It returns the value of the objective function and the
 // gradient with respect to the weights.
 //
-// The gradient is divided by the total number of samples,
-// ensuring that it is invariant to the sample count.
-func weightGradient(s []Sample, f *Forest, o ObjectiveFunc) (grad []float64,
-	obj anyvec.Vector) {
-	obj, gradSamples := computeObjective(s, f, o)
+// The gradient is divided by the total weight of the
+// samples, ensuring that it is invariant to the sample
+// count.
+//
+// If c is non-nil, it is used to avoid re-computing the
+// outputs of the forest.
+func weightGradient(s []Sample, f *Forest, c *SampleCache,
+	o ObjectiveFunc) (grad []float64, obj anyvec.Vector) {
+	obj, gradSamples := computeObjective(s, f, c, o)
 	grad = make([]float64, len(f.Trees))
 
+	if c != nil {
+		if _, ok := c.lookup(s); ok {
+			// The cache is not safe for concurrent use.
+			for i, tree := range f.Trees {
+				grad[i] = c.treeWeightGradient(gradSamples, tree)
+			}
+			return
+		}
+	}
+
 	indices := make(chan int, len(grad))
 	for i := range grad {
 		indices <- i
@@ -82,12 +104,12 @@ func weightGradient(s []Sample, f *Forest, o ObjectiveFunc) (grad []float64,
 	return
 }
 
-func treeWeightGradient(g []*gradientSample, t *Tree) float64 {
+func treeWeightGradient(g []*GradientSample, t *Tree) float64 {
 	var sum float64
 	for _, sample := range g {
-		sum += sample.Gradient.Dot(smallVec(t.FindFeatureSource(sample)))
+		sum += sample.Gradient.Dot(Vector(t.FindFeatureSource(sample)))
 	}
-	return sum / float64(len(g))
+	return sum / totalWeight(g)
 }
 
 // computeObjective computes the objective function and
@@ -99,17 +121,115 @@ func treeWeightGradient(g []*gradientSample, t *Tree) float64 {
 // The f argument is only necessary in offline-policy
 // algorithms or where the samples are re-used for
 // multiple steps.
-func computeObjective(s []Sample, f *Forest, o ObjectiveFunc) (anyvec.Vector,
-	[]*gradientSample) {
-	newParams, oldParams, acts, advs := objectiveArguments(s, f, o)
+//
+// If c is non-nil, it is used to avoid re-computing the
+// outputs of f.
+func computeObjective(s []Sample, f *Forest, c *SampleCache,
+	o ObjectiveFunc) (anyvec.Vector, []*GradientSample) {
+	return objectiveGradients(s, f, c, o, false)
+}
+
+// computeNewtonObjective is like computeObjective, but it
+// also computes the curvature of the objective for every
+// sample.
+func computeNewtonObjective(s []Sample, f *Forest, c *SampleCache,
+	o ObjectiveFunc) (anyvec.Vector, []*GradientSample) {
+	return objectiveGradients(s, f, c, o, true)
+}
+
+func objectiveGradients(s []Sample, f *Forest, c *SampleCache, o ObjectiveFunc,
+	curvature bool) (anyvec.Vector, []*GradientSample) {
+	newParams, oldParams, acts, advs := objectiveArguments(s, forestOutputs(s, f, c))
 	objective := o(newParams, oldParams, acts, advs, len(s))
 	grad := splitSampleGrads(s, newParams, anydiff.Sum(objective))
+	if curvature {
+		curvatures := sampleCurvatures(s, newParams, oldParams, acts, advs, o)
+		for i, sample := range grad {
+			sample.Curvature = curvatures[i]
+		}
+	}
+	for _, sample := range grad {
+		if w := sample.Weight(); w != 1 {
+			sample.Gradient.Scale(w)
+			if sample.Curvature != nil {
+				sample.Curvature.Scale(w)
+			}
+		}
+	}
 	return objective.Output(), grad
 }
 
+// curvatureDelta is the parameter perturbation used to
+// estimate curvatures.
+const curvatureDelta = 1e-3
+
+// sampleCurvatures estimates the absolute value of the
+// diagonal of the objective's Hessian with respect to
+// each sample's parameters.
+//
+// Central differences of the gradient are used.
+// Since the objective is a sum over samples, the same
+// parameter can be perturbed in every sample at once.
+// Thus, the cost is two gradient computations per
+// parameter.
+func sampleCurvatures(s []Sample, params *anydiff.Var, oldParams, acts,
+	advs *anydiff.Const, o ObjectiveFunc) []Vector {
+	c := params.Output().Creator()
+	paramVals := vecToFloats(params.Output())
+	paramSize := len(paramVals) / len(s)
+
+	res := make([]Vector, len(s))
+	flat := make([]float64, len(s)*paramSize)
+	for i := range res {
+		res[i] = flat[i*paramSize : (i+1)*paramSize : (i+1)*paramSize]
+	}
+
+	perturbed := make([]float64, len(paramVals))
+	for j := 0; j < paramSize; j++ {
+		var grads [2][]float64
+		for k, delta := range []float64{curvatureDelta, -curvatureDelta} {
+			copy(perturbed, paramVals)
+			for i := j; i < len(perturbed); i += paramSize {
+				perturbed[i] += delta
+			}
+			v := anydiff.NewVar(c.MakeVectorData(c.MakeNumericList(perturbed)))
+			objective := o(v, oldParams, acts, advs, len(s))
+			grads[k] = paramGradient(v, anydiff.Sum(objective))
+		}
+		for i, curvature := range res {
+			diff := grads[0][i*paramSize+j] - grads[1][i*paramSize+j]
+			curvature[j] = math.Abs(diff) / (2 * curvatureDelta)
+		}
+	}
+
+	return res
+}
+
+// forestOutputs applies the forest to the samples.
+//
+// If c is non-nil and contains every sample, it is synced
+// with the forest and used to produce the outputs.
+//
+// If f is nil, nil is returned.
+func forestOutputs(s []Sample, f *Forest, c *SampleCache) []ActionParams {
+	if f == nil {
+		return nil
+	}
+	if c != nil {
+		c.Sync(f)
+		if res, ok := c.outputs(s); ok {
+			return res
+		}
+	}
+	return f.applySamples(s)
+}
+
 // objectiveArguments produces the arguments for an
 // objective function.
-func objectiveArguments(s []Sample, f *Forest, o ObjectiveFunc) (*anydiff.Var,
+//
+// If params is nil, the ActionParams of each Sample are
+// used as the new parameters.
+func objectiveArguments(s []Sample, params []ActionParams) (*anydiff.Var,
 	*anydiff.Const, *anydiff.Const, *anydiff.Const) {
 	oldParams := make([]anyvec.Vector, len(s))
 	actions := make([]anyvec.Vector, len(s))
@@ -125,9 +245,9 @@ func objectiveArguments(s []Sample, f *Forest, o ObjectiveFunc) (*anydiff.Var,
 	advRes := anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(advs)))
 
 	var newParamRes *anydiff.Var
-	if f != nil {
+	if params != nil {
 		var joined []float64
-		for _, out := range f.applySamples(s) {
+		for _, out := range params {
 			joined = append(joined, out...)
 		}
 		newParamRes = anydiff.NewVar(c.MakeVectorData(c.MakeNumericList(joined)))
@@ -137,37 +257,94 @@ func objectiveArguments(s []Sample, f *Forest, o ObjectiveFunc) (*anydiff.Var,
 	return newParamRes, oldParamRes, actRes, advRes
 }
 
-// gradientSample is a Sample paired with the gradient of
+// GradientSample is a Sample paired with the gradient of
 // some objective with respect to the sample's parameter
 // vector.
-type gradientSample struct {
+//
+// GradientSamples are passed to TreeAlgorithms while a
+// tree is being built.
+// They should not be modified by TreeAlgorithms.
+//
+// The gradient and curvature of a weighted sample are
+// already multiplied by its weight.
+type GradientSample struct {
 	Sample
-	Gradient smallVec
+
+	// Gradient is the gradient of the objective with
+	// respect to the sample's parameter vector.
+	Gradient Vector
+
+	// Curvature stores the absolute diagonal Hessian of
+	// the objective with respect to the sample's parameter
+	// vector.
+	// It is only set for algorithms which need it.
+	Curvature Vector
+
+	// weightScale, if non-zero, multiplies the weight of
+	// the underlying Sample.
+	// It is set for the samples which GOSS subsamples.
+	weightScale float64
+
+	// bins stores the histogram bin of every feature.
+	// It is only set during histogram-based builds.
+	bins []uint8
+
+	// left marks the samples in the left branch of a split
+	// while presorted samples are partitioned.
+	//
+	// It is written without synchronization.
+	// This is safe because each sample is at exactly one
+	// node of a tree at a time, and sibling subtrees, which
+	// may be built concurrently, only partition their own
+	// samples.
+	// Thus, the same GradientSamples must never be used by
+	// two builds at once.
+	left bool
+}
+
+// Weight returns the weight of the underlying Sample,
+// scaled up if the sample was subsampled by GOSS.
+func (g *GradientSample) Weight() float64 {
+	if g.weightScale != 0 {
+		return SampleWeight(g.Sample) * g.weightScale
+	}
+	return SampleWeight(g.Sample)
 }
 
 // splitSampleGrads takes the gradient of obj with respect
 // to params and splits it up amongst the samples.
 func splitSampleGrads(samples []Sample, params *anydiff.Var,
-	obj anydiff.Res) []*gradientSample {
-	grad := anydiff.NewGrad(params)
-	obj.Propagate(anyvec.Ones(params.Output().Creator(), 1), grad)
-	gradVec := grad[params]
-	gradSize := gradVec.Len() / len(samples)
+	obj anydiff.Res) []*GradientSample {
+	nativeGrad := paramGradient(params, obj)
+	gradSize := len(nativeGrad) / len(samples)
 
-	res := make([]*gradientSample, len(samples))
-	nativeGrad := vecToFloats(gradVec)
+	// The samples and their gradients are stored in flat
+	// arrays to avoid allocating memory per sample.
+	// Trees are built from slices of pointers into these
+	// arrays, which are partitioned in place.
+	res := make([]*GradientSample, len(samples))
+	flat := make([]GradientSample, len(samples))
 	for i, s := range samples {
-		res[i] = &gradientSample{
+		flat[i] = GradientSample{
 			Sample:   s,
-			Gradient: nativeGrad[i*gradSize : (i+1)*gradSize],
+			Gradient: nativeGrad[i*gradSize : (i+1)*gradSize : (i+1)*gradSize],
 		}
+		res[i] = &flat[i]
 	}
 	return res
 }
 
+// paramGradient computes the gradient of a scalar with
+// respect to a parameter vector.
+func paramGradient(params *anydiff.Var, obj anydiff.Res) []float64 {
+	grad := anydiff.NewGrad(params)
+	obj.Propagate(anyvec.Ones(params.Output().Creator(), 1), grad)
+	return vecToFloats(grad[params])
+}
+
 // sumGradients computes the sum of the sample's
 // gradients.
-func sumGradients(samples []*gradientSample) smallVec {
+func sumGradients(samples []*GradientSample) Vector {
 	sum := samples[0].Gradient.Copy()
 	for _, sample := range samples[1:] {
 		sum.Add(sample.Gradient)
@@ -175,6 +352,28 @@ func sumGradients(samples []*gradientSample) smallVec {
 	return sum
 }
 
+// totalWeight computes the sum of the samples' weights.
+func totalWeight(samples []*GradientSample) float64 {
+	var sum float64
+	for _, sample := range samples {
+		sum += sample.Weight()
+	}
+	return sum
+}
+
+// sumCurvatures computes the sum of the sample's
+// curvatures.
+func sumCurvatures(samples []*GradientSample) Vector {
+	if samples[0].Curvature == nil {
+		panic("samples have no curvature information")
+	}
+	sum := samples[0].Curvature.Copy()
+	for _, sample := range samples[1:] {
+		sum.Add(sample.Curvature)
+	}
+	return sum
+}
+
 // splitUpTerms splits up the objective vector into its
 // two components: surrogate loss and regularization.
 // It divides both terms by n.
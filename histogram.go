@@ -0,0 +1,327 @@
+package treeagent
+
+import (
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// featureBins stores the quantization of every feature
+// for histogram-based split finding.
+type featureBins struct {
+	// Thresholds stores, for each feature, the boundaries
+	// between bins in ascending order.
+	// A value v falls into bin i if i thresholds are less
+	// than or equal to v.
+	Thresholds [][]float64
+
+	// Min stores the minimum known value of each feature.
+	Min []float64
+}
+
+// missingBin returns the bin index for missing values of
+// a feature.
+// It comes after the bins for known values.
+func (f *featureBins) missingBin(feature int) int {
+	return len(f.Thresholds[feature]) + 1
+}
+
+// newFeatureBins quantizes the features of the samples
+// and stores the resulting bin indices in each sample's
+// bins field.
+//
+// Missing (NaN) values are put in their own bin, which
+// counts towards maxBins.
+func newFeatureBins(samples []*GradientSample, maxBins int) *featureBins {
+	sources := make([]Sample, len(samples))
+	for i, s := range samples {
+		sources[i] = s
+	}
+	res, allBins := quantizeFeatures(sources, maxBins)
+	numFeatures := len(res.Thresholds)
+	for i, s := range samples {
+		s.bins = allBins[i*numFeatures : (i+1)*numFeatures : (i+1)*numFeatures]
+	}
+	return res
+}
+
+// quantizeFeatures is like newFeatureBins, but it returns
+// the bin indices in a flat array, where the bins of the
+// i-th sample start at index i*NumFeatures().
+func quantizeFeatures(samples []Sample, maxBins int) (*featureBins, []uint8) {
+	if maxBins < 2 || maxBins > 256 {
+		panic("histogram bins out of range")
+	}
+	numFeatures := samples[0].NumFeatures()
+	res := &featureBins{
+		Thresholds: make([][]float64, numFeatures),
+		Min:        make([]float64, numFeatures),
+	}
+	allBins := make([]uint8, len(samples)*numFeatures)
+
+	features := make(chan int, numFeatures)
+	for i := 0; i < numFeatures; i++ {
+		features <- i
+	}
+	close(features)
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			values := make([]float64, 0, len(samples))
+			for feature := range features {
+				values = values[:0]
+				for _, s := range samples {
+					if x := s.Feature(feature); !math.IsNaN(x) {
+						values = append(values, x)
+					}
+				}
+				numBins := maxBins
+				if len(values) < len(samples) {
+					numBins--
+				}
+				thresholds := binThresholds(values, numBins)
+				res.Thresholds[feature] = thresholds
+				if len(values) > 0 {
+					res.Min[feature] = values[0]
+				}
+				missingBin := uint8(res.missingBin(feature))
+				for i, s := range samples {
+					idx := i*numFeatures + feature
+					if x := s.Feature(feature); math.IsNaN(x) {
+						allBins[idx] = missingBin
+					} else {
+						allBins[idx] = binIndex(thresholds, x)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return res, allBins
+}
+
+// binThresholds computes bin boundaries so that the
+// values are split into roughly equally-sized bins.
+//
+// The values are sorted in the process.
+func binThresholds(values []float64, maxBins int) []float64 {
+	sort.Float64s(values)
+
+	var unique []float64
+	for i, x := range values {
+		if i == 0 || x != values[i-1] {
+			unique = append(unique, x)
+		}
+	}
+
+	var res []float64
+	if len(unique) <= maxBins {
+		for i := 1; i < len(unique); i++ {
+			res = append(res, (unique[i-1]+unique[i])/2)
+		}
+		return res
+	}
+
+	for i := 1; i < maxBins; i++ {
+		cut := i * len(values) / maxBins
+		if values[cut-1] == values[cut] {
+			// Move the cut to the next distinct value.
+			idx := sort.SearchFloat64s(values, values[cut])
+			if idx == 0 {
+				continue
+			}
+			cut = idx
+		}
+		threshold := (values[cut-1] + values[cut]) / 2
+		if len(res) == 0 || threshold > res[len(res)-1] {
+			res = append(res, threshold)
+		}
+	}
+	return res
+}
+
+// binIndex finds the bin for a value.
+func binIndex(thresholds []float64, value float64) uint8 {
+	return uint8(sort.Search(len(thresholds), func(i int) bool {
+		return thresholds[i] > value
+	}))
+}
+
+// HistogramBin stores gradient statistics for the
+// samples in a histogram bin.
+//
+// BinTrackers use HistogramBins to move many samples to
+// the left side of a split at once.
+type HistogramBin struct {
+	// Sum is the sum of the gradients.
+	Sum Vector
+
+	// Count is the number of samples.
+	Count int
+
+	// Weight is the total weight of the samples.
+	Weight float64
+
+	// Squares is the sum of the squared gradient norms,
+	// each divided by the sample's weight.
+	Squares float64
+
+	// Curvature is only set if the samples have
+	// curvatures.
+	Curvature Vector
+}
+
+// Add adds a sample to the bin.
+func (h *HistogramBin) Add(sample *GradientSample) {
+	if h.Sum == nil {
+		h.Sum = sample.Gradient.Copy()
+	} else {
+		h.Sum.Add(sample.Gradient)
+	}
+	if sample.Curvature != nil {
+		if h.Curvature == nil {
+			h.Curvature = sample.Curvature.Copy()
+		} else {
+			h.Curvature.Add(sample.Curvature)
+		}
+	}
+	h.Count++
+	h.Weight += sample.Weight()
+	h.Squares += weightedSquare(sample)
+}
+
+// histogramSplit is like optimalSplit, but it only
+// considers splits between histogram bins.
+func (b *Builder) histogramSplit(samples []*GradientSample, bins *featureBins,
+	feature int) *splitInfo {
+	return b.binnedSplit(samples, feature, bins.Thresholds[feature], bins.Min[feature],
+		func(i int) int {
+			return int(samples[i].bins[feature])
+		})
+}
+
+// binnedSplit finds the best split between bins of a
+// feature's values.
+// The bins for known values are delimited by thresholds,
+// and the missing bin comes after them.
+// The minimum known value is used as the threshold when
+// only missing values go to the LessThan branch.
+//
+// The binOf function gives the bin of each sample.
+func (b *Builder) binnedSplit(samples []*GradientSample, feature int,
+	thresholds []float64, min float64, binOf func(i int) int) *splitInfo {
+	hist := make([]HistogramBin, len(thresholds)+2)
+	for i, sample := range samples {
+		hist[binOf(i)].Add(sample)
+	}
+	missingBin := len(hist) - 1
+	if len(thresholds) == 0 && hist[missingBin].Count == 0 {
+		return nil
+	}
+
+	// Trackers which cannot add entire bins at once must
+	// add one sample at a time.
+	var binSamples [][]*GradientSample
+	if _, ok := b.algorithm().SplitTracker(b.LeafL2).(BinTracker); !ok {
+		binSamples = make([][]*GradientSample, len(hist))
+		for i, sample := range samples {
+			bin := binOf(i)
+			binSamples[bin] = append(binSamples[bin], sample)
+		}
+	}
+
+	bestSplit, _ := b.histogramSweep(samples, hist, binSamples, thresholds,
+		feature, false)
+	if hist[missingBin].Count > 0 {
+		split, bin := b.histogramSweep(samples, hist, binSamples, thresholds,
+			feature, true)
+		if split != nil && (bestSplit == nil || split.Quality > bestSplit.Quality) {
+			bestSplit = split
+			if bin == -1 {
+				// Every known value goes right.
+				bestSplit.Threshold = min
+			}
+		}
+	}
+
+	if bestSplit != nil {
+		bestSplit.Feature = feature
+	}
+
+	return bestSplit
+}
+
+// histogramSweep finds the best split between the bins
+// for known values, with the missing bin (the last bin)
+// on the given side of the split.
+//
+// It returns the split (without Feature or samples) and
+// the last bin on the LessThan side, which is -1 if only
+// the missing bin goes to the LessThan side.
+//
+// If binSamples is non-nil, samples are added to the
+// tracker one at a time.
+func (b *Builder) histogramSweep(samples []*GradientSample, hist []HistogramBin,
+	binSamples [][]*GradientSample, thresholds []float64, feature int,
+	missingLeft bool) (bestSplit *splitInfo, bestBin int) {
+	tracker := b.splitTracker(feature)
+	tracker.Reset(samples)
+	moveBin := func(i int) {
+		if binSamples == nil {
+			tracker.(BinTracker).MoveBinToLeft(&hist[i])
+		} else {
+			for _, sample := range binSamples[i] {
+				tracker.MoveToLeft(sample)
+			}
+		}
+	}
+
+	minLeaf := b.minLeaf(len(samples))
+	isValid := func(leftCount int) bool {
+		return leftCount >= minLeaf && len(samples)-leftCount >= minLeaf &&
+			leftCount < len(samples) && splitAllowed(tracker)
+	}
+
+	var leftCount int
+	if missingLeft {
+		missingBin := len(hist) - 1
+		moveBin(missingBin)
+		leftCount = hist[missingBin].Count
+		if isValid(leftCount) {
+			bestSplit = &splitInfo{
+				Quality:     tracker.Quality(),
+				Gain:        tracker.Gain(),
+				MissingLeft: true,
+			}
+			bestBin = -1
+		}
+	}
+	for i, bin := range hist[:len(thresholds)] {
+		if bin.Count == 0 {
+			continue
+		}
+		moveBin(i)
+		leftCount += bin.Count
+		if isValid(leftCount) {
+			quality := tracker.Quality()
+			if bestSplit == nil {
+				bestSplit = &splitInfo{}
+			} else if bestSplit.Quality > quality {
+				continue
+			}
+			*bestSplit = splitInfo{
+				Threshold:   thresholds[i],
+				Quality:     quality,
+				Gain:        tracker.Gain(),
+				MissingLeft: missingLeft,
+			}
+			bestBin = i
+		}
+	}
+	return
+}
@@ -0,0 +1,98 @@
+package treeagent
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/anyvec/anyvec64"
+)
+
+func TestHistogramSplitExact(t *testing.T) {
+	// With byte features and 256 bins, histograms should
+	// find the same splits as exact split finding.
+	c := anyvec64.DefaultCreator{}
+	samples := benchmarkingSamples(c, 10, 1000, true)
+	pg := &PG{ActionSpace: anyrl.Softmax{}}
+	_, grads := computeNewtonObjective(samples, nil, nil, pg.Objective)
+	bins := newFeatureBins(grads, 256)
+	for _, algo := range TreeAlgorithms {
+		b := &Builder{Algorithm: algo, MinLeaf: 10}
+		for feature := 0; feature < 10; feature++ {
+			exact := b.optimalSplit(grads, feature)
+			hist := b.histogramSplit(grads, bins, feature)
+			if math.Abs(exact.Quality-hist.Quality) > 1e-8*math.Abs(exact.Quality) {
+				t.Errorf("%s: feature %d: expected quality %f but got %f", algo,
+					feature, exact.Quality, hist.Quality)
+			}
+
+			// The split's rule should reproduce the split
+			// that the histogram measured.
+			partitionSplit(grads, hist, nil)
+			tracker := b.splitTracker(feature)
+			tracker.Reset(grads)
+			for _, sample := range hist.LeftSamples {
+				tracker.MoveToLeft(sample)
+			}
+			if quality := tracker.Quality(); math.Abs(quality-hist.Quality) >
+				1e-8*math.Abs(hist.Quality) {
+				t.Errorf("%s: feature %d: split rule has quality %f but expected %f",
+					algo, feature, quality, hist.Quality)
+			}
+		}
+	}
+}
+
+func TestBinThresholds(t *testing.T) {
+	values := make([]float64, 1000)
+	for i := range values {
+		values[i] = float64(i % 100)
+	}
+	thresholds := binThresholds(values, 10)
+	if len(thresholds) != 9 {
+		t.Fatalf("expected 9 thresholds but got %d", len(thresholds))
+	}
+	counts := make([]int, 10)
+	for i := 0; i < 1000; i++ {
+		counts[binIndex(thresholds, float64(i%100))]++
+	}
+	for i, count := range counts {
+		if count != 100 {
+			t.Errorf("bin %d: expected 100 samples but got %d", i, count)
+		}
+	}
+}
+
+func TestHistogramCache(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	samples := benchmarkingSamples(c, 5, 500, false)
+	forest := benchmarkingForest(5, 3, 5, 2)
+	ppo := &PPO{
+		PG: PG{
+			Builder: Builder{
+				Algorithm:     MSEAlgorithm,
+				MaxDepth:      4,
+				HistogramBins: 16,
+			},
+			ActionSpace: anyrl.Softmax{},
+		},
+	}
+	expected, _, _ := ppo.Build(samples, forest)
+
+	ppo.Cache = NewSampleCache(samples)
+	actual, _, _ := ppo.Build(samples, forest)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Error("cached build differs from uncached build")
+	}
+
+	// The features should only be quantized once.
+	bins := ppo.Cache.bins
+	if bins == nil {
+		t.Fatal("bins were not cached")
+	}
+	ppo.Build(samples[:250], forest)
+	if ppo.Cache.bins != bins {
+		t.Error("bins were recomputed")
+	}
+}
@@ -0,0 +1,117 @@
+package treeagent
+
+// allowedFeatures determines which features may be split
+// on at a node, given the features which its ancestors
+// split on.
+//
+// It returns nil if every feature is allowed.
+func (b *Builder) allowedFeatures(numFeatures int, path []int) []bool {
+	if b.InteractionConstraints == nil || len(path) == 0 {
+		return nil
+	}
+	allowed := make([]bool, numFeatures)
+	for _, set := range b.interactionSets(numFeatures, path) {
+		for feature, inSet := range set {
+			if inSet {
+				allowed[feature] = true
+			}
+		}
+	}
+	return allowed
+}
+
+// interactionSets finds the interaction sets which
+// contain every feature in the non-empty path.
+// Each set is returned as a mask over the features.
+func (b *Builder) interactionSets(numFeatures int, path []int) [][]bool {
+	var res [][]bool
+	listed := make([]bool, numFeatures)
+	for _, set := range b.InteractionConstraints {
+		inSet := make([]bool, numFeatures)
+		for _, feature := range set {
+			if feature < 0 || feature >= numFeatures {
+				panic("interaction constraint feature out of range")
+			}
+			inSet[feature] = true
+			listed[feature] = true
+		}
+		if containsFeatures(inSet, path) {
+			res = append(res, inSet)
+		}
+	}
+
+	// Features in no set act as sets of their own.
+	if !listed[path[0]] && allPathFeatures(path, path[0]) {
+		inSet := make([]bool, numFeatures)
+		inSet[path[0]] = true
+		res = append(res, inSet)
+	}
+	return res
+}
+
+// interacting filters the features to those which may be
+// split on below the features in path.
+func (b *Builder) interacting(features []int, path []int, numFeatures int) []int {
+	allowed := b.allowedFeatures(numFeatures, path)
+	if allowed == nil {
+		return features
+	}
+	return filterFeatures(features, allowed)
+}
+
+// interactingGroups is like interacting, but it groups
+// the features by interaction set.
+//
+// Splits on several features at once, such as oblique
+// splits, must draw all of their features from a single
+// group, since features from different sets may not
+// interact.
+func (b *Builder) interactingGroups(features []int, path []int,
+	numFeatures int) [][]int {
+	if b.InteractionConstraints == nil || len(path) == 0 {
+		return [][]int{features}
+	}
+	var res [][]int
+	for _, set := range b.interactionSets(numFeatures, path) {
+		res = append(res, filterFeatures(features, set))
+	}
+	return res
+}
+
+// childPath extends the features used by a node's
+// ancestors with the features used by its split.
+func childPath(path []int, split *splitInfo) []int {
+	res := append([]int{}, path...)
+	if split.ObliqueFeatures != nil {
+		return append(res, split.ObliqueFeatures...)
+	}
+	return append(res, split.Feature)
+}
+
+func containsFeatures(set []bool, features []int) bool {
+	for _, feature := range features {
+		if !set[feature] {
+			return false
+		}
+	}
+	return true
+}
+
+func allPathFeatures(path []int, feature int) bool {
+	for _, f := range path {
+		if f != feature {
+			return false
+		}
+	}
+	return true
+}
+
+func filterFeatures(features []int, allowed []bool) []int {
+	var res []int
+	for _, feature := range features {
+		if allowed[feature] {
+			res = append(res, feature)
+		}
+	}
+	return res
+}
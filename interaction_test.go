@@ -0,0 +1,126 @@
+package treeagent
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedFeatures(t *testing.T) {
+	b := &Builder{InteractionConstraints: [][]int{{0, 1}, {1, 2, 3}}}
+	cases := []struct {
+		Path     []int
+		Expected []int
+	}{
+		{nil, []int{0, 1, 2, 3, 4, 5}},
+		{[]int{0}, []int{0, 1}},
+		{[]int{1}, []int{0, 1, 2, 3}},
+		{[]int{1, 2}, []int{1, 2, 3}},
+		{[]int{4}, []int{4}},
+		{[]int{4, 4}, []int{4}},
+		{[]int{0, 2}, nil},
+	}
+	for _, c := range cases {
+		actual := b.featuresToTry(6, c.Path)
+		if !reflect.DeepEqual(actual, c.Expected) {
+			t.Errorf("path %v: expected %v but got %v", c.Path, c.Expected, actual)
+		}
+	}
+}
+
+func TestInteractionConstraints(t *testing.T) {
+	samples := make([]*GradientSample, 1000)
+	for i := range samples {
+		features := make([]float64, 5)
+		for j := range features {
+			features[j] = rand.NormFloat64()
+		}
+		samples[i] = &GradientSample{
+			Sample: &memorySample{features: features},
+			Gradient: Vector{features[0]*features[2] + features[1]*features[3],
+				features[4]},
+		}
+	}
+	sets := [][]int{{0, 1}, {2, 3}}
+	checker := &Builder{InteractionConstraints: sets}
+	builders := map[string]*Builder{
+		"depth":     {Algorithm: MSEAlgorithm, MaxDepth: 4},
+		"bestfirst": {Algorithm: MSEAlgorithm, MaxLeaves: 16},
+		"oblique":   {Algorithm: MSEAlgorithm, MaxDepth: 4, ObliqueFeatures: 2},
+		"oblivious": {Algorithm: MSEAlgorithm, MaxDepth: 4, Oblivious: true},
+		"frac":      {Algorithm: MSEAlgorithm, MaxDepth: 4, FeatureFrac: 0.5},
+	}
+	for name, b := range builders {
+		b.InteractionConstraints = sets
+		tree := b.build(samples)
+		if countLeaves(tree) < 4 {
+			t.Errorf("%s: too few leaves: %d", name, countLeaves(tree))
+		}
+		if !interactionsSatisfied(checker, tree, 5) {
+			t.Errorf("%s: constraints violated", name)
+		}
+	}
+}
+
+func TestInteractingGroups(t *testing.T) {
+	b := &Builder{InteractionConstraints: [][]int{{0, 1}, {1, 2, 3}}}
+	features := []int{0, 1, 2, 3, 4, 5}
+	cases := []struct {
+		Path     []int
+		Expected [][]int
+	}{
+		{[]int{1}, [][]int{{0, 1}, {1, 2, 3}}},
+		{[]int{1, 2}, [][]int{{1, 2, 3}}},
+		{[]int{4}, [][]int{{4}}},
+		{[]int{0, 2}, nil},
+	}
+	for _, c := range cases {
+		actual := b.interactingGroups(features, c.Path, 6)
+		if !reflect.DeepEqual(actual, c.Expected) {
+			t.Errorf("path %v: expected %v but got %v", c.Path, c.Expected, actual)
+		}
+	}
+}
+
+func TestObliqueOverlappingInteractions(t *testing.T) {
+	samples := make([]*GradientSample, 1000)
+	for i := range samples {
+		features := make([]float64, 3)
+		for j := range features {
+			features[j] = rand.NormFloat64()
+		}
+		samples[i] = &GradientSample{
+			Sample:   &memorySample{features: features},
+			Gradient: Vector{10*features[1] + features[0] + features[2]},
+		}
+	}
+	sets := [][]int{{0, 1}, {1, 2}}
+	b := &Builder{
+		Algorithm:              MSEAlgorithm,
+		MaxDepth:               4,
+		ObliqueFeatures:        3,
+		InteractionConstraints: sets,
+	}
+	tree := b.build(samples)
+	if !interactionsSatisfied(&Builder{InteractionConstraints: sets}, tree, 3) {
+		t.Error("constraints violated")
+	}
+}
+
+// interactionsSatisfied checks that every path in a tree
+// satisfies a checker's interaction constraints.
+func interactionsSatisfied(checker *Builder, tree *Tree, numFeatures int) bool {
+	var checkPaths func(t *Tree, path []int) bool
+	checkPaths = func(t *Tree, path []int) bool {
+		if t.Leaf {
+			return len(path) == 0 || checker.allowedFeatures(numFeatures, path)[path[0]]
+		}
+		if t.ObliqueFeatures != nil {
+			path = append(path[:len(path):len(path)], t.ObliqueFeatures...)
+		} else {
+			path = append(path[:len(path):len(path)], t.Feature)
+		}
+		return checkPaths(t.LessThan, path) && checkPaths(t.GreaterEqual, path)
+	}
+	return checkPaths(tree, nil)
+}
@@ -1,6 +1,9 @@
 package treeagent
 
 import (
+	"context"
+	"math/rand"
+
 	"github.com/unixpickle/anydiff"
 	"github.com/unixpickle/anydiff/anyseq"
 	"github.com/unixpickle/anyrl"
@@ -27,11 +30,32 @@ type Judger struct {
 	// https://arxiv.org/abs/1506.02438.
 	Lambda float64
 
+	// Newton, if true, makes Train use NewtonAlgorithm.
+	// The squared error has unit curvature, so Newton
+	// steps only differ from MSE steps in how LeafL2
+	// affects the splits.
+	Newton bool
+
 	// These options are the same as those in Builder.
-	MaxDepth    int
-	FeatureFrac float64
-	MinLeaf     int
-	MinLeafFrac float64
+	MaxDepth               int
+	MaxLeaves              int
+	Oblivious              bool
+	FeatureFrac            float64
+	MinLeaf                int
+	MinLeafFrac            float64
+	MinGain                float64
+	LeafL2                 float64
+	HistogramBins          int
+	RandomThresholds       int
+	ObliqueFeatures        int
+	CategoricalFeatures    []int
+	LinearFeatures         int
+	LinearL2               float64
+	InteractionConstraints [][]int
+	MonotoneConstraints    []MonotoneConstraint
+	PruneFrac              float64
+	PruneCost              float64
+	Rand                   *rand.Rand
 }
 
 // JudgeActions produces advantage estimations.
@@ -64,26 +88,60 @@ func (j *Judger) TrainingSamples(r *anyrl.RolloutSet) <-chan Sample {
 // The advantages in the samples should come from
 // TrainingSamples.
 func (j *Judger) Train(data []Sample) (*Tree, float64) {
-	var gradSamples []*gradientSample
-	var loss float64
+	tree, mse, _ := j.TrainContext(context.Background(), data)
+	return tree, mse
+}
+
+// TrainContext is like Train, but it stops growing the
+// tree once ctx is done.
+// The tree grown so far is still returned, along with
+// ctx.Err().
+func (j *Judger) TrainContext(ctx context.Context, data []Sample) (*Tree, float64,
+	error) {
+	var gradSamples []*GradientSample
+	var loss, totalWeight float64
 	outs := j.ValueFunc.applySamples(data)
 	for i, sample := range data {
 		grad := sample.Advantage() - outs[i][0]
-		gradSamples = append(gradSamples, &gradientSample{
-			Sample:   sample,
-			Gradient: []float64{grad},
+		weight := SampleWeight(sample)
+		// The squared error has unit curvature, which is
+		// used for Newton steps and pruning.
+		gradSamples = append(gradSamples, &GradientSample{
+			Sample:    sample,
+			Gradient:  []float64{weight * grad},
+			Curvature: []float64{weight},
 		})
-		loss += grad * grad
+		loss += weight * grad * grad
+		totalWeight += weight
 	}
 	builder := Builder{
-		Algorithm:   MSEAlgorithm,
-		MaxDepth:    j.MaxDepth,
-		FeatureFrac: j.FeatureFrac,
-		MinLeaf:     j.MinLeaf,
-		MinLeafFrac: j.MinLeafFrac,
+		Algorithm:              MSEAlgorithm,
+		MaxDepth:               j.MaxDepth,
+		MaxLeaves:              j.MaxLeaves,
+		Oblivious:              j.Oblivious,
+		FeatureFrac:            j.FeatureFrac,
+		MinLeaf:                j.MinLeaf,
+		MinLeafFrac:            j.MinLeafFrac,
+		MinGain:                j.MinGain,
+		LeafL2:                 j.LeafL2,
+		HistogramBins:          j.HistogramBins,
+		RandomThresholds:       j.RandomThresholds,
+		ObliqueFeatures:        j.ObliqueFeatures,
+		CategoricalFeatures:    j.CategoricalFeatures,
+		LinearFeatures:         j.LinearFeatures,
+		LinearL2:               j.LinearL2,
+		InteractionConstraints: j.InteractionConstraints,
+		MonotoneConstraints:    j.MonotoneConstraints,
+		PruneFrac:              j.PruneFrac,
+		PruneCost:              j.PruneCost,
+		Rand:                   j.Rand,
+	}
+	if j.Newton {
+		builder.Algorithm = NewtonAlgorithm
 	}
-	mse := loss / float64(len(data))
-	return builder.build(gradSamples), mse
+	mse := loss / totalWeight
+	tree, err := builder.buildContext(ctx, gradSamples, nil)
+	return tree, mse, err
 }
 
 // OptimalWeight returns the optimal weight for the tree
@@ -98,8 +156,9 @@ func (j *Judger) OptimalWeight(data []Sample, t *Tree) float64 {
 	for i, sample := range data {
 		out := t.FindFeatureSource(sample)[0]
 		approximation := outs[i][0]
-		denominator += out * out
-		numerator += out * (sample.Advantage() - approximation)
+		weight := SampleWeight(sample)
+		denominator += weight * out * out
+		numerator += weight * out * (sample.Advantage() - approximation)
 	}
 	if denominator == 0 {
 		return 0
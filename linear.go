@@ -0,0 +1,307 @@
+package treeagent
+
+import (
+	"math"
+	"sort"
+
+	"github.com/unixpickle/essentials"
+)
+
+// linearLeaf turns a constant leaf into a linear leaf.
+//
+// The linear terms are fitted with ridge regression on
+// the features which explain the gradients best.
+//
+// For algorithms which use curvature, the slopes are
+// fitted to the per-sample Newton steps, weighted by
+// curvature, so that they are in the same units as the
+// leaf's Newton step.
+// In this case, the constant term is adjusted so that the
+// leaf's Newton step is its value at the samples'
+// curvature-weighted mean features.
+// Otherwise, the slopes are fitted to the gradients and
+// then scaled, one parameter at a time, in the same way
+// that the leaf's algorithm scales the mean gradient to
+// get the leaf's Params.
+// Either way, the leaf's gradient model is consistent
+// with its constant term.
+//
+// If no linear terms are useful, the leaf is unchanged.
+func (b *Builder) linearLeaf(leaf *Tree, data []*GradientSample, state *buildState) {
+	mean := meanGradient(data)
+	features, centers := b.linearFeatures(data, mean, state)
+	if len(features) == 0 {
+		return
+	}
+
+	params := Vector(leaf.Params)
+	var weights []Vector
+	if b.algorithm().NeedsCurvature() {
+		weights, params = b.newtonSlopes(params, data, features, centers)
+	} else {
+		weights = b.scaledSlopes(params, mean, data, features, centers)
+	}
+	if weights == nil {
+		return
+	}
+
+	leaf.Params = ActionParams(params)
+	leaf.LinearFeatures = features
+	leaf.LinearCenters = centers
+	for _, w := range weights {
+		leaf.LinearWeights = append(leaf.LinearWeights, ActionParams(w))
+	}
+}
+
+// scaledSlopes fits the slopes of a linear leaf to the
+// gradients, and then scales each parameter's slopes by
+// the ratio of the leaf's parameter to the mean gradient.
+//
+// It returns nil if every ratio is zero or the system is
+// singular.
+func (b *Builder) scaledSlopes(params, mean Vector, data []*GradientSample,
+	features []int, centers []float64) []Vector {
+	scales := make(Vector, len(mean))
+	var anyScale bool
+	for i, m := range mean {
+		if m != 0 {
+			scales[i] = params[i] / m
+			anyScale = anyScale || scales[i] != 0
+		}
+	}
+	if !anyScale {
+		return nil
+	}
+
+	// Solve (X'DX + l2*I)W = X'DG, where X is the matrix
+	// of centered features, G is the matrix of centered
+	// gradients, and D holds the sample weights.
+	system := b.linearSystem(len(features))
+	targets := make([]Vector, len(features))
+	for i := range targets {
+		targets[i] = make(Vector, len(mean))
+	}
+	row := make([]float64, len(features))
+	for _, sample := range data {
+		linearRow(row, sample, features, centers)
+		w := sample.Weight()
+		grad := sample.Gradient.Copy().Sub(mean.Copy().Scale(w))
+		for i, x := range row {
+			for j, y := range row {
+				system[i][j] += w * x * y
+			}
+			targets[i].Add(grad.Copy().Scale(x))
+		}
+	}
+	weights := solveLinearSystem(system, targets)
+	for _, w := range weights {
+		w.Mul(scales)
+	}
+	return weights
+}
+
+// newtonSlopes fits the slopes of a linear leaf to the
+// samples' Newton steps, g/h, with each sample weighted
+// by its curvature h.
+//
+// Each parameter is fitted with the features centered at
+// their curvature-weighted means, where the optimal
+// constant term is the leaf's Newton step.
+// The constant terms are then shifted to the features'
+// shared centers, and returned along with the slopes.
+//
+// It returns nil slopes if any parameter's system is
+// singular.
+func (b *Builder) newtonSlopes(params Vector, data []*GradientSample,
+	features []int, centers []float64) (weights []Vector, newParams Vector) {
+	weights = make([]Vector, len(features))
+	for i := range weights {
+		weights[i] = make(Vector, len(params))
+	}
+	newParams = params.Copy()
+	rows := make([][]float64, len(data))
+	for i, sample := range data {
+		rows[i] = make([]float64, len(features))
+		linearRow(rows[i], sample, features, centers)
+	}
+
+	// For each parameter, solve (X'HX + l2*I)w = X'G,
+	// where X holds the features centered at their
+	// curvature-weighted means, H holds the curvatures,
+	// and G holds the gradients (i.e. H times the Newton
+	// steps).
+	offset := make([]float64, len(features))
+	row := make([]float64, len(features))
+	for param := range params {
+		var totalCurvature float64
+		for i := range offset {
+			offset[i] = 0
+		}
+		for k, sample := range data {
+			h := sample.Curvature[param]
+			totalCurvature += h
+			for i, x := range rows[k] {
+				offset[i] += h * x
+			}
+		}
+		if totalCurvature <= 0 {
+			// Without curvature, the Newton step is zero.
+			continue
+		}
+		for i := range offset {
+			offset[i] /= totalCurvature
+		}
+
+		system := b.linearSystem(len(features))
+		targets := make([]Vector, len(features))
+		for i := range targets {
+			targets[i] = Vector{0}
+		}
+		for k, sample := range data {
+			h := sample.Curvature[param]
+			g := sample.Gradient[param]
+			for i, x := range rows[k] {
+				row[i] = x - offset[i]
+			}
+			for i, x := range row {
+				for j, y := range row {
+					system[i][j] += h * x * y
+				}
+				targets[i][0] += x * g
+			}
+		}
+		solution := solveLinearSystem(system, targets)
+		if solution == nil {
+			return nil, params
+		}
+		for i, w := range solution {
+			weights[i][param] = w[0]
+			newParams[param] -= w[0] * offset[i]
+		}
+	}
+	return weights, newParams
+}
+
+// linearSystem creates the left-hand side of a ridge
+// regression system, initialized to the L2 penalty.
+func (b *Builder) linearSystem(numFeatures int) [][]float64 {
+	system := make([][]float64, numFeatures)
+	for i := range system {
+		system[i] = make([]float64, numFeatures)
+		system[i][i] = b.LinearL2
+	}
+	return system
+}
+
+// linearRow fills row with a sample's centered features,
+// treating missing values as the centers.
+func linearRow(row []float64, sample *GradientSample, features []int,
+	centers []float64) {
+	for i, feature := range features {
+		row[i] = sample.Feature(feature) - centers[i]
+		if math.IsNaN(row[i]) {
+			row[i] = 0
+		}
+	}
+}
+
+// linearFeatures selects up to b.LinearFeatures features
+// for a linear leaf, along with their means.
+//
+// Features are ranked by how much of the variance in the
+// gradients they explain individually.
+// Categorical features are never selected.
+func (b *Builder) linearFeatures(data []*GradientSample, meanGrad Vector,
+	state *buildState) (features []int, centers []float64) {
+	type candidate struct {
+		Feature int
+		Center  float64
+		Score   float64
+	}
+	var candidates []candidate
+	for feature := 0; feature < data[0].NumFeatures(); feature++ {
+		if state.isCategorical(feature) {
+			continue
+		}
+		var mean float64
+		var count float64
+		for _, sample := range data {
+			if x := sample.Feature(feature); !math.IsNaN(x) {
+				w := sample.Weight()
+				mean += w * x
+				count += w
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		mean /= count
+		var variance float64
+		covariance := make(Vector, len(meanGrad))
+		for _, sample := range data {
+			if x := sample.Feature(feature); !math.IsNaN(x) {
+				w := sample.Weight()
+				diff := x - mean
+				variance += w * diff * diff
+				grad := sample.Gradient.Copy().Sub(meanGrad.Copy().Scale(w))
+				covariance.Add(grad.Scale(diff))
+			}
+		}
+		if variance == 0 {
+			continue
+		}
+		score := covariance.Dot(covariance) / variance
+		if score > 0 {
+			candidates = append(candidates, candidate{feature, mean, score})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+	candidates = candidates[:essentials.MinInt(len(candidates), b.LinearFeatures)]
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Feature < candidates[j].Feature
+	})
+	for _, c := range candidates {
+		features = append(features, c.Feature)
+		centers = append(centers, c.Center)
+	}
+	return
+}
+
+// solveLinearSystem solves the square system Ax = b for
+// a matrix of right-hand sides, using Gaussian
+// elimination with partial pivoting.
+// It modifies a and b.
+//
+// It returns nil if the system is singular.
+func solveLinearSystem(a [][]float64, b []Vector) []Vector {
+	n := len(a)
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if a[pivot][col] == 0 {
+			return nil
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+		for row := col + 1; row < n; row++ {
+			factor := a[row][col] / a[col][col]
+			for j := col; j < n; j++ {
+				a[row][j] -= factor * a[col][j]
+			}
+			b[row].Sub(b[col].Copy().Scale(factor))
+		}
+	}
+	for row := n - 1; row >= 0; row-- {
+		for j := row + 1; j < n; j++ {
+			b[row].Sub(b[j].Copy().Scale(a[row][j]))
+		}
+		b[row].Scale(1 / a[row][row])
+	}
+	return b
+}
@@ -0,0 +1,157 @@
+package treeagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/anyvec/anyvec64"
+)
+
+func TestLinearLeaf(t *testing.T) {
+	samples := make([]*GradientSample, 500)
+	for i := range samples {
+		x := rand.Float64()*2 - 1
+		samples[i] = &GradientSample{
+			Sample:    &memorySample{features: []float64{rand.NormFloat64(), x}},
+			Gradient:  Vector{2*x + 1, -x},
+			Curvature: Vector{1, 1},
+		}
+	}
+	b := &Builder{Algorithm: MSEAlgorithm, LinearFeatures: 1}
+	leaf := b.build(samples)
+	if !reflect.DeepEqual(leaf.LinearFeatures, []int{1}) {
+		t.Fatalf("unexpected linear features: %v", leaf.LinearFeatures)
+	}
+	for _, sample := range samples {
+		actual := leaf.FindFeatureSource(sample)
+		for i, x := range sample.Gradient {
+			if math.Abs(actual[i]-x) > 1e-8 {
+				t.Fatalf("expected %v but got %v", sample.Gradient, actual)
+			}
+		}
+	}
+
+	// The slopes should shrink as the leaf values do.
+	b.LeafL2 = float64(len(samples))
+	shrunk := b.build(samples)
+	for i, w := range shrunk.LinearWeights[0] {
+		if math.Abs(w-leaf.LinearWeights[0][i]/2) > 1e-8 {
+			t.Errorf("weight %d: expected %f but got %f", i, leaf.LinearWeights[0][i]/2, w)
+		}
+	}
+}
+
+func TestLinearLeafNewton(t *testing.T) {
+	samples := make([]*GradientSample, 500)
+	for i := range samples {
+		x := rand.Float64()*2 - 1
+		curvature := Vector{rand.Float64()*2 + 0.1, rand.Float64()*0.5 + 0.1}
+		samples[i] = &GradientSample{
+			Sample:    &memorySample{features: []float64{rand.NormFloat64(), x}},
+			Gradient:  Vector{2*x + 1, -x}.Mul(curvature),
+			Curvature: curvature,
+		}
+	}
+	b := &Builder{Algorithm: NewtonAlgorithm, LinearFeatures: 1}
+	leaf := b.build(samples)
+	if !reflect.DeepEqual(leaf.LinearFeatures, []int{1}) {
+		t.Fatalf("unexpected linear features: %v", leaf.LinearFeatures)
+	}
+
+	// Every sample's Newton step is an affine function of
+	// its feature, so the leaf should match them exactly.
+	for _, sample := range samples {
+		actual := leaf.FindFeatureSource(sample)
+		for i, x := range sample.Gradient {
+			expected := x / sample.Curvature[i]
+			if math.Abs(actual[i]-expected) > 1e-8 {
+				t.Fatalf("expected %v but got %v", expected, actual[i])
+			}
+		}
+	}
+}
+
+func TestLinearForest(t *testing.T) {
+	forest := benchmarkingForest(20, 4, 5, 2)
+	var convert func(t *Tree)
+	convert = func(t *Tree) {
+		if !t.Leaf {
+			convert(t.LessThan)
+			convert(t.GreaterEqual)
+		} else if rand.Intn(2) == 0 {
+			t.LinearFeatures = []int{rand.Intn(5), rand.Intn(5)}
+			t.LinearCenters = []float64{rand.NormFloat64(), rand.NormFloat64()}
+			t.LinearWeights = []ActionParams{
+				{rand.NormFloat64(), rand.NormFloat64()},
+				{rand.NormFloat64(), rand.NormFloat64()},
+			}
+		}
+	}
+	for _, tree := range forest.Trees {
+		convert(tree)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteForest(&buf, forest); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ReadForest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testForestsEqual(t, forest, decoded)
+
+	data, err := json.Marshal(forest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = ReadForest(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testForestsEqual(t, forest, decoded)
+
+	compiled := forest.Compile()
+	features := make([]float64, 5*30)
+	for j := range features {
+		features[j] = rand.NormFloat64()
+	}
+	actual := compiled.ApplyBatch(features, 30)
+	for i := 0; i < 30; i++ {
+		expected := forest.Apply(features[i*5 : (i+1)*5])
+		for j, x := range expected {
+			if math.Abs(x-actual[i*2+j]) > 1e-8 {
+				t.Fatalf("sample %d: expected %v but got %v", i, expected,
+					actual[i*2:(i+1)*2])
+			}
+		}
+	}
+
+	samples := benchmarkingSamples(anyvec64.DefaultCreator{}, 5, 50, false)
+	cache := NewSampleCache(samples)
+	for iter := 0; iter < 2; iter++ {
+		if iter == 1 {
+			// Cover incremental cache updates.
+			tree := benchmarkingTree(3, 5, 2)
+			convert(tree)
+			forest.Add(tree, 0.5)
+		}
+		cache.Sync(forest)
+		cached, ok := cache.outputs(samples)
+		if !ok {
+			t.Fatal("samples should be cached")
+		}
+		for i, sample := range samples {
+			expected := forest.ApplyFeatureSource(sample)
+			for j, x := range expected {
+				if math.Abs(x-cached[i][j]) > 1e-8 {
+					t.Fatalf("sample %d: expected %v but got %v", i, expected, cached[i])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package treeagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestMissingSplit(t *testing.T) {
+	for _, missingLeft := range []bool{false, true} {
+		samples := make([]*GradientSample, 1000)
+		for i := range samples {
+			x := rand.NormFloat64()
+			grad := 1.0
+			if i%3 == 0 {
+				x = math.NaN()
+				if !missingLeft {
+					grad = -1
+				}
+			} else if x >= 0 {
+				grad = -1
+			}
+			samples[i] = &GradientSample{
+				Sample:    &memorySample{features: []float64{x}},
+				Gradient:  Vector{grad},
+				Curvature: Vector{1},
+			}
+		}
+		for _, bins := range []int{0, 16} {
+			b := &Builder{Algorithm: MSEAlgorithm, MaxDepth: 1, HistogramBins: bins}
+			tree := b.build(samples)
+			if tree.Leaf {
+				t.Fatalf("bins %d: expected split", bins)
+			}
+			if tree.MissingLeft != missingLeft {
+				t.Errorf("bins %d: expected MissingLeft=%v", bins, missingLeft)
+			}
+			var correct int
+			for _, sample := range samples {
+				if tree.FindFeatureSource(sample)[0]*sample.Gradient[0] > 0 {
+					correct++
+				}
+			}
+			if correct < len(samples)*95/100 {
+				t.Errorf("bins %d: only %d/%d samples classified correctly", bins,
+					correct, len(samples))
+			}
+		}
+	}
+}
+
+func TestMissingCategoricalSplit(t *testing.T) {
+	samples := make([]*GradientSample, 1000)
+	for i := range samples {
+		x := float64(i % 4)
+		grad := -1.0
+		if x == 3 {
+			x = math.NaN()
+			grad = 1
+		} else if x == 1 {
+			grad = 1
+		}
+		samples[i] = &GradientSample{
+			Sample:   &memorySample{features: []float64{x}},
+			Gradient: Vector{grad},
+		}
+	}
+	b := &Builder{Algorithm: MSEAlgorithm, MaxDepth: 1, CategoricalFeatures: []int{0}}
+	tree := b.build(samples)
+	if tree.Leaf {
+		t.Fatal("expected split")
+	}
+	if !(reflect.DeepEqual(tree.Categories, []float64{1}) && tree.MissingLeft) &&
+		!(reflect.DeepEqual(tree.Categories, []float64{0, 2}) && !tree.MissingLeft) {
+		t.Errorf("unexpected split: categories=%v missingLeft=%v", tree.Categories,
+			tree.MissingLeft)
+	}
+	for _, sample := range samples {
+		if tree.FindFeatureSource(sample)[0]*sample.Gradient[0] <= 0 {
+			t.Fatal("sample misclassified")
+		}
+	}
+}
+
+func TestMissingForest(t *testing.T) {
+	forest := obliqueForest(benchmarkingForest(20, 4, 5, 2))
+	var convert func(t *Tree)
+	convert = func(t *Tree) {
+		if !t.Leaf {
+			t.MissingLeft = rand.Intn(2) == 0
+			convert(t.LessThan)
+			convert(t.GreaterEqual)
+		}
+	}
+	for _, tree := range forest.Trees {
+		convert(tree)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteForest(&buf, forest); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ReadForest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testForestsEqual(t, forest, decoded)
+
+	data, err := json.Marshal(forest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = ReadForest(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testForestsEqual(t, forest, decoded)
+
+	compiled := forest.Compile()
+	features := make([]float64, 5*30)
+	for j := range features {
+		if rand.Intn(3) == 0 {
+			features[j] = math.NaN()
+		} else {
+			features[j] = rand.NormFloat64()
+		}
+	}
+	actual := compiled.ApplyBatch(features, 30)
+	for i := 0; i < 30; i++ {
+		expected := forest.Apply(features[i*5 : (i+1)*5])
+		if !reflect.DeepEqual(ActionParams(actual[i*2:(i+1)*2]), expected) {
+			t.Fatalf("sample %d: expected %v but got %v", i, expected,
+				actual[i*2:(i+1)*2])
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package treeagent
+
+import "math"
+
+// A MonotoneConstraint requires a leaf parameter to be a
+// monotonic function of a feature.
+type MonotoneConstraint struct {
+	Feature int
+	Param   int
+
+	// Direction is 1 if the parameter may only increase
+	// as the feature increases, or -1 if it may only
+	// decrease.
+	Direction int
+}
+
+// monotone returns the constraints on a feature.
+func (b *Builder) monotone(feature int) []MonotoneConstraint {
+	var res []MonotoneConstraint
+	for _, c := range b.MonotoneConstraints {
+		if c.Feature == feature {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// checkMonotone panics if the monotonic constraints are
+// invalid or cannot be combined with other options.
+func (b *Builder) checkMonotone(numFeatures, numParams int) {
+	if len(b.MonotoneConstraints) == 0 {
+		return
+	}
+	if b.Oblivious {
+		panic("monotonic constraints are not supported for oblivious trees")
+	} else if b.LinearFeatures != 0 {
+		panic("monotonic constraints are not supported for linear leaves")
+	}
+	for _, c := range b.MonotoneConstraints {
+		if c.Feature < 0 || c.Feature >= numFeatures {
+			panic("monotonic constraint feature out of range")
+		} else if c.Param < 0 || c.Param >= numParams {
+			panic("monotonic constraint parameter out of range")
+		} else if c.Direction != 1 && c.Direction != -1 {
+			panic("monotonic constraint direction must be 1 or -1")
+		}
+		for _, feature := range b.CategoricalFeatures {
+			if feature == c.Feature {
+				panic("monotonic constraints are not supported for categorical features")
+			}
+		}
+	}
+}
+
+// unconstrained filters out features with monotonic
+// constraints.
+func (b *Builder) unconstrained(features []int) []int {
+	if len(b.MonotoneConstraints) == 0 {
+		return features
+	}
+	var res []int
+	for _, feature := range features {
+		if len(b.monotone(feature)) == 0 {
+			res = append(res, feature)
+		}
+	}
+	return res
+}
+
+// splitTracker creates a SplitTracker for splits on a
+// feature, or on something other than a single feature
+// if feature is -1.
+func (b *Builder) splitTracker(feature int) SplitTracker {
+	algo := b.algorithm()
+	tracker := algo.SplitTracker(b.LeafL2)
+	if feature < 0 {
+		return tracker
+	}
+	if constraints := b.monotone(feature); len(constraints) > 0 {
+		builtin, ok := algo.(*builtinAlgorithm)
+		return &monotoneTracker{
+			SplitTracker: tracker,
+			Constraints:  constraints,
+			L2:           b.LeafL2,
+			Curvature:    algo.NeedsCurvature(),
+			Sums:         ok && builtin.sumLeaves,
+		}
+	}
+	return tracker
+}
+
+// splitAllowed checks that the current split of a tracker
+// satisfies any monotonic constraints.
+func splitAllowed(tracker SplitTracker) bool {
+	m, ok := tracker.(*monotoneTracker)
+	return !ok || m.Satisfied()
+}
+
+// monotoneTracker wraps a SplitTracker to check if splits
+// satisfy monotonic constraints.
+//
+// The leaf values on each side of a split are estimated
+// as gradient sums divided by L2 plus the sample weights
+// (or the curvature sums).
+// If Sums is set, the estimates are multiplied by the
+// sample weights, since SumAlgorithm and
+// BalancedSumAlgorithm shrink sums rather than means.
+// Each built-in algorithm's leaf values are ordered the
+// same way as these estimates.
+// Custom algorithms are assumed to use mean-like leaves.
+type monotoneTracker struct {
+	SplitTracker
+	Constraints []MonotoneConstraint
+	L2          float64
+	Curvature   bool
+	Sums        bool
+
+	leftSums    []float64
+	rightSums   []float64
+	leftDenoms  []float64
+	rightDenoms []float64
+}
+
+func (m *monotoneTracker) Reset(rightSamples []*GradientSample) {
+	m.SplitTracker.Reset(rightSamples)
+	n := len(m.Constraints)
+	m.leftSums = make([]float64, n)
+	m.rightSums = make([]float64, n)
+	m.leftDenoms = make([]float64, n)
+	m.rightDenoms = make([]float64, n)
+	for _, sample := range rightSamples {
+		for i, c := range m.Constraints {
+			m.rightSums[i] += sample.Gradient[c.Param]
+			m.rightDenoms[i] += m.denom(sample, c.Param)
+		}
+	}
+}
+
+func (m *monotoneTracker) MoveToLeft(sample *GradientSample) {
+	m.SplitTracker.MoveToLeft(sample)
+	for i, c := range m.Constraints {
+		grad := sample.Gradient[c.Param]
+		denom := m.denom(sample, c.Param)
+		m.leftSums[i] += grad
+		m.rightSums[i] -= grad
+		m.leftDenoms[i] += denom
+		m.rightDenoms[i] -= denom
+	}
+}
+
+// MoveBinToLeft may only be called if the wrapped tracker
+// is a BinTracker.
+func (m *monotoneTracker) MoveBinToLeft(bin *HistogramBin) {
+	m.SplitTracker.(BinTracker).MoveBinToLeft(bin)
+	for i, c := range m.Constraints {
+		grad := bin.Sum[c.Param]
+		denom := bin.Weight
+		if m.Curvature {
+			denom = bin.Curvature[c.Param]
+		}
+		m.leftSums[i] += grad
+		m.rightSums[i] -= grad
+		m.leftDenoms[i] += denom
+		m.rightDenoms[i] -= denom
+	}
+}
+
+// Satisfied checks if the current split satisfies the
+// constraints.
+func (m *monotoneTracker) Satisfied() bool {
+	for i, c := range m.Constraints {
+		left := m.leafValue(m.leftSums[i], m.leftDenoms[i])
+		right := m.leafValue(m.rightSums[i], m.rightDenoms[i])
+		if float64(c.Direction)*(right-left) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// leafValue estimates a leaf value, up to a positive
+// factor shared by both sides of a split.
+func (m *monotoneTracker) leafValue(sum, denom float64) float64 {
+	value := newtonStep(sum, denom, m.L2)
+	if m.Sums {
+		value *= denom
+	}
+	return value
+}
+
+func (m *monotoneTracker) denom(sample *GradientSample, param int) float64 {
+	if m.Curvature {
+		return sample.Curvature[param]
+	}
+	return sample.Weight()
+}
+
+// leafBounds stores bounds on the parameters of the
+// leaves in a subtree, which are used to enforce
+// monotonic constraints.
+//
+// A nil *leafBounds places no bounds on leaves.
+type leafBounds struct {
+	Lower Vector
+	Upper Vector
+}
+
+// Clamp clamps the parameters to the bounds.
+// It returns a new vector unless there are no bounds.
+func (l *leafBounds) Clamp(params Vector) Vector {
+	if l == nil {
+		return params
+	}
+	res := params.Copy()
+	for i, x := range res {
+		res[i] = math.Max(l.Lower[i], math.Min(l.Upper[i], x))
+	}
+	return res
+}
+
+// childBounds computes the bounds for the children of a
+// split.
+//
+// For each constraint on the split's feature, the bound
+// between the two children is halfway between their leaf
+// values, so that every leaf in one subtree is ordered
+// correctly relative to every leaf in the other.
+func (b *Builder) childBounds(split *splitInfo, bounds *leafBounds,
+	state *buildState) (left, right *leafBounds) {
+	if split.ObliqueFeatures != nil || split.Categories != nil {
+		return bounds, bounds
+	}
+	constraints := b.monotone(split.Feature)
+	if len(constraints) == 0 {
+		return bounds, bounds
+	}
+	leftParams := b.leafValues(split.LeftSamples, state, bounds)
+	rightParams := b.leafValues(split.RightSamples, state, bounds)
+	left, right = bounds.copy(len(leftParams)), bounds.copy(len(leftParams))
+	for _, c := range constraints {
+		mid := (leftParams[c.Param] + rightParams[c.Param]) / 2
+		if c.Direction > 0 {
+			left.Upper[c.Param] = math.Min(left.Upper[c.Param], mid)
+			right.Lower[c.Param] = math.Max(right.Lower[c.Param], mid)
+		} else {
+			left.Lower[c.Param] = math.Max(left.Lower[c.Param], mid)
+			right.Upper[c.Param] = math.Min(right.Upper[c.Param], mid)
+		}
+	}
+	return
+}
+
+// copy copies the bounds, creating unlimited bounds for
+// the given number of parameters if l is nil.
+func (l *leafBounds) copy(numParams int) *leafBounds {
+	if l != nil {
+		return &leafBounds{Lower: l.Lower.Copy(), Upper: l.Upper.Copy()}
+	}
+	res := &leafBounds{
+		Lower: make(Vector, numParams),
+		Upper: make(Vector, numParams),
+	}
+	for i := range res.Lower {
+		res.Lower[i] = math.Inf(-1)
+		res.Upper[i] = math.Inf(1)
+	}
+	return res
+}
+
+// clampToSubtree clamps the parameters of a leaf between
+// the smallest and largest parameters of the leaves of t.
+//
+// This is used when a subtree is collapsed into a leaf,
+// so that the new leaf satisfies any bounds that the old
+// leaves did.
+func clampToSubtree(leaf *Tree, t *Tree) {
+	var bounds *leafBounds
+	var addLeaves func(t *Tree)
+	addLeaves = func(t *Tree) {
+		if !t.Leaf {
+			addLeaves(t.LessThan)
+			addLeaves(t.GreaterEqual)
+		} else if bounds == nil {
+			bounds = &leafBounds{
+				Lower: Vector(t.Params).Copy(),
+				Upper: Vector(t.Params).Copy(),
+			}
+		} else {
+			for i, x := range t.Params {
+				bounds.Lower[i] = math.Min(bounds.Lower[i], x)
+				bounds.Upper[i] = math.Max(bounds.Upper[i], x)
+			}
+		}
+	}
+	addLeaves(t)
+	leaf.Params = ActionParams(bounds.Clamp(Vector(leaf.Params)))
+}
@@ -0,0 +1,83 @@
+package treeagent
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestMonotoneConstraints(t *testing.T) {
+	samples := make([]*GradientSample, 2000)
+	for i := range samples {
+		features := []float64{rand.Float64()*2 - 1, rand.Float64()*2 - 1}
+		x := features[0]
+		samples[i] = &GradientSample{
+			Sample:   &memorySample{features: features},
+			Gradient: Vector{x + math.Sin(12*x), -x + math.Sin(12*x), features[1]},
+			Curvature: Vector{1 + rand.Float64(), 1 + rand.Float64(),
+				1 + rand.Float64()},
+		}
+	}
+	constraints := []MonotoneConstraint{
+		{Feature: 0, Param: 0, Direction: 1},
+		{Feature: 0, Param: 1, Direction: -1},
+	}
+	builders := map[string]*Builder{
+		"mse":       {Algorithm: MSEAlgorithm, MaxDepth: 6},
+		"newton":    {Algorithm: NewtonAlgorithm, MaxDepth: 6, LeafL2: 1},
+		"sum":       {Algorithm: SumAlgorithm, MaxDepth: 6},
+		"histogram": {Algorithm: MSEAlgorithm, MaxDepth: 6, HistogramBins: 32},
+		"random":    {Algorithm: MSEAlgorithm, MaxDepth: 6, RandomThresholds: 5},
+		"bestfirst": {Algorithm: MSEAlgorithm, MaxLeaves: 40},
+		"prune":     {Algorithm: MSEAlgorithm, MaxDepth: 6, PruneFrac: 0.3},
+		"oblique":   {Algorithm: MSEAlgorithm, MaxDepth: 6, ObliqueFeatures: 2},
+	}
+	for name, b := range builders {
+		b.MonotoneConstraints = constraints
+		tree := b.build(append([]*GradientSample{}, samples...))
+		if countLeaves(tree) < 4 {
+			t.Errorf("%s: too few leaves: %d", name, countLeaves(tree))
+		}
+		for i := 0; i < 20; i++ {
+			other := rand.Float64()*2 - 1
+			last := tree.Find([]float64{-1, other})
+			for x := -1.0; x <= 1; x += 0.01 {
+				params := tree.Find([]float64{x, other})
+				if params[0] < last[0] || params[1] > last[1] {
+					t.Fatalf("%s: constraint violated at x=%f: %v then %v", name, x,
+						last, params)
+				}
+				last = params
+			}
+		}
+	}
+}
+
+func TestMonotoneTrackerSums(t *testing.T) {
+	// The left side has the smaller mean but the larger
+	// sum, so only mean-based leaves are increasing.
+	var samples []*GradientSample
+	for i := 0; i < 10; i++ {
+		samples = append(samples, &GradientSample{Gradient: Vector{0.5}})
+	}
+	samples = append(samples, &GradientSample{Gradient: Vector{1}})
+
+	for _, algo := range []TreeAlgorithm{MSEAlgorithm, SumAlgorithm, BalancedSumAlgorithm} {
+		b := &Builder{
+			Algorithm:           algo,
+			LeafL2:              1,
+			MonotoneConstraints: []MonotoneConstraint{{Feature: 0, Param: 0, Direction: 1}},
+		}
+		tracker := b.splitTracker(0)
+		tracker.Reset(samples)
+		for _, sample := range samples[:10] {
+			tracker.MoveToLeft(sample)
+		}
+		left := algo.LeafParams(samples[:10], samples, b.LeafL2)
+		right := algo.LeafParams(samples[10:], samples, b.LeafL2)
+		if expected := right[0] >= left[0]; splitAllowed(tracker) != expected {
+			t.Errorf("%s: expected allowed=%v (leaves %f and %f)", algo, expected,
+				left[0], right[0])
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package treeagent
+
+import (
+	"math"
+	"sort"
+
+	"github.com/unixpickle/essentials"
+)
+
+// obliqueSplit finds a split on a weighted sum of
+// features.
+//
+// The gradients are projected onto the direction that
+// separates the two branches of axisSplit.
+// The features most correlated with the projected
+// gradients are then combined, each weighted by its
+// univariate regression slope.
+//
+// It returns nil if fewer than two features are useful.
+func (b *Builder) obliqueSplit(data []*GradientSample, axisSplit *splitInfo,
+	features []int) *splitInfo {
+	leftMean, rightMean := branchMeans(data, axisSplit)
+	direction := leftMean.Sub(rightMean)
+	targets := make([]float64, len(data))
+	var targetMean float64
+	for i, sample := range data {
+		targets[i] = sample.Gradient.Dot(direction)
+		targetMean += targets[i]
+	}
+	targetMean /= totalWeight(data)
+
+	var candidates []obliqueCandidate
+	for _, feature := range features {
+		var mean float64
+		var count float64
+		for _, sample := range data {
+			if x := sample.Feature(feature); !math.IsNaN(x) {
+				w := sample.Weight()
+				mean += w * x
+				count += w
+			}
+		}
+		mean /= count
+		var variance, covariance float64
+		for i, sample := range data {
+			if x := sample.Feature(feature); !math.IsNaN(x) {
+				w := sample.Weight()
+				diff := x - mean
+				variance += w * diff * diff
+				covariance += diff * (targets[i] - w*targetMean)
+			}
+		}
+		if variance == 0 || covariance == 0 {
+			continue
+		}
+		candidates = append(candidates, obliqueCandidate{
+			Feature:     feature,
+			Correlation: math.Abs(covariance) / math.Sqrt(variance),
+			Slope:       covariance / variance,
+		})
+	}
+	if len(candidates) < 2 {
+		return nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Correlation > candidates[j].Correlation
+	})
+	candidates = candidates[:essentials.MinInt(len(candidates), b.ObliqueFeatures)]
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Feature < candidates[j].Feature
+	})
+
+	node := &Tree{
+		ObliqueFeatures: make([]int, len(candidates)),
+		ObliqueWeights:  make([]float64, len(candidates)),
+	}
+	var norm float64
+	for _, c := range candidates {
+		norm += c.Slope * c.Slope
+	}
+	norm = math.Sqrt(norm)
+	for i, c := range candidates {
+		node.ObliqueFeatures[i] = c.Feature
+		node.ObliqueWeights[i] = c.Slope / norm
+	}
+
+	buf := sortBuffers.Get().(*sortBuffer)
+	defer sortBuffers.Put(buf)
+	sorted, vals, missing := buf.sortByValue(data, func(s *GradientSample) float64 {
+		return node.splitValue(s)
+	})
+	res := b.sortedSplit(data, sorted, vals, missing, -1)
+	if res != nil {
+		// Feature is unused by oblique splits.
+		res.Feature = 0
+		res.ObliqueFeatures = node.ObliqueFeatures
+		res.ObliqueWeights = node.ObliqueWeights
+	}
+	return res
+}
+
+// obliqueCandidate is a feature which may be included
+// in an oblique split.
+type obliqueCandidate struct {
+	Feature int
+
+	// Correlation is proportional to the absolute
+	// correlation between the feature and the projected
+	// gradients.
+	Correlation float64
+
+	// Slope is the regression coefficient of the
+	// projected gradients on the feature.
+	Slope float64
+}
+
+// meanGradient computes the weighted mean of the samples'
+// unweighted gradients.
+//
+// If the samples have no weight, the mean is zero.
+func meanGradient(samples []*GradientSample) Vector {
+	return sumToMean(sumGradients(samples), totalWeight(samples))
+}
+
+// branchMeans computes the meanGradient of the samples in
+// each branch of a split.
+func branchMeans(samples []*GradientSample, split *splitInfo) (left, right Vector) {
+	var node Tree
+	split.setBranch(&node)
+	left = make(Vector, len(samples[0].Gradient))
+	right = make(Vector, len(samples[0].Gradient))
+	var leftWeight, rightWeight float64
+	for _, sample := range samples {
+		if node.goesLeft(sample) {
+			left.Add(sample.Gradient)
+			leftWeight += sample.Weight()
+		} else {
+			right.Add(sample.Gradient)
+			rightWeight += sample.Weight()
+		}
+	}
+	return sumToMean(left, leftWeight), sumToMean(right, rightWeight)
+}
+
+// sumToMean divides a sum of gradients by a total weight
+// in place, giving zero if there is no weight.
+func sumToMean(sum Vector, weight float64) Vector {
+	if weight > 0 {
+		return sum.Scale(1 / weight)
+	}
+	return sum.Scale(0)
+}
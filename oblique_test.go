@@ -0,0 +1,107 @@
+package treeagent
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestObliqueSplit(t *testing.T) {
+	samples := diagonalGradientSamples(1000)
+	for _, oblique := range []int{0, 2} {
+		b := &Builder{Algorithm: MSEAlgorithm, MaxDepth: 1, ObliqueFeatures: oblique}
+		tree := b.build(samples)
+		if oblique == 0 {
+			if tree.ObliqueFeatures != nil {
+				t.Fatal("unexpected oblique split")
+			}
+			continue
+		}
+		if !reflect.DeepEqual(tree.ObliqueFeatures, []int{0, 1}) {
+			t.Fatalf("unexpected oblique features: %v", tree.ObliqueFeatures)
+		}
+		var correct int
+		for _, sample := range samples {
+			if tree.FindFeatureSource(sample)[0]*sample.Gradient[0] > 0 {
+				correct++
+			}
+		}
+		if correct < len(samples)*95/100 {
+			t.Errorf("only %d/%d samples classified correctly", correct, len(samples))
+		}
+	}
+}
+
+func TestObliqueForest(t *testing.T) {
+	forest := obliqueForest(benchmarkingForest(20, 4, 5, 2))
+
+	var buf bytes.Buffer
+	if err := WriteForest(&buf, forest); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ReadForest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testForestsEqual(t, forest, decoded)
+
+	compiled := forest.Compile()
+	features := make([]float64, 5*30)
+	for j := range features {
+		features[j] = rand.NormFloat64()
+	}
+	actual := compiled.ApplyBatch(features, 30)
+	for i := 0; i < 30; i++ {
+		expected := forest.Apply(features[i*5 : (i+1)*5])
+		if !reflect.DeepEqual(ActionParams(actual[i*2:(i+1)*2]), expected) {
+			t.Fatalf("sample %d: expected %v but got %v", i, expected,
+				actual[i*2:(i+1)*2])
+		}
+		single := compiled.Apply(features[i*5 : (i+1)*5])
+		if !reflect.DeepEqual(single, expected) {
+			t.Fatalf("sample %d: expected %v but got %v", i, expected, single)
+		}
+	}
+}
+
+// diagonalGradientSamples creates samples whose
+// gradients depend on which side of the line x0+x1=0 the
+// features lie.
+func diagonalGradientSamples(n int) []*GradientSample {
+	samples := make([]*GradientSample, n)
+	for i := range samples {
+		features := []float64{rand.NormFloat64(), rand.NormFloat64(), rand.NormFloat64()}
+		grad := -1.0
+		if features[0]+features[1] > 0 {
+			grad = 1
+		}
+		samples[i] = &GradientSample{
+			Sample:   &memorySample{features: features},
+			Gradient: Vector{grad},
+		}
+	}
+	return samples
+}
+
+// obliqueForest turns every other level of branching
+// nodes in a forest into oblique nodes.
+func obliqueForest(f *Forest) *Forest {
+	var convert func(t *Tree, depth int)
+	convert = func(t *Tree, depth int) {
+		if t.Leaf {
+			return
+		}
+		if depth%2 == 0 {
+			t.ObliqueFeatures = []int{t.Feature, rand.Intn(5)}
+			t.ObliqueWeights = []float64{rand.NormFloat64(), rand.NormFloat64()}
+			t.Feature = 0
+		}
+		convert(t.LessThan, depth+1)
+		convert(t.GreaterEqual, depth+1)
+	}
+	for _, t := range f.Trees {
+		convert(t, 0)
+	}
+	return f
+}
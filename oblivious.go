@@ -0,0 +1,226 @@
+package treeagent
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// buildOblivious builds an oblivious tree, where every
+// node at a given depth uses the same split.
+//
+// Each level's split maximizes the total gain over all
+// of the nodes at that level.
+func (b *Builder) buildOblivious(data []*GradientSample, state *buildState) *Tree {
+	groups := [][]*GradientSample{data}
+	var features []int
+	var thresholds []float64
+	for depth := 0; depth < b.MaxDepth && !state.stopped(); depth++ {
+		split := b.bestObliviousSplit(groups, state, features)
+		if split == nil {
+			break
+		}
+		state.report(len(groups), 0, 0)
+		features = append(features, split.Feature)
+		thresholds = append(thresholds, split.Threshold)
+		var next [][]*GradientSample
+		for _, group := range groups {
+			var left, right []*GradientSample
+			for _, sample := range group {
+				if sample.Feature(split.Feature) < split.Threshold {
+					left = append(left, sample)
+				} else {
+					right = append(right, sample)
+				}
+			}
+			next = append(next, left, right)
+		}
+		groups = next
+	}
+
+	leaves := make([]*Tree, len(groups))
+	for i, group := range groups {
+		if len(group) == 0 {
+			params := make(ActionParams, len(data[0].Gradient))
+			leaves[i] = &Tree{Leaf: true, Params: params}
+		} else {
+			leaves[i] = b.leaf(group, state, nil)
+		}
+		state.report(0, 1, len(group))
+	}
+	return obliviousTree(features, thresholds, leaves)
+}
+
+// bestObliviousSplit finds the best split to apply to
+// every group of samples.
+// It returns nil if no split is possible or if the best
+// split's gain is less than MinGain.
+//
+// The Gain of the result is the total gain for all of
+// the groups, and the other fields are not used.
+func (b *Builder) bestObliviousSplit(groups [][]*GradientSample, state *buildState,
+	path []int) *splitInfo {
+	features := state.ordered(b.featuresToTry(state.AllData[0].NumFeatures(), path))
+	splits := make([]*splitInfo, len(features))
+	featureIndices := make(chan int, len(features))
+	for i := range features {
+		featureIndices <- i
+	}
+	close(featureIndices)
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range featureIndices {
+				splits[i] = b.obliviousFeatureSplit(groups, features[i], state)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var bestSplit *splitInfo
+	for _, split := range splits {
+		if split == nil {
+			continue
+		}
+		if bestSplit == nil || split.Gain > bestSplit.Gain ||
+			(split.Gain == bestSplit.Gain && split.Feature < bestSplit.Feature) {
+			bestSplit = split
+		}
+	}
+	if bestSplit != nil && b.MinGain != 0 && bestSplit.Gain < b.MinGain {
+		return nil
+	}
+	return bestSplit
+}
+
+// obliviousFeatureSplit finds the threshold for a feature
+// which maximizes the total gain for all of the groups.
+//
+// A threshold may not leave any group with fewer than
+// the minimum number of samples on one side, unless that
+// group is not split at all.
+// Missing values always go to the GreaterEqual side.
+func (b *Builder) obliviousFeatureSplit(groups [][]*GradientSample, feature int,
+	state *buildState) *splitInfo {
+	type sortedGroup struct {
+		Samples []*GradientSample
+		Values  []float64
+	}
+	var sortedGroups []sortedGroup
+	var allValues []float64
+	for _, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		sorted, vals, missing := sortByFeature(group, feature)
+		sortedGroups = append(sortedGroups, sortedGroup{
+			Samples: append(sorted, missing...),
+			Values:  vals,
+		})
+		allValues = append(allValues, vals...)
+	}
+
+	var candidates []float64
+	if state.Bins != nil {
+		candidates = state.Bins.Thresholds[feature]
+	} else {
+		sort.Float64s(allValues)
+		for i := 1; i < len(allValues); i++ {
+			if allValues[i] > allValues[i-1] {
+				candidates = append(candidates, (allValues[i]+allValues[i-1])/2)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	gains := make([]float64, len(candidates))
+	valid := make([]bool, len(candidates))
+	invalid := make([]bool, len(candidates))
+	for _, group := range sortedGroups {
+		tracker := b.algorithm().SplitTracker(b.LeafL2)
+		tracker.Reset(group.Samples)
+		minLeaf := b.minLeaf(len(group.Samples))
+		var numLeft int
+		for i, threshold := range candidates {
+			for numLeft < len(group.Values) && group.Values[numLeft] < threshold {
+				tracker.MoveToLeft(group.Samples[numLeft])
+				numLeft++
+			}
+			numRight := len(group.Samples) - numLeft
+			if numLeft == 0 || numRight == 0 {
+				continue
+			} else if numLeft < minLeaf || numRight < minLeaf {
+				invalid[i] = true
+				continue
+			}
+			gains[i] += tracker.Gain()
+			valid[i] = true
+		}
+	}
+
+	var res *splitInfo
+	for i, threshold := range candidates {
+		if valid[i] && !invalid[i] && (res == nil || gains[i] > res.Gain) {
+			res = &splitInfo{Feature: feature, Threshold: threshold, Gain: gains[i]}
+		}
+	}
+	return res
+}
+
+// obliviousTree creates an oblivious tree from its splits
+// and its leaves.
+//
+// The leaves are ordered by their binary indices, where
+// the first split gives the most significant bit and a 1
+// bit means GreaterEqual.
+func obliviousTree(features []int, thresholds []float64, leaves []*Tree) *Tree {
+	if len(features) == 0 {
+		return leaves[0]
+	}
+	half := len(leaves) / 2
+	return &Tree{
+		Feature:      features[0],
+		Threshold:    thresholds[0],
+		LessThan:     obliviousTree(features[1:], thresholds[1:], leaves[:half]),
+		GreaterEqual: obliviousTree(features[1:], thresholds[1:], leaves[half:]),
+	}
+}
+
+// obliviousSplits checks if a tree is oblivious, meaning
+// that it is a complete tree where every node at a given
+// depth has the same simple threshold split.
+//
+// If so, it returns the splits at each depth and the
+// leaves, ordered as for obliviousTree.
+// A tree which is just a leaf is not considered to be
+// oblivious.
+func obliviousSplits(t *Tree) (features []int, thresholds []float64, leaves []*Tree,
+	ok bool) {
+	nodes := []*Tree{t}
+	for !nodes[0].Leaf {
+		first := nodes[0]
+		next := make([]*Tree, 0, len(nodes)*2)
+		for _, node := range nodes {
+			if node.Leaf || len(node.ObliqueFeatures) > 0 || len(node.Categories) > 0 ||
+				node.MissingLeft || node.Feature != first.Feature ||
+				node.Threshold != first.Threshold {
+				return nil, nil, nil, false
+			}
+			next = append(next, node.LessThan, node.GreaterEqual)
+		}
+		features = append(features, first.Feature)
+		thresholds = append(thresholds, first.Threshold)
+		nodes = next
+	}
+	for _, node := range nodes {
+		if !node.Leaf {
+			return nil, nil, nil, false
+		}
+	}
+	return features, thresholds, nodes, len(features) > 0
+}
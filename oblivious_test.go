@@ -0,0 +1,160 @@
+package treeagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestObliviousBuild(t *testing.T) {
+	samples := make([]*GradientSample, 1000)
+	for i := range samples {
+		features := []float64{rand.NormFloat64(), rand.NormFloat64(), rand.NormFloat64()}
+		grad := Vector{features[0], features[1]}
+		if features[2] > 0.5 {
+			grad[0] += 3
+		}
+		samples[i] = &GradientSample{
+			Sample:    &memorySample{features: features},
+			Gradient:  grad,
+			Curvature: Vector{1, 1},
+		}
+	}
+	for _, bins := range []int{0, 16} {
+		b := &Builder{
+			Algorithm:     MSEAlgorithm,
+			MaxDepth:      3,
+			Oblivious:     true,
+			MinLeaf:       5,
+			HistogramBins: bins,
+		}
+		tree := b.build(samples)
+		features, thresholds, leaves, ok := obliviousSplits(tree)
+		if !ok {
+			t.Fatal("tree is not oblivious")
+		}
+		if len(features) != 3 || len(thresholds) != 3 || len(leaves) != 8 {
+			t.Fatalf("unexpected depth: %d", len(features))
+		}
+		if !reflect.DeepEqual(obliviousTree(features, thresholds, leaves), tree) {
+			t.Fatal("tree does not match its splits")
+		}
+	}
+}
+
+func TestObliviousPrune(t *testing.T) {
+	// The second feature is correlated with the first, so
+	// some combinations of splits on them get no samples.
+	makeSamples := func(correlated bool) []*GradientSample {
+		samples := make([]*GradientSample, 500)
+		for i := range samples {
+			a := float64(rand.Intn(2))
+			b := float64(rand.Intn(2))
+			if correlated {
+				b += a
+			}
+			features := []float64{a, b, rand.NormFloat64()}
+			samples[i] = &GradientSample{
+				Sample:   &memorySample{features: features},
+				Gradient: Vector{a + b + features[2]},
+			}
+		}
+		return samples
+	}
+	b := &Builder{
+		Algorithm: MSEAlgorithm,
+		MaxDepth:  4,
+		Oblivious: true,
+		PruneFrac: 0.1,
+		PruneCost: 1e-3,
+	}
+	b.build(makeSamples(true))
+
+	// Held-out samples may reach subtrees which no
+	// training samples reach.
+	b.PruneFrac = 0
+	train := makeSamples(true)
+	tree := b.build(train)
+	heldOut := makeSamples(false)
+	state := &buildState{AllData: train, HeldOut: heldOut,
+		HeldOutWeight: totalWeight(heldOut)}
+	b.prune(tree, train, heldOut, state)
+}
+
+func TestObliviousBestFirst(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic")
+		}
+	}()
+	samples := []*GradientSample{
+		{Sample: &memorySample{features: []float64{1}}, Gradient: Vector{1}},
+		{Sample: &memorySample{features: []float64{2}}, Gradient: Vector{-1}},
+	}
+	b := &Builder{Algorithm: MSEAlgorithm, MaxDepth: 2, MaxLeaves: 4, Oblivious: true}
+	b.build(samples)
+}
+
+func TestObliviousForest(t *testing.T) {
+	forest := NewForest(2)
+	for i := 0; i < 10; i++ {
+		depth := 1 + rand.Intn(4)
+		features := make([]int, depth)
+		thresholds := make([]float64, depth)
+		for j := range features {
+			features[j] = rand.Intn(5)
+			thresholds[j] = rand.NormFloat64()
+		}
+		leaves := make([]*Tree, 1<<uint(depth))
+		for j := range leaves {
+			leaves[j] = benchmarkingTree(0, 5, 2)
+			if j%3 == 0 {
+				leaves[j].LinearFeatures = []int{rand.Intn(5)}
+				leaves[j].LinearCenters = []float64{rand.NormFloat64()}
+				leaves[j].LinearWeights = []ActionParams{{rand.NormFloat64(), 1}}
+			}
+		}
+		forest.Add(obliviousTree(features, thresholds, leaves), rand.Float64())
+		forest.Add(benchmarkingTree(3, 5, 2), rand.Float64())
+	}
+
+	var buf bytes.Buffer
+	if err := WriteForest(&buf, forest); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ReadForest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testForestsEqual(t, forest, decoded)
+
+	data, err := json.Marshal(forest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = ReadForest(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testForestsEqual(t, forest, decoded)
+
+	compiled := forest.Compile()
+	features := make([]float64, 5*30)
+	for j := range features {
+		features[j] = rand.NormFloat64()
+	}
+	actual := compiled.ApplyBatch(features, 30)
+	for i := 0; i < 30; i++ {
+		expected := forest.Apply(features[i*5 : (i+1)*5])
+		single := compiled.Apply(features[i*5 : (i+1)*5])
+		for j, x := range expected {
+			if math.Abs(x-actual[i*2+j]) > 1e-8 || math.Abs(x-single[j]) > 1e-8 {
+				t.Fatalf("sample %d: expected %v but got %v and %v", i, expected,
+					actual[i*2:(i+1)*2], single)
+			}
+		}
+	}
+}
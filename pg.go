@@ -1,6 +1,8 @@
 package treeagent
 
 import (
+	"context"
+
 	"github.com/unixpickle/anydiff"
 	"github.com/unixpickle/anyrl"
 	"github.com/unixpickle/anyrl/anypg"
@@ -18,13 +20,29 @@ type PG struct {
 	// Regularizer, if non-nil, is used to regularize the
 	// action distributions of the policy.
 	Regularizer anypg.Regularizer
+
+	// GOSS, if non-nil, selects the samples for each tree
+	// based on their gradients.
+	// The objective is still measured on every sample.
+	GOSS *GOSS
 }
 
 // Build approximates the policy gradient with a tree.
 // It returns the tree, the surrogate objective, and the
 // regularization term.
 func (p *PG) Build(data []Sample) (step *Tree, obj, reg anyvec.Numeric) {
-	return p.Builder.buildWithTerms(computeObjective(data, nil, p.Objective))
+	step, obj, reg, _ = p.BuildContext(context.Background(), data)
+	return
+}
+
+// BuildContext is like Build, but it stops growing the
+// tree once ctx is done.
+// The tree grown so far is still returned, along with
+// ctx.Err().
+func (p *PG) BuildContext(ctx context.Context, data []Sample) (step *Tree, obj,
+	reg anyvec.Numeric, err error) {
+	objAndReg, gradSamples := p.Builder.computeObjective(data, nil, nil, p.Objective)
+	return p.Builder.buildWithTerms(ctx, objAndReg, gradSamples, p.GOSS, nil)
 }
 
 // Objective implements the policy gradient objective
@@ -1,8 +1,10 @@
 package treeagent
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
+	"reflect"
 	"runtime"
 	"testing"
 
@@ -29,6 +31,125 @@ func TestPGBuildMSE(t *testing.T) {
 	verifyTestingSamplesTree(t, tree)
 }
 
+func TestPGBuildHistogram(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	samples := testingSamples(c, 5000, nil)
+	builder := &PG{
+		Builder: Builder{
+			MaxDepth:      2,
+			Algorithm:     MSEAlgorithm,
+			HistogramBins: 16,
+		},
+		ActionSpace: anyrl.Softmax{},
+	}
+	tree, _, _ := builder.Build(samples)
+	verifyTestingSamplesTree(t, tree)
+}
+
+func TestPGBuildBestFirst(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	samples := testingSamples(c, 5000, nil)
+	builder := &PG{
+		Builder: Builder{
+			MaxLeaves: 4,
+			Algorithm: MSEAlgorithm,
+		},
+		ActionSpace: anyrl.Softmax{},
+	}
+	tree, _, _ := builder.Build(samples)
+	verifyTestingSamplesTree(t, tree)
+}
+
+func TestPGBuildNewton(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	samples := testingSamples(c, 5000, nil)
+	builder := &PG{
+		Builder: Builder{
+			MaxDepth:  2,
+			Algorithm: NewtonAlgorithm,
+		},
+		ActionSpace: anyrl.Softmax{},
+	}
+	tree, _, _ := builder.Build(samples)
+	verifyTestingSamplesTree(t, tree)
+}
+
+func TestSampleCurvatures(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	samples := testingSamples(c, 20, nil)
+	pg := &PG{ActionSpace: anyrl.Softmax{}}
+	_, grads := computeNewtonObjective(samples, nil, nil, pg.Objective)
+	for _, sample := range grads {
+		// For log-softmax, the diagonal of the Hessian is
+		// -p*(1-p) for every parameter.
+		params := vecToFloats(sample.ActionParams())
+		var norm float64
+		for _, x := range params {
+			norm += math.Exp(x)
+		}
+		for i, x := range params {
+			p := math.Exp(x) / norm
+			expected := math.Abs(sample.Advantage()) * p * (1 - p)
+			if math.Abs(sample.Curvature[i]-expected) > 1e-5 {
+				t.Errorf("expected curvature %f but got %f", expected,
+					sample.Curvature[i])
+			}
+		}
+	}
+}
+
+func TestBuildBestFirst(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	samples := benchmarkingSamples(c, 5, 500, false)
+	pg := &PG{ActionSpace: anyrl.Softmax{}}
+	_, grads := computeNewtonObjective(samples, nil, nil, pg.Objective)
+	for _, algo := range TreeAlgorithms {
+		limited := &Builder{Algorithm: algo, MaxLeaves: 5, MinLeaf: 5}
+		if n := countLeaves(limited.build(grads)); n != 5 {
+			t.Errorf("%s: expected 5 leaves but got %d", algo, n)
+		}
+
+		// With enough leaves, every node is split just like
+		// in depth-first growth.
+		depthFirst := &Builder{Algorithm: algo, MaxDepth: 3, MinLeaf: 5}
+		bestFirst := &Builder{Algorithm: algo, MaxDepth: 3, MaxLeaves: 8, MinLeaf: 5}
+		expected := depthFirst.build(grads)
+		actual := bestFirst.build(grads)
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("%s: best-first tree differs from depth-first tree", algo)
+		}
+	}
+}
+
+func TestBuildMinGain(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	samples := benchmarkingSamples(c, 5, 500, false)
+	pg := &PG{ActionSpace: anyrl.Softmax{}}
+	_, grads := computeNewtonObjective(samples, nil, nil, pg.Objective)
+	for _, algo := range TreeAlgorithms {
+		b := &Builder{Algorithm: algo, MaxDepth: 3}
+		split := b.bestSplit(grads, &buildState{AllData: grads}, nil, nil)
+		if split.Gain <= 0 {
+			continue
+		}
+		b.MinGain = split.Gain * 1.001
+		if tree := b.build(grads); !tree.Leaf {
+			t.Errorf("%s: expected leaf with min gain %f", algo, b.MinGain)
+		}
+		b.MinGain = split.Gain / 2
+		if tree := b.build(grads); tree.Leaf {
+			t.Errorf("%s: expected branch with min gain %f", algo, b.MinGain)
+		}
+	}
+}
+
+func countLeaves(t *Tree) int {
+	if t.Leaf {
+		return 1
+	}
+	return countLeaves(t.LessThan) + countLeaves(t.GreaterEqual)
+}
+
 // testingSamples creates a bunch of samples according to
 // a specific set of rules.
 // The observation dimensionality is 2, but the first
@@ -127,6 +248,33 @@ func verifyTestingSamplesTree(t *testing.T, tree *Tree) {
 	}
 }
 
+func TestPGBuildAllocs(t *testing.T) {
+	// The number of allocations should not grow with the
+	// number of samples.
+	c := anyvec64.DefaultCreator{}
+	pg := &PG{ActionSpace: anyrl.Softmax{}}
+	_, small := computeNewtonObjective(benchmarkingSamples(c, 10, 5000, false), nil, nil,
+		pg.Objective)
+	_, large := computeNewtonObjective(benchmarkingSamples(c, 10, 20000, false), nil, nil,
+		pg.Objective)
+	for _, builder := range []Builder{
+		{Algorithm: NewtonAlgorithm, MaxDepth: 4},
+		{Algorithm: NewtonAlgorithm, MaxLeaves: 16},
+		{Algorithm: NewtonAlgorithm, MaxDepth: 4, HistogramBins: 32},
+	} {
+		smallAllocs := testing.AllocsPerRun(2, func() {
+			builder.build(small)
+		})
+		largeAllocs := testing.AllocsPerRun(2, func() {
+			builder.build(large)
+		})
+		if largeAllocs > 2*smallAllocs {
+			t.Errorf("builder %v: allocations went from %f to %f", builder, smallAllocs,
+				largeAllocs)
+		}
+	}
+}
+
 func BenchmarkPGBuild(b *testing.B) {
 	numFeatures := []int{1000, 10}
 	numSamples := []int{100, 5000}
@@ -176,6 +324,158 @@ func benchmarkPGBuild(b *testing.B, numFeatures, numSamples int, byteObs bool) {
 	}
 }
 
+// BenchmarkPGBuildDeep simulates deep trees on a task
+// with few features, where most of the parallelism comes
+// from building subtrees concurrently.
+func BenchmarkPGBuildDeep(b *testing.B) {
+	c := anyvec64.DefaultCreator{}
+	samples := benchmarkingSamples(c, 4, 20000, false)
+	builder := &PG{
+		Builder: Builder{
+			MaxDepth:  10,
+			Algorithm: MSEAlgorithm,
+			MinLeaf:   5,
+		},
+		ActionSpace: anyrl.Softmax{},
+	}
+	for i := 0; i < b.N; i++ {
+		builder.Build(samples)
+	}
+}
+
+func BenchmarkBuildLargeBatch(b *testing.B) {
+	c := anyvec64.DefaultCreator{}
+	samples := benchmarkingSamples(c, 10, 100000, false)
+	pg := &PG{ActionSpace: anyrl.Softmax{}}
+	_, grads := computeNewtonObjective(samples, nil, nil, pg.Objective)
+	builders := []struct {
+		Name    string
+		Builder Builder
+	}{
+		{"Exact", Builder{Algorithm: NewtonAlgorithm, MaxDepth: benchmarkDepth}},
+		{"BestFirst", Builder{Algorithm: NewtonAlgorithm, MaxLeaves: 64}},
+		{"Histogram", Builder{Algorithm: NewtonAlgorithm, MaxDepth: benchmarkDepth,
+			HistogramBins: 64}},
+	}
+	for _, x := range builders {
+		builder := x.Builder
+		b.Run(x.Name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				builder.build(grads)
+			}
+		})
+	}
+}
+
+func BenchmarkPGBuildHistogram(b *testing.B) {
+	numFeatures := []int{1000, 10}
+	numSamples := []int{100, 5000}
+	names := []string{"ManyFeatures", "ManySamples"}
+	byteObs := []bool{false, false}
+
+	if !testing.Short() {
+		numFeatures = append(numFeatures, 9600)
+		numSamples = append(numSamples, 4096)
+		byteObs = append(byteObs, true)
+		names = append(names, "Huge")
+	}
+
+	for i, name := range names {
+		b.Run(name, func(b *testing.B) {
+			benchmarkPGBuildHistogram(b, numFeatures[i], numSamples[i], byteObs[i])
+		})
+	}
+}
+
+func benchmarkPGBuildHistogram(b *testing.B, numFeatures, numSamples int, byteObs bool) {
+	c := anyvec64.DefaultCreator{}
+	samples := benchmarkingSamples(c, numFeatures, numSamples, byteObs)
+	for _, bins := range []int{0, 255, 32} {
+		name := "Exact"
+		if bins != 0 {
+			name = fmt.Sprintf("Bins%d", bins)
+		}
+		b.Run(name, func(b *testing.B) {
+			builder := &PG{
+				Builder: Builder{
+					MaxDepth:      benchmarkDepth,
+					Algorithm:     MSEAlgorithm,
+					HistogramBins: bins,
+				},
+				ActionSpace: anyrl.Softmax{},
+			}
+			var tree *Tree
+			for i := 0; i < b.N; i++ {
+				tree, _, _ = builder.Build(samples)
+			}
+
+			// Report how well the tree matches the gradient,
+			// which measures the accuracy of the splits.
+			_, grads := computeObjective(samples, nil, nil, builder.Objective)
+			b.ReportMetric(treeGradientCosine(tree, grads), "cosine")
+		})
+	}
+}
+
+func BenchmarkPPOBuildPresorted(b *testing.B) {
+	numFeatures := []int{1000, 10}
+	numSamples := []int{100, 5000}
+	names := []string{"ManyFeatures", "ManySamples"}
+	for i, name := range names {
+		b.Run(name, func(b *testing.B) {
+			benchmarkPPOBuildPresorted(b, numFeatures[i], numSamples[i])
+		})
+	}
+}
+
+func benchmarkPPOBuildPresorted(b *testing.B, numFeatures, numSamples int) {
+	c := anyvec64.DefaultCreator{}
+	samples := benchmarkingSamples(c, numFeatures, numSamples, false)
+	for _, cached := range []bool{false, true} {
+		name := "Sort"
+		if cached {
+			name = "Reuse"
+		}
+		b.Run(name, func(b *testing.B) {
+			ppo := &PPO{
+				PG: PG{
+					Builder: Builder{
+						MaxDepth:  benchmarkDepth,
+						Algorithm: MSEAlgorithm,
+					},
+					ActionSpace: anyrl.Softmax{},
+				},
+			}
+			if cached {
+				// Sort the samples before timing starts,
+				// as is done for the first of many PPO
+				// iterations.
+				ppo.Cache = NewSampleCache(samples)
+				ppo.Cache.featureOrder()
+			}
+			gen := rand.New(rand.NewSource(1337))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ppo.Build(MinibatchRand(gen, samples, 0.5), nil)
+			}
+		})
+	}
+}
+
+// treeGradientCosine computes the cosine similarity
+// between a tree's outputs and the sample gradients.
+func treeGradientCosine(t *Tree, samples []*GradientSample) float64 {
+	var dot, outNorm, gradNorm float64
+	for _, sample := range samples {
+		out := Vector(t.FindFeatureSource(sample))
+		dot += out.Dot(sample.Gradient)
+		outNorm += out.Dot(out)
+		gradNorm += sample.Gradient.Dot(sample.Gradient)
+	}
+	return dot / math.Sqrt(outNorm*gradNorm)
+}
+
 func benchmarkingSamples(c anyvec.Creator, numFeatures, numSamples int,
 	byteObs bool) []Sample {
 	var samples []Sample
@@ -1,6 +1,8 @@
 package treeagent
 
 import (
+	"context"
+
 	"github.com/unixpickle/anydiff"
 	"github.com/unixpickle/anyrl/anypg"
 	"github.com/unixpickle/anyvec"
@@ -20,6 +22,17 @@ type PPO struct {
 	//
 	// If 0, anypg.DefaultPPOEpsilon is used.
 	Epsilon float64
+
+	// Cache, if non-nil, is used to avoid re-computing
+	// the outputs of the forest on every call.
+	// It is synced with the forest automatically.
+	// Build also uses it to avoid re-sorting the samples
+	// for every tree.
+	//
+	// The cache is only used when it contains every
+	// sample passed to a method, so it is typically
+	// created once per batch from the full set of samples.
+	Cache *SampleCache
 }
 
 // Build performs a single step of PPO on the samples.
@@ -27,7 +40,18 @@ type PPO struct {
 // It returns a tree approximation of the gradient, the
 // mean objective, and the mean regulizer (or 0).
 func (p *PPO) Build(s []Sample, f *Forest) (step *Tree, obj, reg anyvec.Numeric) {
-	return p.PG.Builder.buildWithTerms(computeObjective(s, f, p.Objective))
+	step, obj, reg, _ = p.BuildContext(context.Background(), s, f)
+	return
+}
+
+// BuildContext is like Build, but it stops growing the
+// tree once ctx is done.
+// The tree grown so far is still returned, along with
+// ctx.Err().
+func (p *PPO) BuildContext(ctx context.Context, s []Sample, f *Forest) (step *Tree,
+	obj, reg anyvec.Numeric, err error) {
+	objAndReg, data := p.PG.Builder.computeObjective(s, f, p.Cache, p.Objective)
+	return p.PG.Builder.buildWithTerms(ctx, objAndReg, data, p.PG.GOSS, p.Cache)
 }
 
 // WeightGradient returns the gradient with respect to the
@@ -38,11 +62,20 @@ func (p *PPO) Build(s []Sample, f *Forest) (step *Tree, obj, reg anyvec.Numeric)
 // number of samples.
 func (p *PPO) WeightGradient(s []Sample, f *Forest) (grad []float64, obj,
 	reg anyvec.Numeric) {
-	grad, rawObj := weightGradient(s, f, p.Objective)
+	grad, rawObj := weightGradient(s, f, p.Cache, p.Objective)
 	obj, reg = splitUpTerms(rawObj, len(s))
 	return
 }
 
+// Improved checks if the forest improves the objective
+// over the policy that originally produced the samples.
+//
+// This is like the package-level Improved, except that
+// it uses p.Cache.
+func (p *PPO) Improved(s []Sample, f *Forest) bool {
+	return improved(s, f, p.Cache, p.Objective)
+}
+
 // Objective computes the  PPO objective concatenated with
 // the regularization (or 0 if no regularization is used).
 func (p *PPO) Objective(params, oldParams, acts, advs anydiff.Res, n int) anydiff.Res {
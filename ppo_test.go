@@ -26,6 +26,93 @@ func TestPPOMSE(t *testing.T) {
 	verifyTestingSamplesTree(t, tree)
 }
 
+func TestPPODeterministic(t *testing.T) {
+	actor1, critic1 := deterministicTraining(t, 1337)
+	actor2, critic2 := deterministicTraining(t, 1337)
+	testForestsEqual(t, actor1, actor2)
+	testForestsEqual(t, critic1, critic2)
+}
+
+// deterministicTraining gathers rollouts and trains a
+// policy and a value function using a seeded random
+// number generator.
+func deterministicTraining(t *testing.T, seed int64) (actor, critic *Forest) {
+	gen := rand.New(rand.NewSource(seed))
+	actor = NewForest(4)
+	critic = NewForest(1)
+	roller := &Roller{
+		Policy:      actor,
+		ActionSpace: anyrl.Softmax{},
+		Rand:        gen,
+	}
+	ppo := &PPO{
+		PG: PG{
+			Builder: Builder{
+				Algorithm:   MSEAlgorithm,
+				MaxDepth:    3,
+				FeatureFrac: 0.5,
+				Rand:        gen,
+			},
+			ActionSpace: anyrl.Softmax{},
+		},
+	}
+	judger := &Judger{
+		ValueFunc:   critic,
+		Discount:    0.9,
+		Lambda:      0.95,
+		MaxDepth:    3,
+		FeatureFrac: 0.5,
+		Rand:        gen,
+	}
+	for i := 0; i < 3; i++ {
+		rollouts, err := roller.Rollout(&deterministicEnv{}, &deterministicEnv{},
+			&deterministicEnv{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		samples := AllSamples(RolloutSamples(rollouts, judger.JudgeActions(rollouts)))
+		ppo.Cache = NewSampleCache(samples)
+		for j := 0; j < 2; j++ {
+			tree, _, _ := ppo.Build(MinibatchRand(gen, samples, 0.5), actor)
+			actor.Add(tree, 0.5)
+		}
+
+		samples = AllSamples(judger.TrainingSamples(rollouts))
+		tree, _ := judger.Train(MinibatchRand(gen, samples, 0.5))
+		critic.Add(tree, judger.OptimalWeight(samples, tree))
+	}
+	return
+}
+
+// deterministicEnv is an environment with four actions
+// which rewards the agent for taking the action that
+// matches the timestep.
+type deterministicEnv struct {
+	timestep int
+}
+
+func (d *deterministicEnv) Reset() ([]float64, error) {
+	d.timestep = 0
+	return []float64{0, -1}, nil
+}
+
+func (d *deterministicEnv) Step(action []float64) ([]float64, float64, bool, error) {
+	var reward float64
+	var choice int
+	for i, x := range action {
+		if x != 0 {
+			choice = i
+		}
+	}
+	if choice == d.timestep%len(action) {
+		reward = 1
+	}
+	d.timestep++
+	obs := []float64{float64(d.timestep), float64(choice)}
+	return obs, reward, d.timestep == 20, nil
+}
+
 // testingRandomForest generates a Forest which is
 // compatible with testingSamples.
 func testingRandomForest() *Forest {
@@ -0,0 +1,301 @@
+package treeagent
+
+import (
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// maxPresortEntries is the maximum number of sample-feature
+// pairs for which samples are presorted.
+//
+// Presorting uses memory proportional to this number, so
+// larger batches are sorted at every node instead.
+// Sorting uses pooled buffers which hold one node's
+// samples, so the memory used for sorting is then
+// proportional to the number of samples times the number
+// of concurrent split searches.
+const maxPresortEntries = 1 << 23
+
+// featureOrder stores the order of a fixed set of samples
+// along every feature.
+//
+// Trees built from subsets of the samples can use it to
+// avoid sorting the samples again.
+type featureOrder struct {
+	// NumSamples is the number of samples.
+	NumSamples int
+
+	// Indices maps each sample to its index, or is nil if
+	// samples should not be looked up.
+	Indices map[Sample]int
+
+	// Sorted stores, for each feature, the indices of the
+	// samples with known values, sorted by value.
+	// Ties are ordered by index.
+	Sorted [][]int32
+
+	// Values stores, for each feature, the values which
+	// correspond to Sorted.
+	Values [][]float64
+
+	// Missing stores, for each feature, the indices of
+	// the samples whose values are missing (NaN).
+	Missing [][]int32
+}
+
+// newFeatureOrder sorts the samples along every feature.
+// The indices map may be nil.
+func newFeatureOrder(samples []Sample, indices map[Sample]int) *featureOrder {
+	numFeatures := samples[0].NumFeatures()
+	res := &featureOrder{
+		NumSamples: len(samples),
+		Indices:    indices,
+		Sorted:     make([][]int32, numFeatures),
+		Values:     make([][]float64, numFeatures),
+		Missing:    make([][]int32, numFeatures),
+	}
+
+	features := make(chan int, numFeatures)
+	for i := 0; i < numFeatures; i++ {
+		features <- i
+	}
+	close(features)
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for feature := range features {
+				sorter := &orderSorter{
+					Indices: make([]int32, 0, len(samples)),
+					Values:  make([]float64, 0, len(samples)),
+				}
+				var missing []int32
+				for i, s := range samples {
+					if val := s.Feature(feature); math.IsNaN(val) {
+						missing = append(missing, int32(i))
+					} else {
+						sorter.Indices = append(sorter.Indices, int32(i))
+						sorter.Values = append(sorter.Values, val)
+					}
+				}
+				sort.Stable(sorter)
+				res.Sorted[feature] = sorter.Indices
+				res.Values[feature] = sorter.Values
+				res.Missing[feature] = missing
+			}
+		}()
+	}
+	wg.Wait()
+
+	return res
+}
+
+// node creates a presortedNode for a subset of the
+// samples, where indices[i] is the index of data[i].
+//
+// It returns nil if a sample appears more than once.
+func (f *featureOrder) node(data []*GradientSample, indices []int) *presortedNode {
+	byIndex := make([]*GradientSample, f.NumSamples)
+	for i, idx := range indices {
+		if byIndex[idx] != nil {
+			return nil
+		}
+		byIndex[idx] = data[i]
+	}
+
+	numFeatures := len(f.Sorted)
+	res := newPresortedNode(numFeatures)
+	res.Scratch = make([]*GradientSample, len(data))
+	res.ScratchValues = make([]float64, len(data))
+
+	// Every feature's arrays are carved out of one buffer
+	// to keep the number of allocations constant.
+	allSamples := make([]*GradientSample, numFeatures*len(data))
+	allValues := make([]float64, numFeatures*len(data))
+	for feature, sorted := range f.Sorted {
+		samples := allSamples[feature*len(data) : feature*len(data)]
+		values := allValues[feature*len(data) : (feature+1)*len(data)]
+		for i, idx := range sorted {
+			if sample := byIndex[idx]; sample != nil {
+				values[len(samples)] = f.Values[feature][i]
+				samples = append(samples, sample)
+			}
+		}
+		res.NumKnown[feature] = len(samples)
+		for _, idx := range f.Missing[feature] {
+			if sample := byIndex[idx]; sample != nil {
+				samples = append(samples, sample)
+			}
+		}
+		res.Samples[feature] = samples
+		res.Values[feature] = values
+	}
+	return res
+}
+
+// presortedNode stores the samples at a node in sorted
+// order along every feature.
+//
+// The nodes of a tree share the same underlying arrays.
+// When a node is split, each feature's samples are
+// partitioned in place and stably, so the children's
+// samples remain sorted without sorting them again.
+type presortedNode struct {
+	// Samples stores, for each feature, the samples with
+	// known values in sorted order, followed by the
+	// samples with missing values.
+	Samples [][]*GradientSample
+
+	// Values stores, for each feature, the values which
+	// correspond to Samples.
+	// Values for missing samples are undefined.
+	Values [][]float64
+
+	// NumKnown stores, for each feature, the number of
+	// samples with known values.
+	NumKnown []int
+
+	// Scratch and ScratchValues are temporary buffers for
+	// partitioning the node.
+	// Like the other arrays, they are shared with the rest
+	// of the tree, so that sibling nodes use disjoint
+	// regions of them.
+	Scratch       []*GradientSample
+	ScratchValues []float64
+}
+
+func newPresortedNode(numFeatures int) *presortedNode {
+	return &presortedNode{
+		Samples:  make([][]*GradientSample, numFeatures),
+		Values:   make([][]float64, numFeatures),
+		NumKnown: make([]int, numFeatures),
+	}
+}
+
+// presort creates the presortedNode for the root of a
+// tree.
+//
+// If order is non-nil and contains every sample exactly
+// once, it is used to avoid sorting the samples.
+func presort(data []*GradientSample, order *featureOrder) *presortedNode {
+	indices := make([]int, len(data))
+	if order != nil && order.Indices != nil {
+		found := true
+		for i, sample := range data {
+			idx, ok := order.Indices[sample.Sample]
+			if !ok {
+				found = false
+				break
+			}
+			indices[i] = idx
+		}
+		if found {
+			if res := order.node(data, indices); res != nil {
+				return res
+			}
+		}
+	}
+	samples := make([]Sample, len(data))
+	for i, sample := range data {
+		samples[i] = sample
+		indices[i] = i
+	}
+	return newFeatureOrder(samples, nil).node(data, indices)
+}
+
+// presortedSplit is like optimalSplit, but it uses the
+// sorted samples of a node.
+func (b *Builder) presortedSplit(data []*GradientSample, node *presortedNode,
+	feature int) *splitInfo {
+	numKnown := node.NumKnown[feature]
+	samples := node.Samples[feature]
+	return b.sortedSplit(data, samples[:numKnown], node.Values[feature][:numKnown],
+		samples[numKnown:], feature)
+}
+
+// partition splits a node into the nodes for the two
+// branches of a split.
+//
+// The samples in the left branch must be marked with the
+// left field beforehand.
+func (p *presortedNode) partition() (left, right *presortedNode) {
+	numFeatures := len(p.Samples)
+	left = newPresortedNode(numFeatures)
+	right = newPresortedNode(numFeatures)
+	for feature, samples := range p.Samples {
+		values := p.Values[feature]
+		numKnown := p.NumKnown[feature]
+		var numLeft, numLeftKnown, numRight int
+		for i, sample := range samples {
+			if sample.left {
+				samples[numLeft] = sample
+				values[numLeft] = values[i]
+				numLeft++
+				if i < numKnown {
+					numLeftKnown++
+				}
+			} else {
+				p.Scratch[numRight] = sample
+				p.ScratchValues[numRight] = values[i]
+				numRight++
+			}
+		}
+		copy(samples[numLeft:], p.Scratch[:numRight])
+		copy(values[numLeft:], p.ScratchValues[:numRight])
+
+		left.Samples[feature] = samples[:numLeft]
+		left.Values[feature] = values[:numLeft]
+		left.NumKnown[feature] = numLeftKnown
+		right.Samples[feature] = samples[numLeft:]
+		right.Values[feature] = values[numLeft:]
+		right.NumKnown[feature] = numKnown - numLeftKnown
+		left.Scratch, right.Scratch = p.Scratch[:numLeft], p.Scratch[numLeft:]
+		left.ScratchValues = p.ScratchValues[:numLeft]
+		right.ScratchValues = p.ScratchValues[numLeft:]
+	}
+	return
+}
+
+// stablePartition moves the samples marked with the left
+// field to the front, preserving the order within each
+// group, and returns the number of marked samples.
+//
+// The scratch buffer must be at least as long as samples.
+func stablePartition(samples, scratch []*GradientSample) int {
+	var numLeft, numRight int
+	for _, sample := range samples {
+		if sample.left {
+			samples[numLeft] = sample
+			numLeft++
+		} else {
+			scratch[numRight] = sample
+			numRight++
+		}
+	}
+	copy(samples[numLeft:], scratch[:numRight])
+	return numLeft
+}
+
+// orderSorter sorts sample indices by their values,
+// keeping the two slices aligned.
+type orderSorter struct {
+	Indices []int32
+	Values  []float64
+}
+
+func (o *orderSorter) Len() int {
+	return len(o.Indices)
+}
+
+func (o *orderSorter) Less(i, j int) bool {
+	return o.Values[i] < o.Values[j]
+}
+
+func (o *orderSorter) Swap(i, j int) {
+	o.Indices[i], o.Indices[j] = o.Indices[j], o.Indices[i]
+	o.Values[i], o.Values[j] = o.Values[j], o.Values[i]
+}
@@ -0,0 +1,105 @@
+package treeagent
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/anyvec/anyvec64"
+)
+
+func TestPresortPartition(t *testing.T) {
+	var data []*GradientSample
+	for i := 0; i < 300; i++ {
+		features := []float64{rand.NormFloat64(), float64(rand.Intn(5)), rand.NormFloat64()}
+		if rand.Intn(5) == 0 {
+			features[2] = math.NaN()
+		}
+		data = append(data, &GradientSample{
+			Sample:   &memorySample{features: features},
+			Gradient: Vector{features[0] + features[1], rand.NormFloat64()},
+		})
+	}
+	b := &Builder{Algorithm: MSEAlgorithm}
+	state := &buildState{AllData: data}
+
+	node := presort(data, nil)
+	for depth := 0; depth < 3; depth++ {
+		split := b.bestSplit(data, state, nil, node)
+		if split == nil {
+			t.Fatal("no split found")
+		}
+		left, right := partitionSplit(data, split, node)
+		for i, child := range []*presortedNode{left, right} {
+			childData := split.LeftSamples
+			if i == 1 {
+				childData = split.RightSamples
+			}
+			for feature := range child.Samples {
+				expected, vals, missing := sortByFeature(childData, feature)
+				numKnown := child.NumKnown[feature]
+				if !reflect.DeepEqual(child.Values[feature][:numKnown], vals) {
+					t.Fatalf("depth %d feature %d: incorrect values", depth, feature)
+				}
+				if !sameSamples(child.Samples[feature][:numKnown], expected) ||
+					!sameSamples(child.Samples[feature][numKnown:], missing) {
+					t.Fatalf("depth %d feature %d: incorrect samples", depth, feature)
+				}
+				for j, sample := range child.Samples[feature][:numKnown] {
+					if sample.Feature(feature) != vals[j] {
+						t.Fatalf("depth %d feature %d: samples out of order", depth,
+							feature)
+					}
+				}
+			}
+		}
+		data, node = split.LeftSamples, left
+		if len(split.RightSamples) > len(data) {
+			data, node = split.RightSamples, right
+		}
+	}
+}
+
+func TestPresortCache(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	samples := benchmarkingSamples(c, 5, 500, false)
+	forest := benchmarkingForest(5, 3, 5, 2)
+	for _, builder := range []Builder{
+		{Algorithm: MSEAlgorithm, MaxDepth: 4},
+		{Algorithm: MSEAlgorithm, MaxLeaves: 10, MinLeaf: 5},
+		{Algorithm: NewtonAlgorithm, MaxDepth: 4, PruneFrac: 0.2},
+	} {
+		builder.Rand = rand.New(rand.NewSource(1337))
+		ppo := &PPO{PG: PG{Builder: builder, ActionSpace: anyrl.Softmax{}}}
+		minibatch := MinibatchRand(rand.New(rand.NewSource(1)), samples, 0.5)
+		expected, _, _ := ppo.Build(minibatch, forest)
+
+		ppo.PG.Builder.Rand = rand.New(rand.NewSource(1337))
+		ppo.Cache = NewSampleCache(samples)
+		actual, _, _ := ppo.Build(minibatch, forest)
+		if !reflect.DeepEqual(actual, expected) {
+			t.Error("cached build differs from uncached build")
+		}
+	}
+}
+
+// sameSamples checks if two lists contain the same
+// samples, ignoring order.
+func sameSamples(s1, s2 []*GradientSample) bool {
+	if len(s1) != len(s2) {
+		return false
+	}
+	counts := map[*GradientSample]int{}
+	for _, s := range s1 {
+		counts[s]++
+	}
+	for _, s := range s2 {
+		counts[s]--
+		if counts[s] < 0 {
+			return false
+		}
+	}
+	return true
+}
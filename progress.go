@@ -0,0 +1,45 @@
+package treeagent
+
+// BuildProgress describes how far a tree build has come.
+type BuildProgress struct {
+	// Splits is the number of nodes which have been split.
+	Splits int
+
+	// Leaves is the number of finished leaves.
+	//
+	// During best-first growth, leaves are only finished
+	// once the tree stops growing.
+	Leaves int
+
+	// Samples is the number of training samples in the
+	// finished leaves.
+	Samples int
+
+	// TotalSamples is the number of training samples,
+	// excluding held-out samples.
+	TotalSamples int
+}
+
+// stopped checks if the tree should stop growing.
+func (b *buildState) stopped() bool {
+	select {
+	case <-b.Done:
+		return true
+	default:
+		return false
+	}
+}
+
+// report records newly finished nodes and passes the
+// progress to the callback, if there is one.
+func (b *buildState) report(splits, leaves, samples int) {
+	if b.Progress == nil {
+		return
+	}
+	b.progressLock.Lock()
+	defer b.progressLock.Unlock()
+	b.progress.Splits += splits
+	b.progress.Leaves += leaves
+	b.progress.Samples += samples
+	b.Progress(b.progress)
+}
@@ -0,0 +1,127 @@
+package treeagent
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/anyvec/anyvec64"
+)
+
+func TestBuildProgress(t *testing.T) {
+	data := progressTestSamples()
+	for name, b := range map[string]Builder{
+		"depth":     {Algorithm: MSEAlgorithm, MaxDepth: 6},
+		"bestfirst": {Algorithm: MSEAlgorithm, MaxLeaves: 20},
+		"oblivious": {Algorithm: MSEAlgorithm, MaxDepth: 4, Oblivious: true},
+	} {
+		var last BuildProgress
+		var calls int
+		b.Progress = func(p BuildProgress) {
+			if p.Splits < last.Splits || p.Leaves < last.Leaves || p.Samples < last.Samples {
+				t.Errorf("%s: progress went backwards", name)
+			}
+			last = p
+			calls++
+		}
+		tree := b.build(append([]*GradientSample{}, data...))
+		leaves := countLeaves(tree)
+		if last.Leaves != leaves || last.Splits != leaves-1 {
+			t.Errorf("%s: expected %d leaves and %d splits but got %d and %d", name,
+				leaves, leaves-1, last.Leaves, last.Splits)
+		}
+		if last.Samples != len(data) || last.TotalSamples != len(data) {
+			t.Errorf("%s: expected %d samples but got %d/%d", name, len(data),
+				last.Samples, last.TotalSamples)
+		}
+		if calls != 2*leaves-1 && !b.Oblivious {
+			t.Errorf("%s: expected %d calls but got %d", name, 2*leaves-1, calls)
+		}
+	}
+}
+
+func TestBuildContextCancel(t *testing.T) {
+	data := progressTestSamples()
+	full := countLeaves((&Builder{Algorithm: MSEAlgorithm, MaxDepth: 10}).build(
+		append([]*GradientSample{}, data...)))
+	for _, maxLeaves := range []int{0, 500} {
+		ctx, cancel := context.WithCancel(context.Background())
+		b := &Builder{
+			Algorithm: MSEAlgorithm,
+			MaxDepth:  10,
+			MaxLeaves: maxLeaves,
+			Progress: func(p BuildProgress) {
+				if p.Splits == 3 {
+					cancel()
+				}
+			},
+		}
+		tree, err := b.buildContext(ctx, append([]*GradientSample{}, data...), nil)
+		if err != context.Canceled {
+			t.Errorf("leaves %d: unexpected error: %v", maxLeaves, err)
+		}
+		if leaves := countLeaves(tree); leaves >= full/4 {
+			t.Errorf("leaves %d: tree has %d leaves (full tree has %d)", maxLeaves, leaves,
+				full)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pg := &PG{
+		Builder:     Builder{MaxDepth: 4},
+		ActionSpace: anyrl.Softmax{},
+	}
+	samples := benchmarkingSamples(anyvec64.DefaultCreator{}, 5, 100, false)
+	tree, _, _, err := pg.BuildContext(ctx, samples)
+	if err != context.Canceled {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !tree.Leaf {
+		t.Error("expected a single leaf")
+	}
+
+	judger := &Judger{ValueFunc: NewForest(1), MaxDepth: 4}
+	tree, _, err = judger.TrainContext(ctx, samples)
+	if err != context.Canceled {
+		t.Errorf("judger: unexpected error: %v", err)
+	}
+	if !tree.Leaf {
+		t.Error("judger: expected a single leaf")
+	}
+}
+
+func TestBuildTimeLimit(t *testing.T) {
+	data := progressTestSamples()
+	b := &Builder{
+		Algorithm: MSEAlgorithm,
+		MaxDepth:  10,
+		TimeLimit: time.Millisecond * 50,
+		Progress: func(p BuildProgress) {
+			time.Sleep(time.Millisecond * 10)
+		},
+	}
+	tree, err := b.buildContext(context.Background(), data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaves := countLeaves(tree); leaves > 50 {
+		t.Errorf("too many leaves: %d", leaves)
+	}
+}
+
+func progressTestSamples() []*GradientSample {
+	gen := rand.New(rand.NewSource(1337))
+	samples := make([]*GradientSample, 2000)
+	for i := range samples {
+		features := []float64{gen.NormFloat64(), gen.NormFloat64()}
+		samples[i] = &GradientSample{
+			Sample:   &memorySample{features: features},
+			Gradient: Vector{math.Sin(3*features[0]) + features[1], gen.NormFloat64()},
+		}
+	}
+	return samples
+}
@@ -0,0 +1,95 @@
+package treeagent
+
+import "math"
+
+// holdOut splits the samples into training samples and
+// held-out samples for pruning.
+func (b *Builder) holdOut(samples []*GradientSample) (train, heldOut []*GradientSample) {
+	if b.PruneFrac < 0 || b.PruneFrac >= 1 {
+		panic("prune fraction out of range")
+	}
+	numHeldOut := int(math.Ceil(b.PruneFrac * float64(len(samples))))
+	if numHeldOut >= len(samples) {
+		// Always leave at least one training sample.
+		numHeldOut = len(samples) - 1
+	}
+	for i, j := range randPerm(b.Rand, len(samples)) {
+		if i < numHeldOut {
+			heldOut = append(heldOut, samples[j])
+		} else {
+			train = append(train, samples[j])
+		}
+	}
+	return
+}
+
+// prune collapses the subtrees of t which do not improve
+// the objective on the held-out samples by more than
+// PruneCost per extra leaf.
+//
+// Subtrees which no held-out weight reaches are kept,
+// since there is no evidence against them, and collapsing
+// them would discard structure supported by the training
+// samples.
+//
+// Subtrees which no training samples reach (e.g. in
+// oblivious trees) are also kept, since there would be
+// no samples to compute a collapsed leaf from.
+//
+// The train argument contains the training samples which
+// reach t, and is used to compute the parameters of the
+// collapsed leaves.
+// Both sets of samples are reordered in place.
+//
+// Along with the pruned tree, prune returns the tree's
+// score on the held-out samples and its number of leaves.
+func (b *Builder) prune(t *Tree, train, heldOut []*GradientSample,
+	state *buildState) (pruned *Tree, score float64, leaves int) {
+	if t.Leaf {
+		return t, pruneScore(t, heldOut, state), 1
+	}
+
+	leftTrain, rightTrain := partitionSamples(t, train)
+	leftHeldOut, rightHeldOut := partitionSamples(t, heldOut)
+	left, leftScore, leftLeaves := b.prune(t.LessThan, leftTrain, leftHeldOut, state)
+	right, rightScore, rightLeaves := b.prune(t.GreaterEqual, rightTrain, rightHeldOut,
+		state)
+	pruned = t.branchCopy(left, right)
+	score = leftScore + rightScore
+	leaves = leftLeaves + rightLeaves
+	if len(train) == 0 || totalWeight(heldOut) == 0 {
+		return
+	}
+
+	collapsed := b.leaf(train, state, nil)
+	if len(b.MonotoneConstraints) > 0 {
+		clampToSubtree(collapsed, pruned)
+	}
+	collapsedScore := pruneScore(collapsed, heldOut, state)
+	if score-collapsedScore <= b.PruneCost*float64(leaves-1) {
+		return collapsed, collapsedScore, 1
+	}
+	return
+}
+
+// pruneScore estimates how much a leaf improves the
+// objective on the held-out samples which reach it.
+//
+// The estimate uses a second-order approximation when
+// samples have curvatures, and a first-order one
+// otherwise.
+// It is normalized by the total weight of the held-out
+// samples.
+func pruneScore(leaf *Tree, heldOut []*GradientSample, state *buildState) float64 {
+	var sum float64
+	for _, sample := range heldOut {
+		params := Vector(leaf.leafParams(sample))
+		sum += sample.Gradient.Dot(params)
+		if sample.Curvature != nil {
+			for i, c := range sample.Curvature {
+				sum -= c * params[i] * params[i] / 2
+			}
+		}
+	}
+	return sum / state.HeldOutWeight
+}
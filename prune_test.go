@@ -0,0 +1,78 @@
+package treeagent
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/anyvec/anyvec64"
+)
+
+func TestPGBuildPrune(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	samples := testingSamples(c, 5000, nil)
+	pg := &PG{
+		Builder: Builder{
+			MaxDepth:  8,
+			Algorithm: MSEAlgorithm,
+			MinLeaf:   20,
+		},
+		ActionSpace: anyrl.Softmax{},
+	}
+	unpruned, _, _ := pg.Build(samples)
+
+	pg.Builder.PruneFrac = 0.3
+	pruned, _, _ := pg.Build(samples)
+	verifyTestingSamplesTree(t, pruned)
+
+	if countLeaves(pruned) >= countLeaves(unpruned) {
+		t.Errorf("pruning did not remove leaves (%d >= %d)", countLeaves(pruned),
+			countLeaves(unpruned))
+	}
+}
+
+func TestPruneHeldOut(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	samples := testingSamples(c, 1000, nil)
+	pg := &PG{ActionSpace: anyrl.Softmax{}}
+	_, train := computeObjective(samples, nil, nil, pg.Objective)
+	_, heldOut := computeObjective(samples, nil, nil, pg.Objective)
+
+	b := &Builder{Algorithm: MSEAlgorithm, MaxDepth: 4}
+	tree := b.build(train)
+
+	// When the held-out samples agree with the training
+	// samples, there is nothing to prune.
+	state := &buildState{AllData: train, HeldOut: heldOut,
+		HeldOutWeight: totalWeight(heldOut)}
+	pruned, _, _ := b.prune(tree, train, heldOut, state)
+	if countLeaves(pruned) != countLeaves(tree) {
+		t.Errorf("expected %d leaves but got %d", countLeaves(tree), countLeaves(pruned))
+	}
+
+	// When the held-out gradients are reversed, every
+	// split hurts the held-out objective.
+	for _, sample := range heldOut {
+		sample.Gradient.Scale(-1)
+	}
+	pruned, _, _ = b.prune(tree, train, heldOut, state)
+	if !pruned.Leaf {
+		t.Error("expected tree to be pruned to a leaf")
+	}
+
+	// With a large cost, no splits are worthwhile.
+	for _, sample := range heldOut {
+		sample.Gradient.Scale(-1)
+	}
+	b.PruneCost = 1e10
+	pruned, _, _ = b.prune(tree, train, heldOut, state)
+	if !pruned.Leaf {
+		t.Error("expected tree to be pruned to a leaf")
+	}
+
+	// Subtrees without held-out samples are kept, even
+	// with a large cost.
+	pruned, _, _ = b.prune(tree, train, nil, state)
+	if countLeaves(pruned) != countLeaves(tree) {
+		t.Errorf("expected %d leaves but got %d", countLeaves(tree), countLeaves(pruned))
+	}
+}
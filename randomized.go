@@ -0,0 +1,70 @@
+package treeagent
+
+import (
+	"math"
+	"sort"
+)
+
+// randomizedSplit finds the best of several random
+// thresholds for a feature, as in Extremely Randomized
+// Trees.
+// It returns nil if no split is effective.
+//
+// Each uniform, which should be in [0, 1), places one
+// threshold between the minimum and maximum known values
+// of the feature.
+// Missing values are tried in both branches.
+func (b *Builder) randomizedSplit(samples []*GradientSample, feature int,
+	uniforms []float64) *splitInfo {
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, sample := range samples {
+		x := sample.Feature(feature)
+		if x < min {
+			min = x
+		}
+		if x > max {
+			max = x
+		}
+	}
+	if min > max {
+		// Every value is missing.
+		return nil
+	}
+
+	var thresholds []float64
+	if min < max {
+		thresholds = make([]float64, len(uniforms))
+		for i, u := range uniforms {
+			// Thresholds are in (min, max], so that both
+			// branches get known values.
+			thresholds[i] = max - u*(max-min)
+		}
+		sort.Float64s(thresholds)
+	}
+
+	return b.binnedSplit(samples, feature, thresholds, min, func(i int) int {
+		x := samples[i].Feature(feature)
+		if math.IsNaN(x) {
+			return len(thresholds) + 1
+		}
+		return sort.Search(len(thresholds), func(j int) bool {
+			return thresholds[j] > x
+		})
+	})
+}
+
+// randomUniforms draws the uniforms for randomizedSplit
+// for each of the features.
+func (b *Builder) randomUniforms(numFeatures int) [][]float64 {
+	if b.RandomThresholds < 0 {
+		panic("random thresholds out of range")
+	}
+	res := make([][]float64, numFeatures)
+	for i := range res {
+		res[i] = make([]float64, b.RandomThresholds)
+		for j := range res[i] {
+			res[i][j] = randFloat(b.Rand)
+		}
+	}
+	return res
+}
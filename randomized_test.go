@@ -0,0 +1,78 @@
+package treeagent
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestRandomizedSplit(t *testing.T) {
+	samples := make([]*GradientSample, 1000)
+	for i := range samples {
+		x := rand.Float64()*4 - 2
+		if i%10 == 0 {
+			x = math.NaN()
+		}
+		grad := Vector{1, 0}
+		if x < 0.5 || math.IsNaN(x) {
+			grad[0] = -1
+		}
+		samples[i] = &GradientSample{
+			Sample:    &memorySample{features: []float64{rand.NormFloat64(), x}},
+			Gradient:  grad,
+			Curvature: Vector{1, 1},
+		}
+	}
+	b := &Builder{
+		Algorithm:        MSEAlgorithm,
+		MaxDepth:         1,
+		RandomThresholds: 50,
+		Rand:             rand.New(rand.NewSource(1337)),
+	}
+	tree := b.build(samples)
+	if tree.Leaf || tree.Feature != 1 {
+		t.Fatal("expected split on feature 1")
+	}
+	if math.Abs(tree.Threshold-0.5) > 0.2 {
+		t.Errorf("unexpected threshold: %f", tree.Threshold)
+	}
+	if !tree.MissingLeft {
+		t.Error("missing values should go left")
+	}
+	var correct int
+	for _, sample := range samples {
+		if tree.FindFeatureSource(sample)[0]*sample.Gradient[0] > 0 {
+			correct++
+		}
+	}
+	if correct < len(samples)*95/100 {
+		t.Errorf("only %d/%d samples classified correctly", correct, len(samples))
+	}
+
+	// Thresholds should be reproducible from the seed.
+	b.Rand = rand.New(rand.NewSource(1337))
+	if other := b.build(samples); other.Threshold != tree.Threshold {
+		t.Errorf("expected threshold %f but got %f", tree.Threshold, other.Threshold)
+	}
+}
+
+func TestRandomizedConstantFeature(t *testing.T) {
+	samples := make([]*GradientSample, 100)
+	for i := range samples {
+		x := 3.0
+		grad := Vector{1}
+		if i%2 == 0 {
+			x = math.NaN()
+			grad[0] = -1
+		}
+		samples[i] = &GradientSample{
+			Sample:   &memorySample{features: []float64{x}},
+			Gradient: grad,
+		}
+	}
+	b := &Builder{Algorithm: MSEAlgorithm, MaxDepth: 1, RandomThresholds: 5}
+	tree := b.build(samples)
+	if tree.Leaf || !tree.MissingLeft || tree.Threshold != 3 {
+		t.Fatal("expected split between missing and known values")
+	}
+}
@@ -1,6 +1,10 @@
 package treeagent
 
 import (
+	"errors"
+	"math"
+	"math/rand"
+
 	"github.com/unixpickle/anydiff"
 	"github.com/unixpickle/anynet/anyrnn"
 	"github.com/unixpickle/anyrl"
@@ -18,6 +22,16 @@ type Roller struct {
 	// ActionSpace produces actions from parameters.
 	ActionSpace anyrl.Sampler
 
+	// Rand, if non-nil, is used to sample actions.
+	// This makes rollouts reproducible, provided that the
+	// environments are deterministic.
+	//
+	// When Rand is set, ActionSpace must support seeded
+	// sampling, as reported by CanSampleRand.
+	// A Roller with a Rand should not be used from more
+	// than one goroutine at once.
+	Rand *rand.Rand
+
 	// These functions are called to produce tapes when
 	// building a RolloutSet.
 	//
@@ -32,6 +46,10 @@ type Roller struct {
 
 // Rollout produces a rollout per environment.
 func (r *Roller) Rollout(envs ...anyrl.Env) (*anyrl.RolloutSet, error) {
+	if r.Rand != nil && !CanSampleRand(r.ActionSpace) {
+		return nil, essentials.AddCtx("rollout tree",
+			errors.New("action space does not support seeded sampling"))
+	}
 	res, err := r.rnnRoller().Rollout(envs...)
 	return res, essentials.AddCtx("rollout tree", err)
 }
@@ -56,9 +74,87 @@ func (r *Roller) rnnRoller() *anyrl.RNNRoller {
 				return anydiff.NewConst(r.Creator().MakeVector(0))
 			},
 		},
-		ActionSpace:      r.ActionSpace,
+		ActionSpace:      r.actionSpace(),
 		MakeInputTape:    r.MakeInputTape,
 		MakeActionTape:   r.MakeActionTape,
 		MakeAgentOutTape: r.MakeAgentOutTape,
 	}
 }
+
+func (r *Roller) actionSpace() anyrl.Sampler {
+	if r.Rand == nil {
+		return r.ActionSpace
+	}
+	return &randSampler{Sampler: r.ActionSpace, Rand: r.Rand}
+}
+
+// A RandSampler is an anyrl.Sampler which can sample from
+// an explicit source of randomness.
+type RandSampler interface {
+	anyrl.Sampler
+
+	SampleRand(gen *rand.Rand, params anyvec.Vector, batch int) anyvec.Vector
+}
+
+// CanSampleRand checks if an action space supports
+// seeded sampling, i.e. if it can be used by a Roller
+// with a Rand.
+//
+// This is true for anyrl.Softmax and for RandSamplers.
+func CanSampleRand(s anyrl.Sampler) bool {
+	switch s.(type) {
+	case RandSampler, anyrl.Softmax, *anyrl.Softmax:
+		return true
+	default:
+		return false
+	}
+}
+
+// randSampler wraps an anyrl.Sampler to use a specific
+// source of randomness.
+type randSampler struct {
+	anyrl.Sampler
+	Rand *rand.Rand
+}
+
+func (r *randSampler) Sample(params anyvec.Vector, batch int) anyvec.Vector {
+	switch s := r.Sampler.(type) {
+	case RandSampler:
+		return s.SampleRand(r.Rand, params, batch)
+	case anyrl.Softmax, *anyrl.Softmax:
+		return sampleSoftmax(r.Rand, params, batch)
+	default:
+		panic("action space does not support seeded sampling")
+	}
+}
+
+// sampleSoftmax samples one-hot vectors from a batch of
+// softmax distributions.
+func sampleSoftmax(gen *rand.Rand, params anyvec.Vector, batch int) anyvec.Vector {
+	logits := vecToFloats(params)
+	size := len(logits) / batch
+	res := make([]float64, len(logits))
+	for i := 0; i < batch; i++ {
+		subLogits := logits[i*size : (i+1)*size]
+		max := math.Inf(-1)
+		for _, x := range subLogits {
+			max = math.Max(max, x)
+		}
+		var sum float64
+		for _, x := range subLogits {
+			sum += math.Exp(x - max)
+		}
+		target := gen.Float64() * sum
+		choice := size - 1
+		for j, x := range subLogits {
+			target -= math.Exp(x - max)
+			if target < 0 {
+				choice = j
+				break
+			}
+		}
+		res[i*size+choice] = 1
+	}
+	c := params.Creator()
+	return c.MakeVectorData(c.MakeNumericList(res))
+}
@@ -0,0 +1,48 @@
+package treeagent
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/anyvec/anyvec64"
+)
+
+func TestRandSamplerSoftmax(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	logits := []float64{0, math.Log(2), math.Log(3), 0, 0, 1}
+	batch := 10000
+	var params []float64
+	for i := 0; i < batch; i++ {
+		params = append(params, logits...)
+	}
+	paramVec := c.MakeVectorData(c.MakeNumericList(params))
+
+	sample := func(seed int64) []float64 {
+		sampler := &randSampler{
+			Sampler: anyrl.Softmax{},
+			Rand:    rand.New(rand.NewSource(seed)),
+		}
+		return vecToFloats(sampler.Sample(paramVec, batch*2))
+	}
+
+	actions := sample(1337)
+	if !reflect.DeepEqual(actions, sample(1337)) {
+		t.Fatal("same seed gave different actions")
+	}
+
+	counts := make([]float64, 3)
+	for i := 0; i < len(actions); i += 6 {
+		for j := range counts {
+			counts[j] += actions[i+j]
+		}
+	}
+	for i, count := range counts {
+		expected := float64(i+1) / 6
+		if actual := count / float64(batch); math.Abs(actual-expected) > 0.02 {
+			t.Errorf("action %d: expected frequency %f but got %f", i, expected, actual)
+		}
+	}
+}
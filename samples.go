@@ -25,6 +25,42 @@ type Sample interface {
 	Advantage() float64
 }
 
+// A WeightedSample is a Sample with an importance weight,
+// e.g. to down-weight stale or duplicated samples.
+//
+// A sample's weight scales its contribution to the
+// objective's gradient, and thus to the trees, the leaf
+// values, and the gradients of tree weights.
+// Means over samples, such as leaf values and weight
+// gradients, become weighted means.
+// Objective values are not weighted, since an
+// ObjectiveFunc only produces sums over samples.
+//
+// Samples which do not implement WeightedSample have a
+// weight of 1.
+type WeightedSample interface {
+	Sample
+	Weight() float64
+}
+
+// SampleWeight returns the weight of a sample, which is 1
+// unless the sample is a WeightedSample.
+func SampleWeight(s Sample) float64 {
+	if w, ok := s.(WeightedSample); ok {
+		return w.Weight()
+	}
+	return 1
+}
+
+// NewWeightedSample creates a WeightedSample which has
+// the given weight and is otherwise identical to s.
+func NewWeightedSample(s Sample, weight float64) WeightedSample {
+	if w, ok := s.(*weightedSample); ok {
+		s = w.Sample
+	}
+	return &weightedSample{Sample: s, weight: weight}
+}
+
 // RolloutSamples produces a stream of Samples based on
 // the batch of rollouts.
 // The advantages can come from an anypg.ActionJudger.
@@ -37,6 +73,17 @@ type Sample interface {
 // The caller must read the entire channel to prevent a
 // resource leak.
 func RolloutSamples(r *anyrl.RolloutSet, advantages anyrl.Rewards) <-chan Sample {
+	return WeightedRolloutSamples(r, advantages, nil)
+}
+
+// WeightedRolloutSamples is like RolloutSamples, but the
+// samples are WeightedSamples whose weights come from the
+// corresponding entries of weights.
+//
+// If weights is nil, this is equivalent to
+// RolloutSamples.
+func WeightedRolloutSamples(r *anyrl.RolloutSet, advantages,
+	weights anyrl.Rewards) <-chan Sample {
 	res := make(chan Sample, 1)
 	go func() {
 		defer close(res)
@@ -61,12 +108,16 @@ func RolloutSamples(r *anyrl.RolloutSet, advantages anyrl.Rewards) <-chan Sample
 				subIns := inValues[i*numFeatures : (i+1)*numFeatures]
 				subActs := actions.Packed.Slice(i*actSize, (i+1)*actSize)
 				subOuts := outputs.Packed.Slice(i*outSize, (i+1)*outSize)
-				res <- &memorySample{
+				var sample Sample = &memorySample{
 					features:     subIns,
 					action:       subActs,
 					actionParams: subOuts,
 					advantage:    advantages[lane][timestep],
 				}
+				if weights != nil {
+					sample = NewWeightedSample(sample, weights[lane][timestep])
+				}
+				res <- sample
 				i++
 			}
 			timestep++
@@ -83,6 +134,7 @@ func RolloutSamples(r *anyrl.RolloutSet, advantages anyrl.Rewards) <-chan Sample
 //
 // You should only use this if you know that the features
 // are 8-bit integers.
+// Sample weights are preserved.
 //
 // The caller must read the entire channel to prevent a
 // resource leak.
@@ -93,7 +145,11 @@ func Uint8Samples(incoming <-chan Sample) <-chan Sample {
 	go func() {
 		defer close(res)
 		for in := range incoming {
-			res <- newUint8Sample(in)
+			if w, ok := in.(WeightedSample); ok {
+				res <- NewWeightedSample(newUint8Sample(in), w.Weight())
+			} else {
+				res <- newUint8Sample(in)
+			}
 		}
 	}()
 	return res
@@ -110,18 +166,68 @@ func AllSamples(ch <-chan Sample) []Sample {
 }
 
 // Minibatch selects a random fraction of the samples.
+//
+// Samples with a weight of 0 are never selected, since
+// they would not contribute to training.
+// The selected samples keep their weights.
 func Minibatch(samples []Sample, frac float64) []Sample {
+	return MinibatchRand(nil, samples, frac)
+}
+
+// MinibatchRand is like Minibatch, but it uses gen as the
+// source of randomness.
+//
+// If gen is nil, the global source from math/rand is
+// used.
+func MinibatchRand(gen *rand.Rand, samples []Sample, frac float64) []Sample {
+	samples = nonzeroWeights(samples)
 	count := int(math.Ceil(float64(len(samples)) * frac))
 	if count == 0 {
 		count = len(samples)
 	}
 	res := make([]Sample, count)
-	for i, j := range rand.Perm(len(samples))[:count] {
+	for i, j := range randPerm(gen, len(samples))[:count] {
 		res[i] = samples[j]
 	}
 	return res
 }
 
+// nonzeroWeights filters out samples with zero weight.
+// It returns the original slice if no samples are removed.
+func nonzeroWeights(samples []Sample) []Sample {
+	for i, s := range samples {
+		if SampleWeight(s) != 0 {
+			continue
+		}
+		res := append([]Sample{}, samples[:i]...)
+		for _, s := range samples[i+1:] {
+			if SampleWeight(s) != 0 {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return samples
+}
+
+// randPerm is like rand.Perm, but it uses gen if it is
+// non-nil.
+func randPerm(gen *rand.Rand, n int) []int {
+	if gen == nil {
+		return rand.Perm(n)
+	}
+	return gen.Perm(n)
+}
+
+// randFloat is like rand.Float64, but it uses gen if it
+// is non-nil.
+func randFloat(gen *rand.Rand) float64 {
+	if gen == nil {
+		return rand.Float64()
+	}
+	return gen.Float64()
+}
+
 type memorySample struct {
 	features     []float64
 	action       anyvec.Vector
@@ -149,6 +255,15 @@ func (m *memorySample) Advantage() float64 {
 	return m.advantage
 }
 
+type weightedSample struct {
+	Sample
+	weight float64
+}
+
+func (w *weightedSample) Weight() float64 {
+	return w.weight
+}
+
 type uint8Sample struct {
 	features     []uint8
 	action       anyvec.Vector
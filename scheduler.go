@@ -0,0 +1,158 @@
+package treeagent
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/unixpickle/essentials"
+)
+
+const (
+	// minForkSamples is the minimum number of samples in
+	// a subtree for it to be built concurrently with its
+	// sibling.
+	minForkSamples = 128
+
+	// splitWorkPerGoroutine is the number of sample-feature
+	// pairs which justifies an extra goroutine when
+	// searching for a node's split.
+	splitWorkPerGoroutine = 1 << 13
+)
+
+// A buildScheduler builds independent subtrees of a tree
+// concurrently on a fixed pool of workers.
+//
+// Forked work goes into a shared queue, from which idle
+// workers steal it.
+// A goroutine which joins forked work that has not been
+// stolen does the work itself, and while it waits for
+// stolen work to finish, it runs other queued work.
+//
+// A nil *buildScheduler runs all work inline.
+type buildScheduler struct {
+	queue chan *buildTask
+	wg    sync.WaitGroup
+}
+
+// newBuildScheduler creates a scheduler with the given
+// number of workers, in addition to the goroutine that
+// starts the build.
+//
+// It returns nil if there are no workers.
+func newBuildScheduler(workers int) *buildScheduler {
+	if workers < 1 {
+		return nil
+	}
+	res := &buildScheduler{queue: make(chan *buildTask, workers*4)}
+	for i := 0; i < workers; i++ {
+		res.wg.Add(1)
+		go func() {
+			defer res.wg.Done()
+			for task := range res.queue {
+				task.tryRun()
+			}
+		}()
+	}
+	return res
+}
+
+// Fork queues a function to run concurrently with the
+// caller.
+// If the queue is full, the function is run immediately.
+//
+// The result must be passed to Join.
+func (b *buildScheduler) Fork(f func()) *buildTask {
+	task := &buildTask{run: f, done: make(chan struct{})}
+	if b != nil {
+		select {
+		case b.queue <- task:
+			return task
+		default:
+		}
+	}
+	task.tryRun()
+	return task
+}
+
+// Join waits for a forked function to finish.
+// If the function panicked, Join panics with the same
+// value.
+func (b *buildScheduler) Join(t *buildTask) {
+	if !t.tryRun() {
+		var queue chan *buildTask
+		if b != nil {
+			queue = b.queue
+		}
+		for waiting := true; waiting; {
+			select {
+			case <-t.done:
+				waiting = false
+			case other := <-queue:
+				other.tryRun()
+			}
+		}
+	}
+	if t.panicked {
+		panic(t.panicValue)
+	}
+}
+
+// Close stops the workers.
+// No work may be forked afterwards.
+func (b *buildScheduler) Close() {
+	if b != nil {
+		close(b.queue)
+		b.wg.Wait()
+	}
+}
+
+// buildTask is a unit of forked work.
+type buildTask struct {
+	run     func()
+	claimed int32
+	done    chan struct{}
+
+	panicked   bool
+	panicValue interface{}
+}
+
+// tryRun runs the task unless another goroutine has
+// already started it.
+// It returns false if the task was already started.
+func (b *buildTask) tryRun() bool {
+	if !atomic.CompareAndSwapInt32(&b.claimed, 0, 1) {
+		return false
+	}
+	defer close(b.done)
+	defer func() {
+		if r := recover(); r != nil {
+			b.panicked = true
+			b.panicValue = r
+		}
+	}()
+	b.run()
+	return true
+}
+
+// scheduler creates a buildScheduler for building a tree,
+// or returns nil if subtrees should not be built
+// concurrently.
+//
+// Subtrees are never built concurrently if the builder
+// draws random numbers from b.Rand while building, since
+// the numbers drawn by each node would depend on timing.
+func (b *Builder) scheduler() *buildScheduler {
+	if b.Rand != nil && (b.samplesFeatures() || b.RandomThresholds != 0) {
+		return nil
+	}
+	return newBuildScheduler(runtime.GOMAXPROCS(0) - 1)
+}
+
+// splitWorkers determines how many goroutines to use when
+// searching for a node's split.
+func splitWorkers(numSamples, numFeatures int) int {
+	work := numSamples * numFeatures
+	return essentials.MaxInt(1, essentials.MinInt(runtime.GOMAXPROCS(0),
+		work/splitWorkPerGoroutine))
+}
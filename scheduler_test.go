@@ -0,0 +1,89 @@
+package treeagent
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestSchedulerBuild(t *testing.T) {
+	gen := rand.New(rand.NewSource(1337))
+	samples := make([]*GradientSample, 5000)
+	for i := range samples {
+		features := []float64{gen.NormFloat64(), gen.NormFloat64(), gen.NormFloat64()}
+		if gen.Intn(10) == 0 {
+			features[2] = math.NaN()
+		}
+		samples[i] = &GradientSample{
+			Sample:    &memorySample{features: features},
+			Gradient:  Vector{math.Sin(3*features[0]) + features[1], gen.NormFloat64()},
+			Curvature: Vector{1, 1},
+		}
+	}
+	builders := map[string]Builder{
+		"depth":     {Algorithm: MSEAlgorithm, MaxDepth: 10},
+		"bestfirst": {Algorithm: MSEAlgorithm, MaxLeaves: 200},
+		"newton":    {Algorithm: NewtonAlgorithm, MaxDepth: 8, LeafL2: 1},
+		"histogram": {Algorithm: MSEAlgorithm, MaxDepth: 10, HistogramBins: 32},
+		"frac": {Algorithm: MSEAlgorithm, MaxDepth: 10, FeatureFrac: 0.5,
+			Rand: rand.New(rand.NewSource(1))},
+	}
+	old := runtime.GOMAXPROCS(0)
+	defer runtime.GOMAXPROCS(old)
+	for name, b := range builders {
+		var trees []*Tree
+		for _, procs := range []int{1, 4} {
+			runtime.GOMAXPROCS(procs)
+			if b.Rand != nil {
+				b.Rand = rand.New(rand.NewSource(1))
+			}
+			trees = append(trees, b.build(append([]*GradientSample{}, samples...)))
+		}
+		if countLeaves(trees[0]) < 50 {
+			t.Errorf("%s: too few leaves: %d", name, countLeaves(trees[0]))
+		}
+		if !reflect.DeepEqual(trees[0], trees[1]) {
+			t.Errorf("%s: concurrent build changed the tree", name)
+		}
+	}
+}
+
+func TestSchedulerPanic(t *testing.T) {
+	s := newBuildScheduler(2)
+	defer s.Close()
+	defer func() {
+		if r := recover(); r != "test panic" {
+			t.Errorf("unexpected panic: %v", r)
+		}
+	}()
+	task := s.Fork(func() {
+		panic("test panic")
+	})
+	s.Join(task)
+}
+
+func TestSchedulerRandomness(t *testing.T) {
+	gen := rand.New(rand.NewSource(1))
+	cases := []struct {
+		Builder    *Builder
+		Concurrent bool
+	}{
+		{&Builder{Rand: gen}, true},
+		{&Builder{Rand: gen, FeatureFrac: 1}, true},
+		{&Builder{Rand: gen, FeatureFrac: 0.5}, false},
+		{&Builder{Rand: gen, RandomThresholds: 3}, false},
+		{&Builder{FeatureFrac: 0.5}, true},
+	}
+	if runtime.GOMAXPROCS(0) < 2 {
+		t.Skip("scheduler requires multiple threads")
+	}
+	for i, c := range cases {
+		scheduler := c.Builder.scheduler()
+		if actual := scheduler != nil; actual != c.Concurrent {
+			t.Errorf("case %d: expected concurrent=%v", i, c.Concurrent)
+		}
+		scheduler.Close()
+	}
+}
@@ -0,0 +1,374 @@
+package treeagent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/unixpickle/essentials"
+)
+
+// forestMagic is the header of every binary-encoded
+// forest.
+var forestMagic = []byte("TRFB")
+
+// forestVersion is the current version of the binary
+// forest encoding.
+const forestVersion = 1
+
+// Node kinds in the binary encoding.
+const (
+	leafNodeKind        byte = 0
+	branchNodeKind      byte = 1
+	obliqueNodeKind     byte = 2
+	categoricalNodeKind byte = 3
+	linearLeafNodeKind  byte = 4
+	obliviousNodeKind   byte = 5
+)
+
+// maxObliviousDepth is the deepest oblivious tree that
+// may be decoded.
+const maxObliviousDepth = 30
+
+// maxTreeDepth is the deepest tree that may be decoded.
+// It keeps corrupt data from overflowing the stack.
+const maxTreeDepth = 1 << 16
+
+// missingLeftFlag is set in the node kind of branching
+// nodes which send missing values to LessThan.
+const missingLeftFlag byte = 0x80
+
+// WriteForest encodes a forest in a compact binary
+// format.
+//
+// The result can be decoded with ReadForest.
+func WriteForest(w io.Writer, f *Forest) (err error) {
+	defer essentials.AddCtxTo("write forest", &err)
+	bw := &binaryWriter{w: bufio.NewWriter(w)}
+	bw.Bytes(forestMagic)
+	bw.Uvarint(forestVersion)
+	bw.Floats(f.Base)
+	bw.Uvarint(uint64(len(f.Trees)))
+	for i, t := range f.Trees {
+		bw.Float(f.Weights[i])
+		bw.Tree(t)
+	}
+	return bw.Flush()
+}
+
+// ReadForest decodes a forest.
+//
+// The data may either be in the format produced by
+// WriteForest, a JSON-encoded Forest, or a checkpoint log
+// (in which case the latest checkpoint is used).
+// The format is detected automatically.
+func ReadForest(r io.Reader) (f *Forest, err error) {
+	defer essentials.AddCtxTo("read forest", &err)
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(forestMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(header, checkpointMagic) {
+		f, _, err = ReplayCheckpoints(br, -1)
+		if err == nil && f == nil {
+			err = errors.New("no checkpoints in log")
+		}
+		return
+	} else if !bytes.Equal(header, forestMagic) {
+		err = json.NewDecoder(br).Decode(&f)
+		if err == nil && f == nil {
+			err = errors.New("null forest")
+		}
+		return
+	}
+	br.Discard(len(forestMagic))
+
+	reader := &binaryReader{r: br}
+	if version := reader.Uvarint(); reader.err == nil && version != forestVersion {
+		return nil, fmt.Errorf("unsupported version: %d", version)
+	}
+	f = &Forest{Base: reader.Floats()}
+	numTrees := reader.Uvarint()
+	for i := uint64(0); i < numTrees && reader.err == nil; i++ {
+		weight := reader.Float()
+		f.Add(reader.Tree(), weight)
+	}
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	return f, nil
+}
+
+// WriteTree encodes a tree in a compact binary format.
+//
+// The result can be decoded with ReadTree.
+func WriteTree(w io.Writer, t *Tree) error {
+	bw := &binaryWriter{w: bufio.NewWriter(w)}
+	bw.Tree(t)
+	return essentials.AddCtx("write tree", bw.Flush())
+}
+
+// ReadTree decodes a tree that was encoded with
+// WriteTree.
+func ReadTree(r io.Reader) (*Tree, error) {
+	reader := &binaryReader{r: bufio.NewReader(r)}
+	t := reader.Tree()
+	if reader.err != nil {
+		return nil, essentials.AddCtx("read tree", reader.err)
+	}
+	return t, nil
+}
+
+// binaryWriter writes primitive values and records the
+// first error that occurs.
+type binaryWriter struct {
+	w   *bufio.Writer
+	err error
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (b *binaryWriter) Bytes(data []byte) {
+	if b.err == nil {
+		_, b.err = b.w.Write(data)
+	}
+}
+
+func (b *binaryWriter) Uvarint(x uint64) {
+	b.Bytes(b.buf[:binary.PutUvarint(b.buf[:], x)])
+}
+
+func (b *binaryWriter) Float(x float64) {
+	binary.LittleEndian.PutUint64(b.buf[:8], math.Float64bits(x))
+	b.Bytes(b.buf[:8])
+}
+
+func (b *binaryWriter) Floats(x []float64) {
+	b.Uvarint(uint64(len(x)))
+	for _, f := range x {
+		b.Float(f)
+	}
+}
+
+func (b *binaryWriter) Tree(t *Tree) {
+	if t.Leaf && len(t.LinearFeatures) > 0 {
+		b.Bytes([]byte{linearLeafNodeKind})
+		b.Floats(t.Params)
+		b.Uvarint(uint64(len(t.LinearFeatures)))
+		for i, feature := range t.LinearFeatures {
+			b.Uvarint(uint64(feature))
+			b.Float(t.LinearCenters[i])
+			b.Floats(t.LinearWeights[i])
+		}
+		return
+	} else if t.Leaf {
+		b.Bytes([]byte{leafNodeKind})
+		b.Floats(t.Params)
+		return
+	}
+	if features, thresholds, leaves, ok := obliviousSplits(t); ok && len(features) > 1 {
+		b.Bytes([]byte{obliviousNodeKind})
+		b.Uvarint(uint64(len(features)))
+		for i, feature := range features {
+			b.Uvarint(uint64(feature))
+			b.Float(thresholds[i])
+		}
+		for _, leaf := range leaves {
+			b.Tree(leaf)
+		}
+		return
+	}
+	var flags byte
+	if t.MissingLeft {
+		flags |= missingLeftFlag
+	}
+	if len(t.Categories) > 0 {
+		b.Bytes([]byte{categoricalNodeKind | flags})
+		b.Uvarint(uint64(t.Feature))
+		b.Floats(t.Categories)
+	} else if len(t.ObliqueFeatures) > 0 {
+		b.Bytes([]byte{obliqueNodeKind | flags})
+		b.Uvarint(uint64(len(t.ObliqueFeatures)))
+		for i, feature := range t.ObliqueFeatures {
+			b.Uvarint(uint64(feature))
+			b.Float(t.ObliqueWeights[i])
+		}
+		b.Float(t.Threshold)
+	} else {
+		b.Bytes([]byte{branchNodeKind | flags})
+		b.Uvarint(uint64(t.Feature))
+		b.Float(t.Threshold)
+	}
+	b.Tree(t.LessThan)
+	b.Tree(t.GreaterEqual)
+}
+
+func (b *binaryWriter) Flush() error {
+	if b.err == nil {
+		b.err = b.w.Flush()
+	}
+	return b.err
+}
+
+// binaryReader reads primitive values and records the
+// first error that occurs.
+//
+// After an error, all reads return zero values.
+type binaryReader struct {
+	r   *bufio.Reader
+	err error
+	buf [8]byte
+}
+
+func (b *binaryReader) Byte() byte {
+	if b.err != nil {
+		return 0
+	}
+	var res byte
+	res, b.err = b.r.ReadByte()
+	b.fixEOF()
+	return res
+}
+
+func (b *binaryReader) Uvarint() uint64 {
+	if b.err != nil {
+		return 0
+	}
+	var res uint64
+	res, b.err = binary.ReadUvarint(b.r)
+	b.fixEOF()
+	return res
+}
+
+func (b *binaryReader) Int() int {
+	x := b.Uvarint()
+	if x > math.MaxInt32 {
+		b.fail(errors.New("integer out of range"))
+		return 0
+	}
+	return int(x)
+}
+
+func (b *binaryReader) Float() float64 {
+	if b.err != nil {
+		return 0
+	}
+	_, b.err = io.ReadFull(b.r, b.buf[:])
+	b.fixEOF()
+	return math.Float64frombits(binary.LittleEndian.Uint64(b.buf[:]))
+}
+
+func (b *binaryReader) Floats() []float64 {
+	n := b.Int()
+	if b.err != nil {
+		return nil
+	}
+	res := make([]float64, 0, essentials.MinInt(n, 1<<16))
+	for i := 0; i < n && b.err == nil; i++ {
+		res = append(res, b.Float())
+	}
+	return res
+}
+
+func (b *binaryReader) Tree() *Tree {
+	return b.tree(0)
+}
+
+// tree decodes a tree which is depth levels below the
+// root of the tree being decoded.
+func (b *binaryReader) tree(depth int) *Tree {
+	if depth > maxTreeDepth {
+		b.fail(fmt.Errorf("tree deeper than %d levels", maxTreeDepth))
+		return &Tree{Leaf: true}
+	}
+	kind := b.Byte()
+	if kind == leafNodeKind {
+		return &Tree{Leaf: true, Params: b.Floats()}
+	} else if kind == linearLeafNodeKind {
+		res := &Tree{Leaf: true, Params: b.Floats()}
+		n := b.Int()
+		for i := 0; i < n && b.err == nil; i++ {
+			res.LinearFeatures = append(res.LinearFeatures, b.Int())
+			res.LinearCenters = append(res.LinearCenters, b.Float())
+			res.LinearWeights = append(res.LinearWeights, b.Floats())
+		}
+		if b.err == nil && n == 0 {
+			b.fail(errors.New("linear leaf has no features"))
+		}
+		return res
+	} else if kind == obliviousNodeKind {
+		return b.obliviousTree(depth)
+	}
+	res := &Tree{MissingLeft: kind&missingLeftFlag != 0}
+	switch kind &^ missingLeftFlag {
+	case branchNodeKind:
+		res.Feature = b.Int()
+		res.Threshold = b.Float()
+	case obliqueNodeKind:
+		n := b.Int()
+		for i := 0; i < n && b.err == nil; i++ {
+			res.ObliqueFeatures = append(res.ObliqueFeatures, b.Int())
+			res.ObliqueWeights = append(res.ObliqueWeights, b.Float())
+		}
+		if b.err == nil && n == 0 {
+			b.fail(errors.New("oblique node has no features"))
+		}
+		res.Threshold = b.Float()
+	case categoricalNodeKind:
+		res.Feature = b.Int()
+		res.Categories = b.Floats()
+		if b.err == nil && len(res.Categories) == 0 {
+			b.fail(errors.New("categorical node has no categories"))
+		}
+	default:
+		b.fail(fmt.Errorf("unknown node kind: %d", kind))
+		return &Tree{Leaf: true}
+	}
+	res.LessThan = b.tree(depth + 1)
+	res.GreaterEqual = b.tree(depth + 1)
+	return res
+}
+
+func (b *binaryReader) obliviousTree(treeDepth int) *Tree {
+	depth := b.Int()
+	if b.err == nil && (depth == 0 || depth > maxObliviousDepth) {
+		b.fail(fmt.Errorf("invalid oblivious depth: %d", depth))
+	}
+	if b.err != nil {
+		return &Tree{Leaf: true}
+	}
+	features := make([]int, depth)
+	thresholds := make([]float64, depth)
+	for i := range features {
+		features[i] = b.Int()
+		thresholds[i] = b.Float()
+	}
+	leaves := make([]*Tree, 1<<uint(depth))
+	for i := range leaves {
+		if b.err != nil {
+			return &Tree{Leaf: true}
+		}
+		leaves[i] = b.tree(treeDepth + depth)
+		if !leaves[i].Leaf {
+			b.fail(errors.New("oblivious tree has non-leaf node"))
+		}
+	}
+	return obliviousTree(features, thresholds, leaves)
+}
+
+func (b *binaryReader) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+func (b *binaryReader) fixEOF() {
+	if b.err == io.EOF {
+		b.err = io.ErrUnexpectedEOF
+	}
+}
@@ -0,0 +1,78 @@
+package treeagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestForestBinary(t *testing.T) {
+	forest := benchmarkingForest(10, 3, 5, 3)
+	var buf bytes.Buffer
+	if err := WriteForest(&buf, forest); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ReadForest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testForestsEqual(t, forest, decoded)
+}
+
+func TestForestJSONDetection(t *testing.T) {
+	forest := benchmarkingForest(10, 3, 5, 3)
+	data, err := json.Marshal(forest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ReadForest(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testForestsEqual(t, forest, decoded)
+}
+
+func TestForestBinaryTruncated(t *testing.T) {
+	forest := benchmarkingForest(3, 2, 5, 3)
+	var buf bytes.Buffer
+	if err := WriteForest(&buf, forest); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	for _, size := range []int{5, len(data) / 2, len(data) - 1} {
+		if _, err := ReadForest(bytes.NewReader(data[:size])); err == nil {
+			t.Errorf("expected error for %d/%d bytes", size, len(data))
+		}
+	}
+}
+
+func TestTreeBinaryTooDeep(t *testing.T) {
+	// Encode a chain of branches which never ends.
+	var data []byte
+	for i := 0; i <= maxTreeDepth+1; i++ {
+		data = append(data, branchNodeKind, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	}
+	_, err := ReadTree(bytes.NewReader(data))
+	if err == nil || !strings.Contains(err.Error(), "deeper") {
+		t.Errorf("expected depth error but got %v", err)
+	}
+}
+
+func testForestsEqual(t *testing.T, expected, actual *Forest) {
+	if !reflect.DeepEqual(expected.Base, actual.Base) {
+		t.Errorf("expected base %v but got %v", expected.Base, actual.Base)
+	}
+	if !reflect.DeepEqual(expected.Weights, actual.Weights) {
+		t.Errorf("expected weights %v but got %v", expected.Weights, actual.Weights)
+	}
+	if len(expected.Trees) != len(actual.Trees) {
+		t.Fatalf("expected %d trees but got %d", len(expected.Trees), len(actual.Trees))
+	}
+	for i, tree := range expected.Trees {
+		if !reflect.DeepEqual(tree, actual.Trees[i]) {
+			t.Errorf("tree %d differs", i)
+		}
+	}
+}
@@ -2,17 +2,15 @@ package treeagent
 
 // SignTree copies the tree and sets every parameter to 1
 // or -1 depending on its sign.
+//
+// Linear leaves are replaced by constant leaves, using
+// the signs of their Params.
 func SignTree(t *Tree) *Tree {
 	if t.Leaf {
 		return &Tree{
 			Leaf:   true,
-			Params: ActionParams(smallVec(t.Params).Copy().Signs()),
+			Params: ActionParams(Vector(t.Params).Copy().Signs()),
 		}
 	}
-	return &Tree{
-		Feature:      t.Feature,
-		Threshold:    t.Threshold,
-		LessThan:     SignTree(t.LessThan),
-		GreaterEqual: SignTree(t.GreaterEqual),
-	}
+	return t.branchCopy(SignTree(t.LessThan), SignTree(t.GreaterEqual))
 }
@@ -28,46 +28,54 @@ func numToFloat(num anyvec.Numeric) float64 {
 	}
 }
 
-// smallVec is a native vector type optimized to be used
+// Vector is a native vector type optimized to be used
 // with a small number of components.
+// It is used for gradients and curvatures, so custom
+// TreeAlgorithms can use it to implement SplitTrackers.
 //
-// Most smallVec methods return the receiver so that
+// Most Vector methods return the receiver so that
 // vector operations can be chained more easily.
-type smallVec []float64
+type Vector []float64
 
-func (s smallVec) Copy() smallVec {
-	return append(smallVec{}, s...)
+// Copy creates a copy of the vector.
+func (s Vector) Copy() Vector {
+	return append(Vector{}, s...)
 }
 
-func (s smallVec) Scale(scale float64) smallVec {
+// Scale scales the vector in place.
+func (s Vector) Scale(scale float64) Vector {
 	for i, x := range s {
 		s[i] = x * scale
 	}
 	return s
 }
 
-func (s smallVec) Add(other smallVec) smallVec {
+// Add adds another vector to s in place.
+func (s Vector) Add(other Vector) Vector {
 	for i, x := range other {
 		s[i] += x
 	}
 	return s
 }
 
-func (s smallVec) Sub(other smallVec) smallVec {
+// Sub subtracts another vector from s in place.
+func (s Vector) Sub(other Vector) Vector {
 	for i, x := range other {
 		s[i] -= x
 	}
 	return s
 }
 
-func (s smallVec) Mul(other smallVec) smallVec {
+// Mul multiplies s by another vector, component-wise.
+func (s Vector) Mul(other Vector) Vector {
 	for i, x := range other {
 		s[i] *= x
 	}
 	return s
 }
 
-func (s smallVec) Dot(other smallVec) float64 {
+// Dot computes the dot product of two vectors.
+func (s Vector) Dot(other Vector) float64 {
 	var res float64
 	for i, x := range s {
 		res += x * other[i]
@@ -75,7 +83,9 @@ func (s smallVec) Dot(other smallVec) float64 {
 	return res
 }
 
-func (s smallVec) AbsSum() float64 {
+// AbsSum computes the sum of the absolute values of
+// the components.
+func (s Vector) AbsSum() float64 {
 	var res float64
 	for _, x := range s {
 		if x < 0 {
@@ -87,7 +97,8 @@ func (s smallVec) AbsSum() float64 {
 	return res
 }
 
-func (s smallVec) Signs() smallVec {
+// Signs replaces each non-zero component with its sign.
+func (s Vector) Signs() Vector {
 	for i, x := range s {
 		if x < 0 {
 			s[i] = -1
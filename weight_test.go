@@ -0,0 +1,105 @@
+package treeagent
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestWeightedBuild(t *testing.T) {
+	// Integer gradients make the sums exact, so that both
+	// sets of samples give exactly the same splits.
+	gen := rand.New(rand.NewSource(1337))
+	var weighted, duplicated, unit []*GradientSample
+	for i := 0; i < 300; i++ {
+		features := []float64{gen.NormFloat64(), gen.NormFloat64()}
+		grad := Vector{math.Round(4*features[0]) + float64(gen.Intn(3)),
+			math.Round(features[1] * features[0])}
+		curvature := Vector{float64(1 + gen.Intn(3)), float64(1 + gen.Intn(3))}
+		sample := &memorySample{features: features}
+		weight := float64(1 + i%2)
+		weighted = append(weighted, &GradientSample{
+			Sample:    NewWeightedSample(sample, weight),
+			Gradient:  grad.Copy().Scale(weight),
+			Curvature: curvature.Copy().Scale(weight),
+		})
+		for j := 0; j < int(weight); j++ {
+			duplicated = append(duplicated, &GradientSample{
+				Sample:    sample,
+				Gradient:  grad.Copy(),
+				Curvature: curvature.Copy(),
+			})
+		}
+		unit = append(unit, &GradientSample{
+			Sample:    NewWeightedSample(sample, 1),
+			Gradient:  grad.Copy(),
+			Curvature: curvature.Copy(),
+		})
+	}
+	for _, algo := range TreeAlgorithms {
+		b := &Builder{Algorithm: algo, MaxDepth: 3, LeafL2: 0.5}
+		expected := b.build(append([]*GradientSample{}, duplicated...))
+		actual := b.build(append([]*GradientSample{}, weighted...))
+		if !treesClose(actual, expected) {
+			t.Errorf("%s: weighted tree differs from duplicated tree", algo)
+		}
+
+		var plain []*GradientSample
+		for _, sample := range unit {
+			plain = append(plain, &GradientSample{
+				Sample:    sample.Sample.(*weightedSample).Sample,
+				Gradient:  sample.Gradient,
+				Curvature: sample.Curvature,
+			})
+		}
+		expected = b.build(plain)
+		actual = b.build(append([]*GradientSample{}, unit...))
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: unit weights changed the tree", algo)
+		}
+	}
+}
+
+func TestWeightedMinibatch(t *testing.T) {
+	var samples []Sample
+	for i := 0; i < 100; i++ {
+		sample := &memorySample{features: []float64{float64(i)}}
+		samples = append(samples, NewWeightedSample(sample, float64(i%2)))
+	}
+	batch := Minibatch(samples, 1)
+	if len(batch) != 50 {
+		t.Fatalf("expected 50 samples but got %d", len(batch))
+	}
+	for _, sample := range batch {
+		if SampleWeight(sample) != 1 {
+			t.Fatal("selected sample with zero weight")
+		}
+	}
+}
+
+func TestWeightedUint8Samples(t *testing.T) {
+	ch := make(chan Sample, 2)
+	ch <- NewWeightedSample(&memorySample{features: []float64{3}}, 0.5)
+	ch <- &memorySample{features: []float64{4}}
+	close(ch)
+	res := AllSamples(Uint8Samples(ch))
+	if SampleWeight(res[0]) != 0.5 || SampleWeight(res[1]) != 1 {
+		t.Errorf("unexpected weights: %f, %f", SampleWeight(res[0]),
+			SampleWeight(res[1]))
+	}
+	if res[0].Feature(0) != 3 || res[1].Feature(0) != 4 {
+		t.Error("unexpected features")
+	}
+}
+
+func treesClose(t1, t2 *Tree) bool {
+	if t1.Leaf != t2.Leaf {
+		return false
+	} else if t1.Leaf {
+		return Vector(t1.Params).Copy().Sub(Vector(t2.Params)).AbsSum() < 1e-8
+	}
+	return t1.Feature == t2.Feature && t1.Threshold == t2.Threshold &&
+		treesClose(t1.LessThan, t2.LessThan) &&
+		treesClose(t1.GreaterEqual, t2.GreaterEqual)
+}